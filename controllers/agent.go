@@ -0,0 +1,159 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	agentUsername string
+	agentPassword string
+
+	agentPort    = "4242"
+	agentTimeout = time.Duration(15) * time.Minute
+)
+
+// SetAgentCredentials sets the credentials used to call the other squid instances
+func SetAgentCredentials(username string, password string) {
+	agentUsername = username
+	agentPassword = password
+}
+
+// nodeURL is the URL advertised by a node or http://<node>:4242
+func nodeURL(node string) (string, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	status, ok := statuses[node]
+	if !ok {
+		return "", notFoundError("unknown node " + node)
+	}
+	if status.URL != "" {
+		return strings.TrimRight(status.URL, "/"), nil
+	}
+	return "http://" + node + ":" + agentPort, nil
+}
+
+// agentRequest calls the API of the agent of a node and decodes
+// the JSON response in out when not nil
+func agentRequest(node string, method string, path string, body interface{}, out interface{}) (int, error) {
+	return lockedAgentRequest(node, "", method, path, body, out)
+}
+
+// lockedAgentRequest calls the API of the agent of a node for an operation
+// holding the global lock with a token, the agent checks it with the server
+func lockedAgentRequest(node string, lock string, method string, path string, body interface{}, out interface{}) (int, error) {
+	url, err := nodeURL(node)
+	if err != nil {
+		return 0, err
+	}
+
+	var reader io.Reader
+	if body != nil {
+		in, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewBuffer(in)
+	}
+
+	req, err := http.NewRequest(method, url+"/api"+path, reader)
+	if err != nil {
+		return 0, err
+	}
+	req.SetBasicAuth(agentUsername, agentPassword)
+	if lock != "" {
+		req.Header.Set(lockHeader, lock)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	client := http.Client{Timeout: agentTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+
+	if out != nil && json.Unmarshal(content, out) == nil {
+		return resp.StatusCode, nil
+	}
+	if resp.StatusCode >= 300 {
+		var msg string
+		if json.Unmarshal(content, &msg) != nil {
+			msg = string(content)
+		}
+		return resp.StatusCode, errors.New(msg)
+	}
+	if out != nil {
+		return resp.StatusCode, fmt.Errorf("unexpected response from %s: %s", node, content)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// proxyAgent forwards a request to the agent of a node and streams its
+// response, flushed as it comes for the server-sent events
+func proxyAgent(c *gin.Context, node string, path string) {
+	url, err := nodeURL(node)
+	if err != nil {
+		c.JSON(errorStatus(err), err.Error())
+		return
+	}
+
+	req, err := http.NewRequest(c.Request.Method, url+"/api"+path, c.Request.Body)
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+	req = req.WithContext(c.Request.Context())
+	req.URL.RawQuery = c.Request.URL.RawQuery
+	req.SetBasicAuth(agentUsername, agentPassword)
+	if contentType := c.Request.Header.Get("Content-Type"); contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	// No timeout: the streams last until the client is gone
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.JSON(502, node+": "+err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, header := range []string{"Content-Type", "Cache-Control"} {
+		if value := resp.Header.Get(header); value != "" {
+			c.Header(header, value)
+		}
+	}
+	c.Status(resp.StatusCode)
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err := c.Writer.Write(buf[:n]); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,472 @@
+package controllers
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	canaries = map[string]*canary{}
+
+	defaultSoak  = 300
+	canariesKept = 50
+)
+
+// Status of a canary deployment
+const (
+	canaryDeploying = "deploying"
+	canarySoaking   = "soaking"
+	canaryPromoted  = "promoted"
+	canaryAborted   = "aborted"
+)
+
+type canarySpec struct {
+	Compose     string   `json:"compose"`
+	Definition  string   `json:"definition"`
+	Nodes       []string `json:"nodes"`
+	Canaries    int      `json:"canaries"`
+	Percent     int      `json:"percent"`
+	Soak        int      `json:"soak"`
+	WaitTimeout int      `json:"waitTimeout"`
+	BatchSize   int      `json:"batchSize"`
+}
+
+type canary struct {
+	ID        string     `json:"id"`
+	Spec      canarySpec `json:"spec"`
+	User      string     `json:"user"`
+	Status    string     `json:"status"`
+	Started   int64      `json:"started"`
+	Ended     int64      `json:"ended,omitempty"`
+	Canaries  []string   `json:"canaries"`
+	Others    []string   `json:"others"`
+	Evidence  []string   `json:"evidence"`
+	Rollout   string     `json:"rollout,omitempty"`
+	Execution string     `json:"execution,omitempty"`
+	// Nodes is what happened on each canary
+	Nodes []*rolloutNode `json:"nodes"`
+
+	lock     string
+	rollout  *rollout
+	restores map[string]canaryRestore
+}
+
+// canaryRestore is the rollback of a canary to its previous definition
+type canaryRestore struct {
+	Execution string
+	Error     string
+}
+
+// StartCanary deploys a new compose definition on some nodes, watches them
+// during a soak period then promotes it to the other nodes or restores them
+func StartCanary(c *gin.Context) {
+	var spec canarySpec
+	if err := c.BindJSON(&spec); err != nil {
+		c.JSON(400, err.Error())
+		return
+	}
+
+	k, err := newCanary(spec, authUser(c))
+	if err != nil {
+		c.JSON(errorStatus(err), err.Error())
+		return
+	}
+
+	go k.run()
+
+	rmx.RLock()
+	defer rmx.RUnlock()
+	c.JSON(200, k.redacted())
+}
+
+func ListCanaries(c *gin.Context) {
+	rmx.RLock()
+	defer rmx.RUnlock()
+
+	list := []*canary{}
+	for _, k := range canaries {
+		list = append(list, k.redacted())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Started > list[j].Started
+	})
+
+	c.JSON(200, list)
+}
+
+// GetCanary returns a canary, the secrets of its definition are
+// redacted unless an admin asks for them
+func GetCanary(c *gin.Context) {
+	redact, ok := redactionFor(c)
+	if !ok {
+		return
+	}
+
+	rmx.RLock()
+	defer rmx.RUnlock()
+
+	k, ok := canaries[c.Param("id")]
+	if !ok {
+		c.JSON(404, "canary not found")
+		return
+	}
+
+	if redact {
+		k = k.redacted()
+	}
+	c.JSON(200, k)
+}
+
+func newCanary(spec canarySpec, user string) (*canary, error) {
+	if spec.Compose == "" {
+		return nil, badRequestError("compose is required")
+	}
+	if _, err := composeFilePath(spec.Compose); err != nil {
+		return nil, badRequestError(err.Error())
+	}
+	if spec.Definition == "" {
+		return nil, badRequestError("definition is required")
+	}
+	if err := checkDefinition(spec.Compose, []byte(spec.Definition)); err != nil {
+		return nil, badRequestError("invalid definition: " + err.Error())
+	}
+	if spec.Soak <= 0 {
+		spec.Soak = defaultSoak
+	}
+	if spec.WaitTimeout <= 0 {
+		spec.WaitTimeout = defaultWaitTimeout
+	}
+	if spec.BatchSize <= 0 {
+		spec.BatchSize = defaultBatchSize
+	}
+	if len(spec.Nodes) == 0 {
+		spec.Nodes = nodesRunningCompose(spec.Compose)
+	}
+	for _, node := range spec.Nodes {
+		if _, err := nodeURL(node); err != nil {
+			return nil, err
+		}
+	}
+	if len(spec.Nodes) == 0 {
+		return nil, badRequestError("no node runs " + spec.Compose)
+	}
+
+	// The canaries are the first nodes, one by default
+	nbCanaries := spec.Canaries
+	if spec.Percent > 0 {
+		nbCanaries = (len(spec.Nodes)*spec.Percent + 99) / 100
+	}
+	if nbCanaries <= 0 {
+		nbCanaries = 1
+	}
+	if nbCanaries > len(spec.Nodes) {
+		nbCanaries = len(spec.Nodes)
+	}
+
+	lock, err := acquireGlobalLock("canary of "+spec.Compose+" by "+user, defaultLockTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &canary{
+		ID:       newExecutionID(),
+		Spec:     spec,
+		User:     user,
+		Status:   canaryDeploying,
+		Started:  time.Now().Unix(),
+		Canaries: spec.Nodes[:nbCanaries],
+		Others:   spec.Nodes[nbCanaries:],
+		Evidence: []string{},
+		Nodes:    []*rolloutNode{},
+		lock:     lock,
+		restores: map[string]canaryRestore{},
+	}
+	for _, node := range k.Canaries {
+		k.Nodes = append(k.Nodes, &rolloutNode{Node: node, Status: nodePending})
+	}
+
+	rmx.Lock()
+	canaries[k.ID] = k
+	forgetOldCanaries()
+	rmx.Unlock()
+
+	return k, nil
+}
+
+func (k *canary) run() {
+	// The lock is handed over to the rollout promoting the canary
+	defer func() {
+		rmx.RLock()
+		promoted := k.Rollout != ""
+		rmx.RUnlock()
+		if !promoted {
+			releaseGlobalLock(k.lock)
+		}
+	}()
+
+	healthy := k.deployCanaries()
+	if healthy {
+		healthy = k.soak()
+	}
+
+	if healthy {
+		k.promote()
+	} else {
+		k.restore()
+	}
+
+	k.record()
+}
+
+func (k *canary) update(f func()) {
+	rmx.Lock()
+	defer rmx.Unlock()
+	f()
+}
+
+func (k *canary) observe(format string, args ...interface{}) {
+	line := time.Now().UTC().Format(time.RFC3339) + " " + fmt.Sprintf(format, args...)
+	k.update(func() { k.Evidence = append(k.Evidence, line) })
+}
+
+// deployCanaries deploys the new definition on the canaries
+// and waits for them to be healthy
+func (k *canary) deployCanaries() bool {
+	rolloutBatchNodes(rolloutSpec{
+		Compose:     k.Spec.Compose,
+		Definition:  k.Spec.Definition,
+		WaitTimeout: k.Spec.WaitTimeout,
+	}, k.lock, k.Nodes, k.update)
+
+	healthy := true
+	for _, n := range k.Nodes {
+		rmx.RLock()
+		status, execution, detail := n.Status, n.Execution, n.Detail
+		rmx.RUnlock()
+
+		k.observe("%s deploy %s (execution %s) %s", n.Node, status, execution, detail)
+		if status != nodeHealthy {
+			healthy = false
+		}
+	}
+
+	return healthy
+}
+
+// soak watches the reported status of the canaries during the soak period
+func (k *canary) soak() bool {
+	k.update(func() { k.Status = canarySoaking })
+
+	start := time.Now()
+	end := start.Add(time.Duration(k.Spec.Soak) * time.Second)
+	for time.Now().Before(end) {
+		time.Sleep(rolloutCheckPeriod)
+
+		for _, n := range k.Nodes {
+			done, healthy, detail := nodeComposeHealth(n.Node, k.Spec.Compose, start.Unix())
+			if done && !healthy {
+				k.fail(n, "unhealthy during soak: "+detail)
+				return false
+			}
+		}
+	}
+
+	for _, n := range k.Nodes {
+		done, healthy, detail := nodeComposeHealth(n.Node, k.Spec.Compose, start.Unix())
+		if !done || !healthy {
+			k.fail(n, "not healthy at the end of the soak: "+detail)
+			return false
+		}
+		k.observe("%s healthy after a soak of %ds", n.Node, k.Spec.Soak)
+	}
+
+	return true
+}
+
+// fail marks a canary failed
+func (k *canary) fail(n *rolloutNode, detail string) {
+	k.update(func() {
+		n.Status = nodeFailed
+		n.Detail = detail
+	})
+	k.observe("%s %s", n.Node, detail)
+}
+
+// promote rolls out the new definition to the other nodes
+// and waits for the end of the rollout
+func (k *canary) promote() {
+	k.update(func() { k.Status = canaryPromoted })
+
+	if len(k.Others) == 0 {
+		k.observe("no other node to promote to")
+		return
+	}
+
+	r, err := newRollout(rolloutSpec{
+		Compose:     k.Spec.Compose,
+		Definition:  k.Spec.Definition,
+		Nodes:       k.Others,
+		BatchSize:   k.Spec.BatchSize,
+		WaitTimeout: k.Spec.WaitTimeout,
+	}, k.User, k.lock)
+	if err != nil {
+		k.observe("fail to promote: %s", err)
+		return
+	}
+
+	k.observe("promoted to %v by rollout %s", k.Others, r.ID)
+	k.update(func() {
+		k.Rollout = r.ID
+		k.rollout = r
+	})
+	r.run()
+
+	rmx.RLock()
+	status, reason := r.Status, r.Reason
+	rmx.RUnlock()
+	k.observe("rollout %s %s %s", r.ID, status, reason)
+}
+
+// restore rolls back the canaries which applied the new definition to
+// their last successful deployment before it, the others are unchanged
+func (k *canary) restore() {
+	k.update(func() { k.Status = canaryAborted })
+
+	for _, n := range k.Nodes {
+		rmx.RLock()
+		applied := n.Execution
+		rmx.RUnlock()
+
+		if applied == "" {
+			k.observe("%s not restored: the definition was not applied", n.Node)
+			continue
+		}
+
+		query := "file=" + url.QueryEscape(k.Spec.Compose) + "&execution=" + url.QueryEscape(applied)
+		var e execution
+		code, err := lockedAgentRequest(n.Node, k.lock, "POST", "/compose/rollback?"+query, nil, &e)
+		restore := canaryRestore{Execution: e.ID}
+		switch {
+		case err != nil:
+			restore.Error = err.Error()
+			k.observe("%s fail to restore: %s", n.Node, err)
+		case code != 200:
+			restore.Error = "restore " + e.Status
+			k.observe("%s restore %s (execution %s)", n.Node, e.Status, e.ID)
+		default:
+			k.observe("%s restored (execution %s)", n.Node, e.ID)
+		}
+		k.update(func() { k.restores[n.Node] = restore })
+	}
+}
+
+// record historizes the canary decision and its evidence with
+// the result of the deployment on each node
+func (k *canary) record() {
+	rmx.RLock()
+	e := &execution{
+		Kind:     kindCanary,
+		Date:     k.Started,
+		User:     k.User,
+		Decision: k.Status,
+		Evidence: append([]string{}, k.Evidence...),
+		Results:  []*cmdResult{},
+	}
+	for _, n := range k.Nodes {
+		result := k.nodeResult(n)
+		if restore, ok := k.restores[n.Node]; ok {
+			result.RolledBack = restore.Execution
+			if restore.Error != "" {
+				result.Error = strings.TrimPrefix(result.Error+"; restore: "+restore.Error, "; ")
+			}
+		}
+		e.Results = append(e.Results, result)
+	}
+	if k.rollout != nil {
+		for _, batch := range k.rollout.Batches {
+			for _, n := range batch.Nodes {
+				e.Results = append(e.Results, k.nodeResult(n))
+			}
+		}
+	}
+	aborted := k.Status == canaryAborted
+	rmx.RUnlock()
+
+	e.Status = executionStatus(e.Results)
+	if aborted {
+		e.Status = executionFailed
+	}
+	recordExecution(e)
+
+	logrus.WithField("canary", k.ID).Infof("Canary of %s %s", k.Spec.Compose, k.Status)
+
+	k.update(func() {
+		k.Execution = e.ID
+		k.Ended = time.Now().Unix()
+	})
+}
+
+// nodeResult is the result of the deployment of the definition on a node
+// with the compose file and the hash reported by its agent
+func (k *canary) nodeResult(n *rolloutNode) *cmdResult {
+	path, _ := composeFilePath(k.Spec.Compose)
+	result := &cmdResult{
+		Date:    k.Started,
+		Node:    n.Node,
+		Compose: path,
+		Status:  resultSuccess,
+		Error:   n.Detail,
+		Result:  []string{},
+	}
+	if n.result != nil {
+		result.Compose = n.result.Compose
+		result.ExitCode = n.result.ExitCode
+		result.Hash = n.result.Hash
+		result.Snapshot = k.Spec.Definition
+	}
+
+	switch n.Status {
+	case nodeHealthy:
+	case nodePending:
+		result.Status = resultSkipped
+		result.Error = "not deployed"
+	default:
+		result.Status = resultFailed
+	}
+
+	return result
+}
+
+// forgetOldCanaries keeps only the most recent ended canaries,
+// their decision stays in the history
+func forgetOldCanaries() {
+	list := []*canary{}
+	for _, k := range canaries {
+		list = append(list, k)
+	}
+	if len(list) <= canariesKept {
+		return
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Started > list[j].Started
+	})
+	for _, k := range list[canariesKept:] {
+		if k.Ended != 0 {
+			delete(canaries, k.ID)
+		}
+	}
+}
+
+// redacted copies a canary with the secrets of its definition redacted
+func (k *canary) redacted() *canary {
+	redacted := *k
+	redacted.Spec.Definition = redactText(k.Spec.Definition)
+	return &redacted
+}
@@ -0,0 +1,72 @@
+package controllers
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestCanaryNodeResult(t *testing.T) {
+	k := &canary{Spec: canarySpec{Compose: "web.yml", Definition: "services: {}"}}
+	path, _ := composeFilePath("web.yml")
+	agentResult := &cmdResult{Compose: "/srv/compose/web.yml", Hash: "abc", ExitCode: 0}
+
+	tests := []struct {
+		name     string
+		n        *rolloutNode
+		status   string
+		compose  string
+		snapshot bool
+	}{
+		{"healthy", &rolloutNode{Node: "a", Status: nodeHealthy, Execution: "1", result: agentResult}, resultSuccess, agentResult.Compose, true},
+		{"unhealthy", &rolloutNode{Node: "b", Status: nodeFailed, Execution: "2", result: agentResult}, resultFailed, agentResult.Compose, true},
+		{"refused by the agent", &rolloutNode{Node: "c", Status: nodeFailed, Detail: "compose file locked"}, resultFailed, path, false},
+		{"not deployed", &rolloutNode{Node: "d", Status: nodePending}, resultSkipped, path, false},
+	}
+
+	for _, test := range tests {
+		result := k.nodeResult(test.n)
+		if result.Status != test.status {
+			t.Errorf("%s: expected status %s, got %s", test.name, test.status, result.Status)
+		}
+		if result.Compose != test.compose {
+			t.Errorf("%s: expected compose %s, got %s", test.name, test.compose, result.Compose)
+		}
+		if (result.Snapshot != "") != test.snapshot || (result.Hash != "") != test.snapshot {
+			t.Errorf("%s: expected a snapshot %v, got %q (hash %q)", test.name, test.snapshot, result.Snapshot, result.Hash)
+		}
+		if result.Node != test.n.Node {
+			t.Errorf("%s: expected node %s, got %s", test.name, test.n.Node, result.Node)
+		}
+	}
+}
+
+func TestForgetOldCanaries(t *testing.T) {
+	defer func(previous map[string]*canary, kept int) {
+		rmx.Lock()
+		canaries, canariesKept = previous, kept
+		rmx.Unlock()
+	}(canaries, canariesKept)
+
+	rmx.Lock()
+	canariesKept = 2
+	canaries = map[string]*canary{
+		"1": {ID: "1", Started: 1, Ended: 2},
+		// Still soaking
+		"2": {ID: "2", Started: 2},
+		"3": {ID: "3", Started: 3, Ended: 4},
+		"4": {ID: "4", Started: 4, Ended: 5},
+		"5": {ID: "5", Started: 5},
+	}
+	forgetOldCanaries()
+	kept := []string{}
+	for id := range canaries {
+		kept = append(kept, id)
+	}
+	rmx.Unlock()
+
+	sort.Strings(kept)
+	if expected := []string{"2", "4", "5"}; !reflect.DeepEqual(kept, expected) {
+		t.Errorf("expected the canaries %v kept, got %v", expected, kept)
+	}
+}
@@ -0,0 +1,462 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	catalogDir = "catalog"
+	cmx        sync.RWMutex
+
+	// Agent side: the compose files synced from the catalog of the server
+	catalogEnabled  = false
+	catalogSynced   = ".catalog.json"
+	catalogSyncLock sync.Mutex
+
+	placementFile = "placement.json"
+
+	nodeLabels = map[string]string{}
+)
+
+type catalogEntry struct {
+	Name      string            `json:"name"`
+	Hash      string            `json:"hash"`
+	Size      int64             `json:"size"`
+	Placement map[string]string `json:"placement"`
+}
+
+// SetLabels sets the labels of the node used to place compose files
+func SetLabels(labels map[string]string) {
+	nodeLabels = labels
+}
+
+// ParseLabels parses labels formatted as key=value,key=value
+func ParseLabels(s string) map[string]string {
+	labels := map[string]string{}
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 {
+			labels[parts[0]] = parts[1]
+		} else {
+			labels[parts[0]] = ""
+		}
+	}
+	return labels
+}
+
+// SetCatalogDir sets the directory where the server stores the catalog
+func SetCatalogDir(dir string) {
+	catalogDir = dir
+}
+
+// ---------
+// Server side
+
+// ListCatalog lists the compose files of the catalog with their placement
+func ListCatalog(c *gin.Context) {
+	entries, err := catalogEntries()
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	c.JSON(200, entries)
+}
+
+// GetCatalogFile returns the content of a compose file of the catalog,
+// redacted unless an admin or an agent asks for unredacted=true
+func GetCatalogFile(c *gin.Context) {
+	redact, ok := agentRedactionFor(c)
+	if !ok {
+		return
+	}
+
+	path, err := catalogPath(c.Param("name"))
+	if err != nil {
+		c.JSON(400, err.Error())
+		return
+	}
+
+	cmx.RLock()
+	defer cmx.RUnlock()
+
+	in, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		c.JSON(404, "compose file not found")
+		return
+	}
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	c.Header("X-Squid-Hash", contentHash(in))
+	if redact {
+		in = []byte(redactText(string(in)))
+	}
+	c.Data(200, "application/x-yaml", in)
+}
+
+// PutCatalogFile adds or replaces a compose file of the catalog
+func PutCatalogFile(c *gin.Context) {
+	path, err := catalogPath(c.Param("name"))
+	if err != nil {
+		c.JSON(400, err.Error())
+		return
+	}
+
+	in, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+	if err := checkDefinition(c.Param("name"), in); err != nil {
+		c.JSON(400, err.Error())
+		return
+	}
+
+	cmx.Lock()
+	defer cmx.Unlock()
+
+	if err := writeComposeFile(path, in); err != nil {
+		handleError(c, err)
+		return
+	}
+
+	c.JSON(200, gin.H{"name": c.Param("name"), "hash": contentHash(in)})
+}
+
+func DeleteCatalogFile(c *gin.Context) {
+	name := c.Param("name")
+	path, err := catalogPath(name)
+	if err != nil {
+		c.JSON(400, err.Error())
+		return
+	}
+
+	cmx.Lock()
+	defer cmx.Unlock()
+
+	if err := os.Remove(path); os.IsNotExist(err) {
+		c.JSON(404, "compose file not found")
+		return
+	} else if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	placement, err := readPlacement()
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+	delete(placement, name)
+	if err := writePlacement(placement); err != nil {
+		handleError(c, err)
+		return
+	}
+
+	c.JSON(200, true)
+}
+
+// PutPlacement sets the labels a node must have to run a compose file
+func PutPlacement(c *gin.Context) {
+	name := c.Param("name")
+	if _, err := catalogPath(name); err != nil {
+		c.JSON(400, err.Error())
+		return
+	}
+
+	var labels map[string]string
+	if err := c.BindJSON(&labels); err != nil {
+		c.JSON(400, err.Error())
+		return
+	}
+
+	cmx.Lock()
+	defer cmx.Unlock()
+
+	placement, err := readPlacement()
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+	placement[name] = labels
+	if err := writePlacement(placement); err != nil {
+		handleError(c, err)
+		return
+	}
+
+	c.JSON(200, placement[name])
+}
+
+// GetAssignments lists the compose files of the catalog placed on a node
+// given the labels in query (key=value,key=value) or the reported ones
+func GetAssignments(c *gin.Context) {
+	node := c.Param("node")
+
+	labels := ParseLabels(c.Query("labels"))
+	if len(labels) == 0 {
+		m.RLock()
+		labels = statuses[node].Labels
+		m.RUnlock()
+	}
+
+	entries, err := catalogEntries()
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	assigned := []catalogEntry{}
+	for _, entry := range entries {
+		if entry.Placement != nil && matchLabels(labels, entry.Placement) {
+			assigned = append(assigned, entry)
+		}
+	}
+
+	c.JSON(200, assigned)
+}
+
+// matchLabels tells if labels contain all the required ones
+func matchLabels(labels map[string]string, required map[string]string) bool {
+	for k, v := range required {
+		if value, ok := labels[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+func catalogEntries() ([]catalogEntry, error) {
+	cmx.RLock()
+	defer cmx.RUnlock()
+
+	placement, err := readPlacement()
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(catalogDir)
+	if os.IsNotExist(err) {
+		return []catalogEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []catalogEntry{}
+	for _, f := range files {
+		if f.IsDir() || !hasComposeExt(f.Name()) {
+			continue
+		}
+		in, err := ioutil.ReadFile(filepath.Join(catalogDir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, catalogEntry{
+			Name:      f.Name(),
+			Hash:      contentHash(in),
+			Size:      f.Size(),
+			Placement: placement[f.Name()],
+		})
+	}
+
+	return entries, nil
+}
+
+// catalogPath resolves the path of a compose file of the catalog
+func catalogPath(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") || !hasComposeExt(name) {
+		return "", errors.New("invalid compose file name: " + name)
+	}
+	return filepath.Join(catalogDir, name), nil
+}
+
+func readPlacement() (map[string]map[string]string, error) {
+	placement := map[string]map[string]string{}
+
+	in, err := ioutil.ReadFile(filepath.Join(catalogDir, placementFile))
+	if os.IsNotExist(err) {
+		return placement, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(in, &placement); err != nil {
+		return nil, err
+	}
+
+	return placement, nil
+}
+
+func writePlacement(placement map[string]map[string]string) error {
+	out, err := json.MarshalIndent(placement, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeComposeFile(filepath.Join(catalogDir, placementFile), out)
+}
+
+// ---------
+// Agent side
+
+// SetCatalogSync enables the sync of the compose files assigned to the
+// node, before the deployments and SyncCatalog start
+func SetCatalogSync(enabled bool) {
+	catalogEnabled = enabled
+}
+
+// SyncCatalog downloads periodically the compose files assigned to the node
+func SyncCatalog(period int) {
+	for {
+		if err := syncCatalog(); err != nil {
+			logrus.WithError(err).Error("Fail to sync the catalog")
+		}
+		time.Sleep(time.Duration(period) * time.Second)
+	}
+}
+
+// syncCatalog writes the compose files assigned to the node in the compose
+// directory and removes the ones previously synced but no longer assigned
+func syncCatalog() error {
+	if !catalogEnabled {
+		return nil
+	}
+
+	catalogSyncLock.Lock()
+	defer catalogSyncLock.Unlock()
+
+	labels := []string{}
+	for k, v := range nodeLabels {
+		labels = append(labels, k+"="+v)
+	}
+	sort.Strings(labels)
+
+	var assigned []catalogEntry
+	path := "/assignments/" + url.PathEscape(hostname) + "?labels=" + url.QueryEscape(strings.Join(labels, ","))
+	if err := collectorGet(path, &assigned); err != nil {
+		return err
+	}
+
+	synced := map[string]bool{}
+	for _, entry := range assigned {
+		file := filepath.Join(composesDir, entry.Name)
+		synced[entry.Name] = true
+
+		if in, err := ioutil.ReadFile(file); err == nil && contentHash(in) == entry.Hash {
+			continue
+		}
+
+		var content []byte
+		if err := collectorGet("/catalog/"+url.PathEscape(entry.Name)+"?unredacted=true", &content); err != nil {
+			return err
+		}
+		if hash := contentHash(content); hash != entry.Hash {
+			return fmt.Errorf("checksum mismatch for %s: %s instead of %s", entry.Name, hash, entry.Hash)
+		}
+		if err := writeComposeFile(file, content); err != nil {
+			return err
+		}
+		logrus.WithField("hash", entry.Hash).Infof("Sync %s from the catalog", entry.Name)
+	}
+
+	previous, err := readSyncedCatalog()
+	if err != nil {
+		return err
+	}
+	for name := range previous {
+		if !synced[name] {
+			logrus.Infof("Remove %s no longer assigned", name)
+			if err := os.Remove(filepath.Join(composesDir, name)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	return writeSyncedCatalog(synced)
+}
+
+func readSyncedCatalog() (map[string]bool, error) {
+	synced := map[string]bool{}
+
+	in, err := ioutil.ReadFile(filepath.Join(composesDir, catalogSynced))
+	if os.IsNotExist(err) {
+		return synced, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return synced, json.Unmarshal(in, &synced)
+}
+
+func writeSyncedCatalog(synced map[string]bool) error {
+	out, err := json.Marshal(synced)
+	if err != nil {
+		return err
+	}
+	return writeComposeFile(filepath.Join(composesDir, catalogSynced), out)
+}
+
+// collectorGet calls the API of the server, the response is decoded
+// in out or copied when out is a *[]byte
+func collectorGet(path string, out interface{}) error {
+	return lockedCollectorGet(path, "", out)
+}
+
+// lockedCollectorGet calls the API of the server with the token of
+// the global lock in the lock header if given
+func lockedCollectorGet(path string, token string, out interface{}) error {
+	if collectorURL == "" {
+		return errors.New("no squid server to join")
+	}
+
+	req, err := http.NewRequest("GET", collectorURL+"/api"+path, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(agentUsername, agentPassword)
+	if token != "" {
+		req.Header.Set(lockHeader, token)
+	}
+
+	client := http.Client{Timeout: time.Duration(30) * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	in, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %d %s", path, resp.StatusCode, in)
+	}
+
+	if content, ok := out.(*[]byte); ok {
+		*content = in
+		return nil
+	}
+	return json.Unmarshal(in, out)
+}
@@ -0,0 +1,176 @@
+package controllers
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCatalogPath(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"web.yml", true},
+		{"web.yaml", true},
+		{"", false},
+		{"web.json", false},
+		{".catalog.yml", false},
+		{"../web.yml", false},
+		{"node1/web.yml", false},
+		{`node1\web.yml`, false},
+	}
+
+	for _, test := range tests {
+		path, err := catalogPath(test.name)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("%q: expected valid %v, got %v", test.name, test.valid, err)
+			continue
+		}
+		if test.valid && path != filepath.Join(catalogDir, test.name) {
+			t.Errorf("%q: unexpected path %s", test.name, path)
+		}
+	}
+}
+
+func TestParseAndMatchLabels(t *testing.T) {
+	tests := []struct {
+		labels   string
+		required map[string]string
+		expected bool
+	}{
+		{"", map[string]string{}, true},
+		{"zone=eu, ssd=true", map[string]string{}, true},
+		{"zone=eu, ssd=true", map[string]string{"zone": "eu"}, true},
+		{"zone=eu,ssd=true,", map[string]string{"zone": "eu", "ssd": "true"}, true},
+		{"zone=eu", map[string]string{"zone": "us"}, false},
+		{"zone=eu", map[string]string{"zone": "eu", "ssd": "true"}, false},
+		// A label without value
+		{"gpu", map[string]string{"gpu": ""}, true},
+		{"", map[string]string{"gpu": ""}, false},
+	}
+
+	for _, test := range tests {
+		if match := matchLabels(ParseLabels(test.labels), test.required); match != test.expected {
+			t.Errorf("%q %v: expected %v, got %v", test.labels, test.required, test.expected, match)
+		}
+	}
+}
+
+func TestSyncCatalog(t *testing.T) {
+	composes, cleanup := useComposesDir(t)
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "squid-catalog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(previous string) { catalogDir = previous }(catalogDir)
+	catalogDir = dir
+
+	defer func(username string, password string) { agentUsername, agentPassword = username, password }(agentUsername, agentPassword)
+	agentUsername, agentPassword = "agent", "secret"
+	defer func(previous map[string]string) { nodeLabels = previous }(nodeLabels)
+	defer func(previous bool) { catalogEnabled = previous }(catalogEnabled)
+	catalogEnabled = true
+
+	// The server, altering the compose files downloaded if tampered
+	tampered := false
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	api := router.Group("/api", gin.BasicAuth(gin.Accounts{"agent": "secret"}))
+	api.GET("/assignments/:node", GetAssignments)
+	api.GET("/catalog/:name", func(c *gin.Context) {
+		if tampered {
+			c.Data(200, "application/x-yaml", []byte("services: {}\n"))
+			return
+		}
+		GetCatalogFile(c)
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+	defer func(previous string) { collectorURL = previous }(collectorURL)
+	collectorURL = server.URL
+
+	files := map[string]string{
+		"web.yml": "services:\n  web:\n    image: nginx\n",
+		"db.yml":  "services:\n  db:\n    environment:\n      DB_PASSWORD: s3cr3t\n",
+		"es.yml":  "services:\n  es:\n    image: es:6\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writePlacement(map[string]map[string]string{
+		"web.yml": {},
+		"db.yml":  {"zone": "eu"},
+		"es.yml":  {"zone": "eu", "ssd": "true"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Not synced from the catalog
+	if err := ioutil.WriteFile(filepath.Join(composes, "local.yml"), []byte("services: {}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		labels   string
+		update   map[string]string
+		tampered bool
+		error    bool
+		expected []string
+	}{
+		{"", nil, false, false, []string{"local.yml", "web.yml"}},
+		{"zone=eu", nil, false, false, []string{"db.yml", "local.yml", "web.yml"}},
+		{"zone=eu,ssd=true", nil, false, false, []string{"db.yml", "es.yml", "local.yml", "web.yml"}},
+		// No longer assigned
+		{"zone=us", nil, false, false, []string{"local.yml", "web.yml"}},
+		// Not written when the content does not match its checksum
+		{"zone=us", map[string]string{"web.yml": "services:\n  web:\n    image: nginx:2\n"}, true, true, []string{"local.yml", "web.yml"}},
+		{"zone=us", nil, false, false, []string{"local.yml", "web.yml"}},
+	}
+
+	for i, test := range tests {
+		SetLabels(ParseLabels(test.labels))
+		tampered = test.tampered
+		for name, content := range test.update {
+			files[name] = content
+			if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err := syncCatalog()
+		if (err != nil) != test.error {
+			t.Errorf("%d: expected error %v, got %v", i, test.error, err)
+		}
+
+		found, err := walkComposeFiles(composes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := []string{}
+		for _, file := range found {
+			names = append(names, filepath.Base(file))
+		}
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("%d: expected %v, got %v", i, test.expected, names)
+		}
+
+		for _, name := range names {
+			in, _ := ioutil.ReadFile(filepath.Join(composes, name))
+			if content, ok := files[name]; ok && !test.tampered && string(in) != content {
+				t.Errorf("%d: %s not synced, got %s", i, name, in)
+			}
+		}
+	}
+}
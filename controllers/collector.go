@@ -23,10 +23,16 @@ var (
 )
 
 type NodeStatus struct {
-	Node     string   `json:"node"`
-	Date     int64    `json:"date"`
-	Period   int      `json:"period"`
-	Services Services `json:"services"`
+	Node     string            `json:"node"`
+	URL      string            `json:"url"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Commit   string            `json:"commit,omitempty"`
+	Date     int64             `json:"date"`
+	Period   int               `json:"period"`
+	Services Services          `json:"services"`
+	Ports    []portBinding     `json:"ports,omitempty"`
+
+	Compliance *complianceReport `json:"compliance,omitempty"`
 }
 
 func CollectStatus(c *gin.Context) {
@@ -45,11 +51,29 @@ func CollectStatus(c *gin.Context) {
 	c.JSON(200, true)
 }
 
+// Statuses returns the status of each node with the secrets of the
+// services redacted, unless an admin asks for unredacted=true
 func Statuses(c *gin.Context) {
+	redact, ok := redactionFor(c)
+	if !ok {
+		return
+	}
+
 	m.RLock()
 	defer m.RUnlock()
 
-	c.JSON(200, statuses)
+	if !redact {
+		c.JSON(200, statuses)
+		return
+	}
+
+	redacted := map[string]NodeStatus{}
+	for node, status := range statuses {
+		status.Services = redactServices(status.Services)
+		redacted[node] = status
+	}
+
+	c.JSON(200, redacted)
 }
 
 func GetAgent(c *gin.Context) {
@@ -89,7 +113,7 @@ docker run -d \
 	c.String(200, getServerScript)
 }
 
-func SendServicesStatus(collector string, username string, password string, period int, host string) {
+func SendServicesStatus(collector string, username string, password string, period int, host string, advertise string) {
 	duration := time.Duration(period) * time.Second
 
 	for {
@@ -98,11 +122,27 @@ func SendServicesStatus(collector string, username string, password string, peri
 			logrus.WithError(err).Error("Fail to get services status")
 		}
 
+		ports, err := nodePorts()
+		if err != nil {
+			logrus.WithError(err).Error("Fail to get ports")
+		}
+
+		compliance, err := nodeCompliance()
+		if err != nil {
+			logrus.WithError(err).Error("Fail to evaluate the policy")
+		}
+
 		err = postStatus(collector, username, password, host, NodeStatus{
 			Node:     host,
+			URL:      advertise,
+			Labels:   nodeLabels,
+			Commit:   deployedCommit(),
 			Date:     time.Now().Unix(),
 			Period:   period,
 			Services: services,
+			Ports:    ports,
+
+			Compliance: compliance,
 		})
 		if err != nil {
 			logrus.WithError(err).Error("Fail to send services status")
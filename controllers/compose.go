@@ -0,0 +1,772 @@
+package controllers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+var (
+	// Keys of a service merged as a mapping, declared as a map or a list of key=value
+	mappingKeys = map[string]bool{
+		"environment": true,
+		"labels":      true,
+		"sysctls":     true,
+		"extra_hosts": true,
+	}
+	// Keys of a service whose values are concatenated
+	sequenceKeys = map[string]bool{
+		"ports":          true,
+		"expose":         true,
+		"external_links": true,
+		"dns":            true,
+		"dns_search":     true,
+		"tmpfs":          true,
+		"cap_add":        true,
+		"cap_drop":       true,
+		"security_opt":   true,
+	}
+	// Keys of a service merged by their mount path in the container
+	mountKeys = map[string]bool{
+		"volumes": true,
+		"devices": true,
+	}
+	// Keys of a service never inherited with extends
+	notExtendedKeys = []string{"links", "volumes_from", "depends_on"}
+
+	maxExtendsDepth = 10
+
+	projectNameCleaner = regexp.MustCompile("[^a-z0-9]")
+)
+
+// isComposeFile tells if a file is a compose file: .yml or .yaml, not
+// hidden (rendered compose files and temporary files) and not an override
+func isComposeFile(path string) bool {
+	name := filepath.Base(path)
+	if !hasComposeExt(name) || strings.HasPrefix(name, ".") {
+		return false
+	}
+	return !strings.HasSuffix(strings.TrimSuffix(name, filepath.Ext(name)), ".override")
+}
+
+func hasComposeExt(name string) bool {
+	ext := filepath.Ext(name)
+	return ext == ".yml" || ext == ".yaml"
+}
+
+// overrideFile finds the override file of a compose file:
+// docker-compose.override.yml for docker-compose.yml for example
+func overrideFile(file string) (string, bool) {
+	base := strings.TrimSuffix(file, filepath.Ext(file))
+	for _, ext := range []string{".yml", ".yaml"} {
+		override := base + ".override" + ext
+		if _, err := os.Stat(override); err == nil {
+			return override, true
+		}
+	}
+	return "", false
+}
+
+// loadCompose reads a compose file, renders it if it is a template,
+// merges its override file and the overlay of the node, resolves its
+// extends and env_file and interpolates the variables of its .env
+func loadCompose(file string) (*RawCompose, error) {
+	in, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	in, err = renderTemplate(file, in)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Dir(file)
+	env, err := composeEnv(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := decodeCompose(in, env)
+	if err != nil {
+		return nil, err
+	}
+
+	if override, ok := overrideFile(file); ok {
+		in, err := ioutil.ReadFile(override)
+		if err != nil {
+			return nil, err
+		}
+		overrideDoc, err := decodeCompose(in, env)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", filepath.Base(override), err)
+		}
+		doc.merge(overrideDoc)
+	}
+
+	provenance, err := loadOverlay(file, doc, env)
+	if err != nil {
+		return nil, err
+	}
+
+	compose, err := doc.normalize(dir, env)
+	if err != nil {
+		return nil, err
+	}
+
+	// The fields added by extends and env_file come from the compose file
+	if provenance != nil {
+		for name, service := range compose.Services {
+			if provenance[name] == nil {
+				provenance[name] = map[string]string{}
+			}
+			for key := range service {
+				if _, ok := provenance[name][key]; !ok {
+					provenance[name][key] = composeName(file)
+				}
+			}
+		}
+		compose.Provenance = provenance
+	}
+
+	return compose, nil
+}
+
+// parseCompose parses a compose definition not written yet
+// in the compose directory, rendered if its name is a template
+func parseCompose(name string, in []byte) (*RawCompose, error) {
+	in, err := renderTemplate(name, in)
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := composeEnv(composesDir)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := decodeCompose(in, env)
+	if err != nil {
+		return nil, err
+	}
+
+	return doc.normalize(composesDir, env)
+}
+
+// composeEnv gets the variables to interpolate: the .env file of the
+// directory overridden by the environment of squid
+func composeEnv(dir string) (map[string]string, error) {
+	env, err := readEnvFile(filepath.Join(dir, ".env"))
+	if os.IsNotExist(err) {
+		env = map[string]string{}
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, kv := range os.Environ() {
+		parts := strings.SplitN(kv, "=", 2)
+		env[parts[0]] = parts[1]
+	}
+
+	return env, nil
+}
+
+// readEnvFile reads a file of KEY=VALUE lines, comments start with #
+func readEnvFile(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	env := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) == 2 {
+			env[strings.TrimSpace(parts[0])] = parts[1]
+		} else {
+			env[strings.TrimSpace(parts[0])] = ""
+		}
+	}
+
+	return env, scanner.Err()
+}
+
+// composeDoc is a compose file decoded in the v2/v3 layout
+type composeDoc struct {
+	Version string
+	// HasServices tells if the services are under a services key (v2/v3
+	// layout, with or without version) and not at the top level (v1)
+	HasServices bool
+	Squid       interface{}
+	Services    map[string]map[string]interface{}
+	Networks    map[string]interface{}
+	Volumes     map[string]interface{}
+}
+
+// decodeCompose decodes and interpolates a compose file. The services of
+// a v1 compose file (without version) are the top-level keys.
+func decodeCompose(in []byte, env map[string]string) (*composeDoc, error) {
+	var raw interface{}
+	if err := yaml.Unmarshal(in, &raw); err != nil {
+		return nil, err
+	}
+	if raw == nil {
+		return nil, errors.New("empty compose file")
+	}
+
+	interpolated, err := interpolateValue(raw, env)
+	if err != nil {
+		return nil, err
+	}
+	top, ok := interpolated.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("a compose file must be a mapping")
+	}
+
+	doc := &composeDoc{
+		Squid:    top[squidKey],
+		Services: map[string]map[string]interface{}{},
+		Networks: map[string]interface{}{},
+		Volumes:  map[string]interface{}{},
+	}
+
+	version, hasVersion := top["version"]
+	_, hasServices := top["services"]
+	if !hasVersion && !hasServices {
+		// v1: every top-level key is a service
+		for name, value := range top {
+			if strings.HasPrefix(name, "x-") {
+				continue
+			}
+			service, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("service %s must be a mapping", name)
+			}
+			doc.Services[name] = service
+		}
+		return doc, nil
+	}
+
+	doc.HasServices = true
+	if hasVersion {
+		doc.Version = fmt.Sprint(version)
+	}
+	if err := decodeSection(top, "services", &doc.Services); err != nil {
+		return nil, err
+	}
+	if err := decodeSection(top, "networks", &doc.Networks); err != nil {
+		return nil, err
+	}
+	if err := decodeSection(top, "volumes", &doc.Volumes); err != nil {
+		return nil, err
+	}
+
+	return doc, nil
+}
+
+// decodeSection decodes a top-level section of a compose file, a section
+// declared without value is empty
+func decodeSection(top map[string]interface{}, key string, out interface{}) error {
+	value := top[key]
+	if value == nil {
+		return nil
+	}
+
+	in, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(in, out); err != nil {
+		return fmt.Errorf("invalid %s: %s", key, err)
+	}
+	return nil
+}
+
+// merge merges an override compose file
+func (d *composeDoc) merge(override *composeDoc) {
+	if override.Version != "" {
+		d.Version = override.Version
+	}
+	d.HasServices = d.HasServices || override.HasServices
+	if override.Squid != nil {
+		d.Squid = override.Squid
+	}
+	for name, service := range override.Services {
+		if base, ok := d.Services[name]; ok {
+			d.Services[name] = mergeService(base, service)
+		} else {
+			d.Services[name] = service
+		}
+	}
+	for name, network := range override.Networks {
+		d.Networks[name] = network
+	}
+	for name, volume := range override.Volumes {
+		d.Volumes[name] = volume
+	}
+}
+
+// normalize resolves the extends and the env_file of the services
+func (d *composeDoc) normalize(dir string, env map[string]string) (*RawCompose, error) {
+	compose := &RawCompose{
+		Version:     d.Version,
+		HasServices: d.HasServices,
+		Project:     projectName(dir),
+		Services:    RawServices{},
+		Networks:    d.Networks,
+		Volumes:     d.Volumes,
+	}
+
+	if d.Squid != nil {
+		rule, err := serviceOptions(map[string]interface{}{squidKey: d.Squid})
+		if err != nil {
+			return nil, err
+		}
+		compose.Squid = rule
+	}
+
+	for name := range d.Services {
+		service, err := d.resolveService(name, dir, env, 0)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %s", name, err)
+		}
+		compose.Services[name] = service
+	}
+
+	return compose, nil
+}
+
+// resolveService merges a service with the service it extends
+func (d *composeDoc) resolveService(name string, dir string, env map[string]string, depth int) (map[string]interface{}, error) {
+	if depth > maxExtendsDepth {
+		return nil, errors.New("too many levels of extends")
+	}
+
+	service, ok := d.Services[name]
+	if !ok {
+		return nil, errors.New("unknown service " + name)
+	}
+
+	service, err := applyEnvFile(copyService(service), dir)
+	if err != nil {
+		return nil, err
+	}
+	normalizeMappings(service)
+
+	extends, ok := service["extends"]
+	if !ok {
+		return service, nil
+	}
+	delete(service, "extends")
+
+	baseName, baseFile := "", ""
+	switch e := extends.(type) {
+	case string:
+		baseName = e
+	case map[string]interface{}:
+		baseName, _ = e["service"].(string)
+		baseFile, _ = e["file"].(string)
+	}
+	if baseName == "" {
+		return nil, errors.New("extends requires a service")
+	}
+
+	baseDoc, baseDir := d, dir
+	if baseFile != "" {
+		path := baseFile
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, baseFile)
+		}
+		in, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if baseDoc, err = decodeCompose(in, env); err != nil {
+			return nil, fmt.Errorf("%s: %s", baseFile, err)
+		}
+		baseDir = filepath.Dir(path)
+	} else if baseName == name {
+		return nil, errors.New("a service can't extend itself")
+	}
+
+	base, err := baseDoc.resolveService(baseName, baseDir, env, depth+1)
+	if err != nil {
+		return nil, fmt.Errorf("extends %s: %s", baseName, err)
+	}
+	for _, key := range notExtendedKeys {
+		delete(base, key)
+	}
+
+	return mergeService(base, service), nil
+}
+
+// applyEnvFile merges the env_file of a service in its environment,
+// the variables of environment take precedence
+func applyEnvFile(service map[string]interface{}, dir string) (map[string]interface{}, error) {
+	value, ok := service["env_file"]
+	if !ok {
+		return service, nil
+	}
+	delete(service, "env_file")
+
+	files := []string{}
+	switch v := value.(type) {
+	case string:
+		files = append(files, v)
+	case []interface{}:
+		for _, f := range v {
+			files = append(files, fmt.Sprint(f))
+		}
+	}
+
+	environment := map[string]interface{}{}
+	for _, file := range files {
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		env, err := readEnvFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range env {
+			environment[k] = v
+		}
+	}
+	for k, v := range toMapping(service["environment"]) {
+		environment[k] = v
+	}
+	service["environment"] = environment
+
+	return service, nil
+}
+
+// mergeService merges a service over a base service: the mappings are
+// merged, the sequences concatenated and the other values overridden
+func mergeService(base map[string]interface{}, override map[string]interface{}) map[string]interface{} {
+	merged := copyService(base)
+
+	for key, value := range override {
+		previous, ok := merged[key]
+		switch {
+		case !ok:
+			merged[key] = value
+		case mappingKeys[key]:
+			mapping := toMapping(previous)
+			for k, v := range toMapping(value) {
+				mapping[k] = v
+			}
+			merged[key] = mapping
+		case sequenceKeys[key]:
+			merged[key] = mergeSequences(toSequence(previous), toSequence(value), func(v interface{}) string {
+				return fmt.Sprint(v)
+			})
+		case mountKeys[key]:
+			merged[key] = mergeSequences(toSequence(previous), toSequence(value), mountTarget)
+		case isMapping(previous) && isMapping(value):
+			merged[key] = deepMerge(previous.(map[string]interface{}), value.(map[string]interface{}))
+		default:
+			merged[key] = value
+		}
+	}
+
+	return merged
+}
+
+// mergeSequences concatenates two sequences, the values of the
+// second one replace the values of the first one with the same key
+func mergeSequences(base []interface{}, override []interface{}, key func(interface{}) string) []interface{} {
+	overridden := map[string]bool{}
+	for _, v := range override {
+		overridden[key(v)] = true
+	}
+
+	merged := []interface{}{}
+	for _, v := range base {
+		if !overridden[key(v)] {
+			merged = append(merged, v)
+		}
+	}
+	return append(merged, override...)
+}
+
+// mountTarget is the path in the container of a volume or a device
+func mountTarget(v interface{}) string {
+	if m, ok := v.(map[string]interface{}); ok {
+		return fmt.Sprint(m["target"])
+	}
+	parts := strings.Split(fmt.Sprint(v), ":")
+	if len(parts) > 1 {
+		return parts[1]
+	}
+	return parts[0]
+}
+
+// normalizeMappings converts the mappings declared as lists to maps
+func normalizeMappings(service map[string]interface{}) {
+	for key := range mappingKeys {
+		if value, ok := service[key]; ok {
+			service[key] = toMapping(value)
+		}
+	}
+}
+
+// toMapping converts a list of key=value (key:value for extra_hosts) to a map
+func toMapping(value interface{}) map[string]interface{} {
+	mapping := map[string]interface{}{}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, val := range v {
+			mapping[k] = val
+		}
+	case []interface{}:
+		for _, kv := range v {
+			s := fmt.Sprint(kv)
+			sep := strings.IndexAny(s, "=:")
+			if sep < 0 {
+				// Value taken from the environment of docker-compose
+				mapping[s] = nil
+				continue
+			}
+			mapping[s[:sep]] = s[sep+1:]
+		}
+	}
+
+	return mapping
+}
+
+func toSequence(value interface{}) []interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		return v
+	case nil:
+		return []interface{}{}
+	default:
+		return []interface{}{v}
+	}
+}
+
+func copyService(service map[string]interface{}) map[string]interface{} {
+	c := map[string]interface{}{}
+	for k, v := range service {
+		c[k] = v
+	}
+	return c
+}
+
+// interpolateValue replaces the variables in all the strings of a value
+func interpolateValue(value interface{}, env map[string]string) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return interpolate(v, env)
+	case map[string]interface{}:
+		m := map[string]interface{}{}
+		for k, val := range v {
+			interpolated, err := interpolateValue(val, env)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = interpolated
+		}
+		return m, nil
+	case []interface{}:
+		l := []interface{}{}
+		for _, val := range v {
+			interpolated, err := interpolateValue(val, env)
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, interpolated)
+		}
+		return l, nil
+	default:
+		return value, nil
+	}
+}
+
+// interpolate replaces $VAR, ${VAR}, ${VAR:-default}, ${VAR-default},
+// ${VAR:?error} and ${VAR?error} in a string, $$ is a literal $
+func interpolate(s string, env map[string]string) (string, error) {
+	var out bytes.Buffer
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			out.WriteByte(s[i])
+			continue
+		}
+
+		next := s[i+1]
+		switch {
+		case next == '$':
+			out.WriteByte('$')
+			i++
+		case next == '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("invalid interpolation format in %q", s)
+			}
+			value, err := expandVariable(s[i+2:i+end], env)
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(value)
+			i += end
+		case isVariableChar(next):
+			end := i + 1
+			for end < len(s) && isVariableChar(s[end]) {
+				end++
+			}
+			out.WriteString(env[s[i+1:end]])
+			i = end - 1
+		default:
+			out.WriteByte(s[i])
+		}
+	}
+
+	return out.String(), nil
+}
+
+func expandVariable(expr string, env map[string]string) (string, error) {
+	for _, op := range []string{":-", ":?", "-", "?"} {
+		sep := strings.Index(expr, op)
+		if sep <= 0 {
+			continue
+		}
+		name, arg := expr[:sep], expr[sep+len(op):]
+		value, set := env[name]
+		unset := !set || (strings.HasPrefix(op, ":") && value == "")
+		if !unset {
+			return value, nil
+		}
+		if strings.HasSuffix(op, "?") {
+			return "", fmt.Errorf("required variable %s is missing a value: %s", name, arg)
+		}
+		return arg, nil
+	}
+
+	for i := 0; i < len(expr); i++ {
+		if !isVariableChar(expr[i]) {
+			return "", fmt.Errorf("invalid interpolation format for ${%s}", expr)
+		}
+	}
+	return env[expr], nil
+}
+
+func isVariableChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// projectName is the name docker-compose gives to the project of
+// the compose files of a directory
+func projectName(dir string) string {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		abs = dir
+	}
+	return projectNameCleaner.ReplaceAllString(strings.ToLower(filepath.Base(abs)), "")
+}
+
+// serviceImage is the image of a service, the one built by docker-compose
+// for a service with only a build
+func serviceImage(compose *RawCompose, name string, composeService map[string]interface{}) string {
+	if image, ok := composeService["image"].(string); ok {
+		return image
+	}
+	if _, ok := composeService["build"]; ok {
+		return compose.Project + "_" + name
+	}
+	return ""
+}
+
+// renderCompose writes the normalized compose file deployed by
+// docker-compose next to the compose file, without the squid extensions.
+// The encrypted values are replaced by variables of the returned environment.
+func renderCompose(file string, compose *RawCompose) (string, []string, error) {
+	secrets := newSecretEnv()
+	services := map[string]interface{}{}
+	for name, service := range compose.Services {
+		rendered := map[string]interface{}{}
+		for k, v := range service {
+			if k != squidKey {
+				rendered[k] = secrets.seal(escapeDollars(v))
+			}
+		}
+		services[name] = rendered
+	}
+	if secrets.err != nil {
+		return "", nil, secrets.err
+	}
+
+	doc := map[string]interface{}{}
+	if !compose.HasServices {
+		// v1
+		doc = services
+	} else {
+		if compose.Version != "" {
+			doc["version"] = compose.Version
+		}
+		doc["services"] = services
+		if len(compose.Networks) > 0 {
+			doc["networks"] = escapeDollars(compose.Networks)
+		}
+		if len(compose.Volumes) > 0 {
+			doc["volumes"] = escapeDollars(compose.Volumes)
+		}
+	}
+
+	out, err := yaml.Marshal(doc)
+	if err != nil {
+		return "", nil, err
+	}
+
+	rendered := filepath.Join(filepath.Dir(file), "."+filepath.Base(file))
+	return rendered, secrets.env, writeComposeFile(rendered, out)
+}
+
+// escapeDollars escapes the $ of the interpolated values to prevent
+// docker-compose from interpolating them again
+func escapeDollars(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return strings.Replace(v, "$", "$$", -1)
+	case map[string]interface{}:
+		m := map[string]interface{}{}
+		for k, val := range v {
+			m[k] = escapeDollars(val)
+		}
+		return m
+	case []interface{}:
+		l := []interface{}{}
+		for _, val := range v {
+			l = append(l, escapeDollars(val))
+		}
+		return l
+	default:
+		return value
+	}
+}
+
+// sortedServices lists the names of the services of a compose file
+func sortedServices(compose *RawCompose) []string {
+	names := []string{}
+	for name := range compose.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
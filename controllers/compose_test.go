@@ -0,0 +1,182 @@
+package controllers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/ghodss/yaml"
+)
+
+// useComposesDir sets a temporary compose directory, the returned
+// function removes it and restores the previous one
+func useComposesDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "squid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := composesDir
+	composesDir = dir
+	return dir, func() {
+		composesDir = previous
+		os.RemoveAll(dir)
+	}
+}
+
+func TestRenderComposeLayouts(t *testing.T) {
+	dir, cleanup := useComposesDir(t)
+	defer cleanup()
+
+	tests := []struct {
+		name    string
+		in      string
+		keys    []string
+		version string
+	}{
+		{"v1", "web:\n  image: nginx\n", []string{"web"}, ""},
+		{"v2", "version: '2'\nservices:\n  web:\n    image: nginx\n    networks: [front]\nnetworks:\n  front: {}\n",
+			[]string{"networks", "services", "version"}, "2"},
+		{"v3", "version: '3.7'\nservices:\n  web:\n    image: nginx\n    volumes: ['data:/data']\nvolumes:\n  data: {}\n",
+			[]string{"services", "version", "volumes"}, "3.7"},
+		{"versionless", "services:\n  web:\n    image: nginx\n    networks: [front]\nnetworks:\n  front: {}\n",
+			[]string{"networks", "services"}, ""},
+	}
+
+	for _, test := range tests {
+		compose, err := parseCompose(test.name+".yml", []byte(test.in))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		rendered, _, err := renderCompose(filepath.Join(dir, test.name+".yml"), compose)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		out, err := ioutil.ReadFile(rendered)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var doc map[string]interface{}
+		if err := yaml.Unmarshal(out, &doc); err != nil {
+			t.Fatal(err)
+		}
+
+		keys := []string{}
+		for key := range doc {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		if len(keys) != len(test.keys) {
+			t.Errorf("%s: expected the top-level keys %v, got %v", test.name, test.keys, keys)
+			continue
+		}
+		for i := range keys {
+			if keys[i] != test.keys[i] {
+				t.Errorf("%s: expected the top-level keys %v, got %v", test.name, test.keys, keys)
+				break
+			}
+		}
+		if version, _ := doc["version"].(string); version != test.version {
+			t.Errorf("%s: expected version %q, got %q", test.name, test.version, version)
+		}
+	}
+}
+
+func TestLintVersionlessCompose(t *testing.T) {
+	dir, cleanup := useComposesDir(t)
+	defer cleanup()
+
+	file := filepath.Join(dir, "web.yml")
+	in := "services:\n  web:\n    image: nginx\n    networks: [back]\n"
+	if err := ioutil.WriteFile(file, []byte(in), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	l := lintComposeFile(file)
+	for _, d := range l.diags {
+		if d.Rule == "undefined-network" {
+			if d.Line != 4 {
+				t.Errorf("expected the undefined network at line 4, got %d", d.Line)
+			}
+			return
+		}
+	}
+	t.Errorf("expected an undefined network, got %+v", l.diags)
+}
+
+func TestInterpolate(t *testing.T) {
+	env := map[string]string{"TAG": "1.13", "EMPTY": "", "HOST_PORT": "8080"}
+
+	tests := []struct {
+		in       string
+		expected string
+		err      bool
+	}{
+		{"nginx:$TAG", "nginx:1.13", false},
+		{"nginx:${TAG}-alpine", "nginx:1.13-alpine", false},
+		{"${HOST_PORT}:80", "8080:80", false},
+		{"$UNSET", "", false},
+		{"${UNSET:-latest}", "latest", false},
+		{"${EMPTY:-latest}", "latest", false},
+		{"${EMPTY-latest}", "", false},
+		{"${UNSET-latest}", "latest", false},
+		{"${TAG:?required}", "1.13", false},
+		{"${EMPTY?required}", "", false},
+		{"${EMPTY:?required}", "", true},
+		{"${UNSET?required}", "", true},
+		{"price: $$5", "price: $5", false},
+		{"end $", "end $", false},
+		{"$ alone", "$ alone", false},
+		{"${TAG", "", true},
+		{"${TAG.minor}", "", true},
+	}
+
+	for _, test := range tests {
+		out, err := interpolate(test.in, env)
+		if (err != nil) != test.err {
+			t.Errorf("%q: expected an error %v, got %v", test.in, test.err, err)
+			continue
+		}
+		if out != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.in, test.expected, out)
+		}
+	}
+}
+
+func TestMergeService(t *testing.T) {
+	base := map[string]interface{}{
+		"image":       "nginx:1.12",
+		"environment": []interface{}{"A=1", "B=2"},
+		"ports":       []interface{}{"80:80"},
+		"volumes":     []interface{}{"/data:/var/data", "/logs:/var/log"},
+		"logging":     map[string]interface{}{"driver": "syslog", "options": map[string]interface{}{"tag": "web"}},
+	}
+	override := map[string]interface{}{
+		"image":       "nginx:1.13",
+		"environment": map[string]interface{}{"B": "3", "C": "4"},
+		"ports":       []interface{}{"443:443"},
+		"volumes":     []interface{}{"/srv/data:/var/data"},
+		"logging":     map[string]interface{}{"options": map[string]interface{}{"facility": "daemon"}},
+		"command":     "nginx -g 'daemon off;'",
+	}
+	expected := map[string]interface{}{
+		"image":       "nginx:1.13",
+		"environment": map[string]interface{}{"A": "1", "B": "3", "C": "4"},
+		"ports":       []interface{}{"80:80", "443:443"},
+		"volumes":     []interface{}{"/logs:/var/log", "/srv/data:/var/data"},
+		"logging":     map[string]interface{}{"driver": "syslog", "options": map[string]interface{}{"tag": "web", "facility": "daemon"}},
+		"command":     "nginx -g 'daemon off;'",
+	}
+
+	if merged := mergeService(base, override); !reflect.DeepEqual(merged, expected) {
+		t.Errorf("expected %v, got %v", expected, merged)
+	}
+	if base["image"] != "nginx:1.12" {
+		t.Error("expected the base service to be left unchanged")
+	}
+}
@@ -0,0 +1,183 @@
+package controllers
+
+import (
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/context"
+)
+
+const (
+	kindContainer = "container"
+
+	defaultStopTimeout = 10
+)
+
+var containerActions = map[string]func(ctx context.Context, cli *client.Client, name string, c *gin.Context) error{
+	"start": func(ctx context.Context, cli *client.Client, name string, c *gin.Context) error {
+		return cli.ContainerStart(ctx, name, "")
+	},
+	"stop": func(ctx context.Context, cli *client.Client, name string, c *gin.Context) error {
+		return cli.ContainerStop(ctx, name, stopTimeout(c))
+	},
+	"restart": func(ctx context.Context, cli *client.Client, name string, c *gin.Context) error {
+		return cli.ContainerRestart(ctx, name, stopTimeout(c))
+	},
+	"kill": func(ctx context.Context, cli *client.Client, name string, c *gin.Context) error {
+		return cli.ContainerKill(ctx, name, c.DefaultQuery("signal", "KILL"))
+	},
+	"remove": func(ctx context.Context, cli *client.Client, name string, c *gin.Context) error {
+		return cli.ContainerRemove(ctx, name, types.ContainerRemoveOptions{
+			Force:         c.Query("force") == "true",
+			RemoveVolumes: c.Query("volumes") == "true",
+		})
+	},
+}
+
+// ContainerAction starts, stops (timeout in seconds), restarts, kills
+// (signal) or removes (force, volumes) a container of the node, declared
+// in a compose file or not. The action is recorded in the history.
+func ContainerAction(c *gin.Context) {
+	name, action := c.Param("name"), c.Param("action")
+	do, ok := containerActions[action]
+	if !ok {
+		c.JSON(400, "unknown action "+action)
+		return
+	}
+
+	cli, err := getDockerClient()
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), deployTimeout)
+	defer cancel()
+
+	info, err := cli.ContainerInspect(ctx, name)
+	if err != nil {
+		if client.IsErrContainerNotFound(err) {
+			c.JSON(404, "container "+name+" not found")
+			return
+		}
+		handleError(c, err)
+		return
+	}
+
+	// The container of a compose file being deployed is left to the deployment
+	composes, err := listComposes()
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+	var labels map[string]string
+	if info.Config != nil {
+		labels = info.Config.Labels
+	}
+	if compose := declaringCompose(composes, strings.TrimPrefix(info.Name, "/"), labels); compose != "" {
+		unlock, err := lockDeploy(c, []string{filepath.Join(composesDir, compose)})
+		if err != nil {
+			c.JSON(errorStatus(err), err.Error())
+			return
+		}
+		defer unlock()
+	}
+
+	now := time.Now().Unix()
+	result := &cmdResult{
+		Date:      now,
+		Container: name,
+		Status:    resultSuccess,
+		Cmd:       map[string]interface{}{"action": action, "container": name},
+		Result:    []string{action + " " + name},
+	}
+	if err := do(ctx, cli, name, c); err != nil {
+		result.Status = resultFailed
+		result.ExitCode = -1
+		result.Error = err.Error()
+	}
+
+	e := &execution{
+		Kind:    kindContainer,
+		Date:    now,
+		User:    authUser(c),
+		Results: []*cmdResult{result},
+	}
+	e.Status = executionStatus(e.Results)
+	recordExecution(e)
+
+	respondExecution(c, e)
+}
+
+// NodeContainerAction relays an action on a container to the agent of
+// a node and records it in the history of the server
+func NodeContainerAction(c *gin.Context) {
+	node, name, action := c.Param("node"), c.Param("name"), c.Param("action")
+	if _, ok := containerActions[action]; !ok {
+		c.JSON(400, "unknown action "+action)
+		return
+	}
+
+	path := "/containers/" + url.PathEscape(name) + "/" + action
+	if c.Request.URL.RawQuery != "" {
+		path += "?" + c.Request.URL.RawQuery
+	}
+
+	var e execution
+	code, err := agentRequest(node, "POST", path, nil, &e)
+	if err != nil {
+		status := code
+		if status == 0 {
+			status = errorStatus(err)
+		}
+		c.JSON(status, node+": "+err.Error())
+		return
+	}
+
+	// The execution of the agent is recorded again by the server
+	e.ID = ""
+	e.Node = node
+	e.User = authUser(c)
+	for _, result := range e.Results {
+		result.Node = node
+	}
+	recordExecution(&e)
+
+	respondExecution(c, &e)
+}
+
+// declaringCompose finds the compose file declaring a container: by the
+// project and service labels of docker-compose, by its name without them
+func declaringCompose(composes []RawCompose, name string, labels map[string]string) string {
+	project, service := labels[composeProjectLabel], labels[composeServiceLabel]
+	for _, compose := range composes {
+		if compose.Error != "" {
+			continue
+		}
+		for key, composeService := range compose.Services {
+			if project != "" && service != "" {
+				if compose.Project == project && key == service {
+					return compose.File
+				}
+				continue
+			}
+			if serviceContainerName(key, composeService) == name {
+				return compose.File
+			}
+		}
+	}
+	return ""
+}
+
+func stopTimeout(c *gin.Context) int {
+	if timeout, err := strconv.Atoi(c.Query("timeout")); err == nil && timeout >= 0 {
+		return timeout
+	}
+	return defaultStopTimeout
+}
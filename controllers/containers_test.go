@@ -0,0 +1,163 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestContainerActions(t *testing.T) {
+	actions := []string{}
+	for action := range containerActions {
+		actions = append(actions, action)
+	}
+	sort.Strings(actions)
+
+	if expected := []string{"kill", "remove", "restart", "start", "stop"}; !reflect.DeepEqual(actions, expected) {
+		t.Errorf("expected the actions %v, got %v", expected, actions)
+	}
+
+	tests := []struct {
+		query    string
+		expected int
+	}{
+		{"", defaultStopTimeout},
+		{"timeout=0", 0},
+		{"timeout=30", 30},
+		{"timeout=-1", defaultStopTimeout},
+		{"timeout=soon", defaultStopTimeout},
+	}
+	for _, test := range tests {
+		c, _, _ := gin.CreateTestContext()
+		c.Request, _ = http.NewRequest("POST", "/api/containers/web/stop?"+test.query, nil)
+		if timeout := stopTimeout(c); timeout != test.expected {
+			t.Errorf("%q: expected %d, got %d", test.query, test.expected, timeout)
+		}
+	}
+}
+
+func TestDeclaringCompose(t *testing.T) {
+	composes := []RawCompose{
+		{File: "web.yml", Project: "compose", Services: RawServices{"web": {"image": "nginx"}}},
+		{File: "db.yml", Project: "compose", Services: RawServices{"db": {"image": "postgres", "container_name": "postgres"}}},
+		{File: "common/es.yml", Project: "common", Services: RawServices{"es": {"image": "es:6"}}},
+		{File: "invalid.yml", Error: "invalid"},
+	}
+	compose := func(project string, service string) map[string]string {
+		return map[string]string{composeProjectLabel: project, composeServiceLabel: service}
+	}
+
+	tests := []struct {
+		name     string
+		labels   map[string]string
+		expected string
+	}{
+		{"compose_web_1", compose("compose", "web"), "web.yml"},
+		{"postgres", compose("compose", "db"), "db.yml"},
+		{"common_es_1", compose("common", "es"), "common/es.yml"},
+		// Another project with the same service
+		{"other_web_1", compose("other", "web"), ""},
+		// Without the labels of docker-compose
+		{"postgres", nil, "db.yml"},
+		{"web", map[string]string{}, "web.yml"},
+		{"manual", nil, ""},
+	}
+
+	for _, test := range tests {
+		if file := declaringCompose(composes, test.name, test.labels); file != test.expected {
+			t.Errorf("%s %v: expected %q, got %q", test.name, test.labels, test.expected, file)
+		}
+	}
+}
+
+func TestNodeContainerAction(t *testing.T) {
+	defer useHistory()()
+
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/containers/web/stop":
+			if r.URL.RawQuery != "timeout=5" {
+				t.Errorf("expected the query to be relayed, got %q", r.URL.RawQuery)
+			}
+			w.WriteHeader(200)
+			json.NewEncoder(w).Encode(&execution{ID: "agent", Kind: kindContainer, Node: "agent", Status: executionSuccess,
+				Results: []*cmdResult{{Container: "web", Status: resultSuccess}}})
+		case "/api/containers/db/kill":
+			w.WriteHeader(500)
+			json.NewEncoder(w).Encode(&execution{ID: "agent", Kind: kindContainer, Status: executionFailed,
+				Results: []*cmdResult{{Container: "db", Status: resultFailed, Error: "no such process"}}})
+		case "/api/containers/es/stop":
+			w.WriteHeader(409)
+			json.NewEncoder(w).Encode("compose file es.yml locked by ba")
+		default:
+			w.WriteHeader(404)
+			json.NewEncoder(w).Encode("container not found")
+		}
+	}))
+	defer agent.Close()
+
+	m.Lock()
+	previous := statuses
+	statuses = map[string]NodeStatus{"node1": {Node: "node1", URL: agent.URL}}
+	m.Unlock()
+	defer func() { m.Lock(); statuses = previous; m.Unlock() }()
+
+	tests := []struct {
+		node     string
+		name     string
+		action   string
+		query    string
+		code     int
+		recorded bool
+	}{
+		{"node1", "web", "stop", "timeout=5", 200, true},
+		{"node1", "db", "kill", "", 500, true},
+		{"node1", "es", "stop", "", 409, false},
+		{"node1", "cache", "start", "", 404, false},
+		{"node1", "web", "pause", "", 400, false},
+		{"node2", "web", "stop", "", 404, false},
+	}
+
+	for _, test := range tests {
+		mx.RLock()
+		before := len(historyResults)
+		mx.RUnlock()
+
+		c, w, _ := gin.CreateTestContext()
+		c.Request, _ = http.NewRequest("POST", "/api/nodes/containers/"+test.node+"/"+test.name+"/"+test.action+"?"+test.query, nil)
+		c.Params = gin.Params{{Key: "node", Value: test.node}, {Key: "name", Value: test.name}, {Key: "action", Value: test.action}}
+		c.Set(gin.AuthUserKey, "ba")
+		NodeContainerAction(c)
+
+		if w.Code != test.code {
+			t.Errorf("%s %s on %s: expected %d, got %d %s", test.action, test.name, test.node, test.code, w.Code, w.Body.String())
+		}
+
+		mx.RLock()
+		recorded := historyResults[before:]
+		mx.RUnlock()
+		if (len(recorded) == 1) != test.recorded || len(recorded) > 1 {
+			t.Errorf("%s %s on %s: expected recorded %v, got %d executions", test.action, test.name, test.node, test.recorded, len(recorded))
+			continue
+		}
+		if !test.recorded {
+			continue
+		}
+
+		e := recorded[0]
+		if e.ID == "" || e.ID == "agent" || e.Node != test.node || e.User != "ba" {
+			t.Errorf("%s %s on %s: expected the execution recorded again for the node, got %+v", test.action, test.name, test.node, e)
+		}
+		for _, result := range e.Results {
+			if result.Node != test.node {
+				t.Errorf("%s %s on %s: expected the result of the node, got %q", test.action, test.name, test.node, result.Node)
+			}
+		}
+	}
+}
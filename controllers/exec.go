@@ -0,0 +1,328 @@
+package controllers
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/context"
+)
+
+var (
+	auditFile = "audit.log"
+	amx       sync.Mutex
+
+	defaultExecCmd    = []string{"sh"}
+	defaultAuditLimit = 100
+)
+
+// auditEntry records who opened a shell in which container, what was
+// done in it (the resizes of the terminal, the bytes typed and received)
+// and how it ended, or why it was denied or failed
+type auditEntry struct {
+	Date      int64    `json:"date"`
+	Node      string   `json:"node"`
+	User      string   `json:"user"`
+	Remote    string   `json:"remote"`
+	Container string   `json:"container"`
+	Cmd       []string `json:"cmd"`
+	Event     string   `json:"event"`
+	ExitCode  *int     `json:"exitCode,omitempty"`
+	Duration  int64    `json:"duration,omitempty"`
+	Error     string   `json:"error,omitempty"`
+	Cols      int      `json:"cols,omitempty"`
+	Rows      int      `json:"rows,omitempty"`
+	Input     int64    `json:"input,omitempty"`
+	Output    int64    `json:"output,omitempty"`
+}
+
+// terminalMessage is sent by the terminal: the keys typed (input)
+// or the new size of the terminal (resize)
+type terminalMessage struct {
+	Type string `json:"type"`
+	Data string `json:"data"`
+	Cols int    `json:"cols"`
+	Rows int    `json:"rows"`
+}
+
+// SetAuditFile sets the file where the exec sessions are appended
+func SetAuditFile(file string) {
+	auditFile = file
+}
+
+// ExecContainer opens a shell (or the cmd given in query) with a TTY in
+// a container and bridges it over a WebSocket. It is reserved to the
+// admin and each session is recorded in the audit trail, as well as the
+// attempts denied or failed.
+func ExecContainer(c *gin.Context) {
+	name := c.Param("name")
+	cmd := c.Request.URL.Query()["cmd"]
+	if len(cmd) == 0 {
+		cmd = defaultExecCmd
+	}
+
+	entry := auditEntry{
+		Node:      hostname,
+		User:      authUser(c),
+		Remote:    c.ClientIP(),
+		Container: name,
+		Cmd:       cmd,
+	}
+	fail := func(code int, err error) {
+		entry.Error = err.Error()
+		audit(entry, "failed")
+		c.JSON(code, err.Error())
+	}
+
+	if !isAdmin(c) {
+		entry.Error = "not admin"
+		audit(entry, "denied")
+		c.JSON(403, "exec is reserved to the admin")
+		return
+	}
+
+	cli, err := getDockerClient()
+	if err != nil {
+		fail(500, err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The exec session is created once the WebSocket is open
+	// to never leave one not attached
+	if _, err := cli.ContainerInspect(ctx, name); err != nil {
+		if client.IsErrContainerNotFound(err) {
+			fail(404, errors.New("container "+name+" not found"))
+			return
+		}
+		fail(500, err)
+		return
+	}
+
+	ws, err := upgradeWebSocket(c)
+	if err != nil {
+		fail(errorStatus(err), err)
+		return
+	}
+
+	config := types.ExecConfig{
+		User:         c.Query("user"),
+		Tty:          true,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          cmd,
+	}
+	created, err := cli.ContainerExecCreate(ctx, name, config)
+	if err != nil {
+		entry.Error = err.Error()
+		audit(entry, "failed")
+		ws.CloseWith(truncate(err.Error(), 120))
+		return
+	}
+
+	start := time.Now()
+	audit(entry, "start")
+
+	exitCode, err := bridgeExec(ctx, cli, created.ID, config, ws, &entry)
+	if err != nil {
+		entry.Error = err.Error()
+		ws.CloseWith(truncate(err.Error(), 120))
+	} else {
+		ws.CloseWith("exit " + strconv.Itoa(exitCode))
+	}
+
+	entry.Duration = int64(time.Since(start).Seconds())
+	entry.Cols, entry.Rows = 0, 0
+	if err == nil {
+		entry.ExitCode = &exitCode
+	}
+	audit(entry, "end")
+}
+
+// bridgeExec starts an exec session, copies its output to the WebSocket
+// and the input of the WebSocket to it until one of them ends. The bytes
+// typed and received are counted in the entry, the resizes audited.
+func bridgeExec(ctx context.Context, cli *client.Client, id string, config types.ExecConfig, ws *wsConn, entry *auditEntry) (int, error) {
+	session, err := cli.ContainerExecAttach(ctx, id, config)
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+
+	// The output is counted apart from the entry updated by readTerminal
+	output := make(chan int64, 1)
+	go func() {
+		output <- copyOutput(session.Reader, ws)
+		// Unblock the reading of the WebSocket
+		ws.conn.SetReadDeadline(time.Now())
+	}()
+
+	readTerminal(ws, session.Conn, func(cols int, rows int) {
+		cli.ContainerExecResize(ctx, id, types.ResizeOptions{Height: rows, Width: cols})
+	}, entry)
+
+	// The client is gone or the session ended
+	session.Close()
+	entry.Output = <-output
+
+	inspect, err := cli.ContainerExecInspect(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	return inspect.ExitCode, nil
+}
+
+// copyOutput copies the output of an exec session to the WebSocket until
+// one of them ends and returns the number of bytes received
+func copyOutput(r io.Reader, ws *wsConn) int64 {
+	var received int64
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			received += int64(n)
+			if ws.WriteMessage(wsBinary, buf[:n]) != nil {
+				return received
+			}
+		}
+		if err != nil {
+			return received
+		}
+	}
+}
+
+// readTerminal writes the keys typed in the terminal to the input of an
+// exec session and resizes it until the WebSocket or the input ends. The
+// bytes typed are counted in the entry, the resizes audited.
+func readTerminal(ws *wsConn, input io.Writer, resize func(cols int, rows int), entry *auditEntry) {
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		var msg terminalMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			continue
+		}
+		switch msg.Type {
+		case "input":
+			entry.Input += int64(len(msg.Data))
+			if _, err := io.WriteString(input, msg.Data); err != nil {
+				return
+			}
+		case "resize":
+			if msg.Cols > 0 && msg.Rows > 0 && (msg.Cols != entry.Cols || msg.Rows != entry.Rows) {
+				entry.Cols, entry.Rows = msg.Cols, msg.Rows
+				audit(*entry, "resize")
+				resize(msg.Cols, msg.Rows)
+			}
+		}
+	}
+}
+
+// audit appends an event of an exec session to the audit trail
+func audit(entry auditEntry, event string) {
+	entry.Date = time.Now().Unix()
+	entry.Event = event
+
+	logrus.WithFields(logrus.Fields{
+		"user":      entry.User,
+		"container": entry.Container,
+		"cmd":       strings.Join(entry.Cmd, " "),
+	}).Info("Exec " + event)
+
+	if auditFile == "" {
+		return
+	}
+
+	amx.Lock()
+	defer amx.Unlock()
+
+	out, err := json.Marshal(entry)
+	if err == nil {
+		var f *os.File
+		f, err = os.OpenFile(auditFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err == nil {
+			_, err = fmt.Fprintln(f, string(out))
+			f.Close()
+		}
+	}
+	if err != nil {
+		logrus.WithError(err).Error("Fail to write the audit trail")
+	}
+}
+
+// GetAudit returns the last events of the audit trail (limit, 100 by
+// default), reserved to the admin
+func GetAudit(c *gin.Context) {
+	if !isAdmin(c) {
+		c.JSON(403, "the audit trail is reserved to the admin")
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultAuditLimit)))
+	if err != nil || limit <= 0 {
+		c.JSON(400, "invalid limit")
+		return
+	}
+
+	entries := []auditEntry{}
+	if auditFile != "" {
+		amx.Lock()
+		entries, err = readAudit()
+		amx.Unlock()
+		if err != nil {
+			handleError(c, err)
+			return
+		}
+	}
+
+	if len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	c.JSON(200, entries)
+}
+
+func readAudit() ([]auditEntry, error) {
+	entries := []auditEntry{}
+
+	f, err := os.Open(auditFile)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry auditEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, scanner.Err()
+}
+
+func truncate(s string, max int) string {
+	if len(s) > max {
+		return s[:max]
+	}
+	return s
+}
@@ -0,0 +1,116 @@
+package controllers
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestExecContainerDenied(t *testing.T) {
+	dir, err := ioutil.TempDir("", "squid-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(file string, admin string) { auditFile, adminUsername = file, admin }(auditFile, adminUsername)
+	auditFile = filepath.Join(dir, "audit.log")
+	adminUsername = "admin"
+
+	c, w, _ := gin.CreateTestContext()
+	c.Request, _ = http.NewRequest("GET", "/api/containers/web/exec?cmd=bash", nil)
+	c.Params = gin.Params{{Key: "name", Value: "web"}}
+	c.Set(gin.AuthUserKey, "ba")
+	ExecContainer(c)
+
+	if w.Code != 403 {
+		t.Errorf("expected the exec to be forbidden, got %d", w.Code)
+	}
+
+	entries, err := readAudit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected the denied attempt to be audited, got %v", entries)
+	}
+	entry := entries[0]
+	if entry.Event != "denied" || entry.User != "ba" || entry.Container != "web" || len(entry.Cmd) != 1 || entry.Cmd[0] != "bash" {
+		t.Errorf("unexpected audit entry %+v", entry)
+	}
+}
+
+func TestReadTerminal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "squid-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(file string) { auditFile = file }(auditFile)
+	auditFile = filepath.Join(dir, "audit.log")
+
+	messages := []string{
+		`{"type":"resize","cols":80,"rows":24}`,
+		`{"type":"input","data":"ls\n"}`,
+		// Same size, no size, not JSON and unknown messages are ignored
+		`{"type":"resize","cols":80,"rows":24}`,
+		`{"type":"resize"}`,
+		`not json`,
+		`{"type":"ping"}`,
+		`{"type":"resize","cols":120,"rows":40}`,
+		`{"type":"input","data":"exit\n"}`,
+	}
+	frames := [][]byte{}
+	for _, message := range messages {
+		frames = append(frames, clientFrame(true, wsText, []byte(message), true))
+	}
+	frames = append(frames, clientFrame(true, wsClose, nil, true))
+
+	ws, closeWS := wsPipe(frames...)
+	defer closeWS()
+
+	var input bytes.Buffer
+	resizes := [][]int{}
+	entry := &auditEntry{User: "admin", Container: "web"}
+	readTerminal(ws, &input, func(cols int, rows int) { resizes = append(resizes, []int{cols, rows}) }, entry)
+
+	if input.String() != "ls\nexit\n" || entry.Input != 8 {
+		t.Errorf("expected the input ls and exit (8 bytes), got %q (%d bytes)", input.String(), entry.Input)
+	}
+	if expected := [][]int{{80, 24}, {120, 40}}; !reflect.DeepEqual(resizes, expected) {
+		t.Errorf("expected the resizes %v, got %v", expected, resizes)
+	}
+
+	entries, err := readAudit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	audited := [][]int{}
+	for _, e := range entries {
+		if e.Event != "resize" || e.User != "admin" || e.Container != "web" {
+			t.Errorf("unexpected audit entry %+v", e)
+		}
+		audited = append(audited, []int{e.Cols, e.Rows})
+	}
+	if expected := [][]int{{80, 24}, {120, 40}}; !reflect.DeepEqual(audited, expected) {
+		t.Errorf("expected the resizes %v audited, got %v", expected, audited)
+	}
+}
+
+func TestCopyOutput(t *testing.T) {
+	ws, closeWS := wsPipe()
+	received := copyOutput(bytes.NewBufferString("total 0\n"), ws)
+	sent := closeWS()
+
+	if received != 8 {
+		t.Errorf("expected 8 bytes received, got %d", received)
+	}
+	if _, op, payload, _ := serverFrame(t, sent); op != wsBinary || string(payload) != "total 0\n" {
+		t.Errorf("expected the output in a binary message, got %d %q", op, payload)
+	}
+}
@@ -0,0 +1,521 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	versionsDir  = "versions"
+	versionsKept = 10
+)
+
+type composeFile struct {
+	Name     string `json:"name"`
+	Hash     string `json:"hash"`
+	Size     int64  `json:"size"`
+	Modified int64  `json:"modified"`
+}
+
+type composeVersion struct {
+	ID   string `json:"id"`
+	Date int64  `json:"date"`
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// SetComposeVersions sets the directory where the previous versions of the
+// edited compose files are kept and how many are kept by compose file
+func SetComposeVersions(dir string, kept int) {
+	versionsDir = dir
+	versionsKept = kept
+}
+
+// ListComposeFiles lists the compose files of the node with their hash
+func ListComposeFiles(c *gin.Context) {
+	paths, err := listComposeFiles()
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	files := []composeFile{}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			handleError(c, err)
+			return
+		}
+		in, err := ioutil.ReadFile(path)
+		if err != nil {
+			handleError(c, err)
+			return
+		}
+		files = append(files, composeFile{
+			Name:     composeName(path),
+			Hash:     contentHash(in),
+			Size:     info.Size(),
+			Modified: info.ModTime().Unix(),
+		})
+	}
+
+	c.JSON(200, files)
+}
+
+// ComposeFileRoute serves /compose/files/*path with the handler of a
+// compose file, the names of the files of the layers contain slashes:
+// <name>, <name>/versions, <name>/versions/<version> and <name>/rendered
+func ComposeFileRoute(c *gin.Context) {
+	name := strings.TrimPrefix(c.Param("path"), "/")
+	var handler gin.HandlerFunc
+
+	switch c.Request.Method {
+	case "PUT":
+		handler = PutComposeFile
+	case "DELETE":
+		handler = DeleteComposeFile
+	default:
+		switch i := strings.LastIndex(name, "/versions/"); {
+		case strings.HasSuffix(name, "/rendered"):
+			name, handler = strings.TrimSuffix(name, "/rendered"), GetRenderedComposeFile
+		case strings.HasSuffix(name, "/versions"):
+			name, handler = strings.TrimSuffix(name, "/versions"), ListComposeVersions
+		case i >= 0:
+			c.Params = append(c.Params, gin.Param{Key: "version", Value: name[i+len("/versions/"):]})
+			name, handler = name[:i], GetComposeVersion
+		default:
+			handler = GetComposeFile
+		}
+	}
+
+	c.Params = append(c.Params, gin.Param{Key: "name", Value: name})
+	handler(c)
+}
+
+// GetComposeFile returns the content of a compose file, its hash is
+// the ETag to send back in If-Match to update or delete it
+func GetComposeFile(c *gin.Context) {
+	redact, ok := redactionFor(c)
+	if !ok {
+		return
+	}
+
+	path, err := editableComposePath(c.Param("name"))
+	if err != nil {
+		c.JSON(400, err.Error())
+		return
+	}
+
+	in, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		c.JSON(404, "compose file not found")
+		return
+	}
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	c.Header("ETag", etag(in))
+	if redact {
+		in = []byte(redactText(string(in)))
+	}
+	c.Data(200, "application/x-yaml", in)
+}
+
+// PutComposeFile creates or replaces a compose file after validating it.
+// Replacing a compose file requires the ETag of the current content in
+// If-Match, the content replaced is kept as a version.
+func PutComposeFile(c *gin.Context) {
+	name := c.Param("name")
+	path, err := editableComposePath(name)
+	if err != nil {
+		c.JSON(400, err.Error())
+		return
+	}
+	if err := checkEditable(); err != nil {
+		c.JSON(errorStatus(err), err.Error())
+		return
+	}
+
+	in, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+	if strings.Contains(string(in), redactedValue) {
+		c.JSON(400, name+": the content contains redacted values, edit the unredacted compose file")
+		return
+	}
+	validate := func() error { return validateCompose(name, in) }
+	if base, ok := baseFile(path); ok {
+		validate = func() error { return validateOverlay(base, path, in) }
+	}
+	if err := validate(); err != nil {
+		c.JSON(400, name+": "+err.Error())
+		return
+	}
+
+	// The compose file deployed with an overlay is the common one
+	unlock, err := lockDeploy(c, []string{deployedFile(path)})
+	if err != nil {
+		c.JSON(errorStatus(err), err.Error())
+		return
+	}
+	defer unlock()
+
+	current, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		handleError(c, err)
+		return
+	}
+	exists := err == nil
+
+	if status, msg := checkPrecondition(c, current, exists); status != 0 {
+		c.JSON(status, msg)
+		return
+	}
+
+	if exists {
+		if err := saveVersion(name, current); err != nil {
+			handleError(c, err)
+			return
+		}
+	}
+	if err := writeComposeFile(path, in); err != nil {
+		handleError(c, err)
+		return
+	}
+
+	status := 200
+	if !exists {
+		status = 201
+	}
+	c.Header("ETag", etag(in))
+	c.JSON(status, gin.H{"name": name, "hash": contentHash(in)})
+}
+
+// DeleteComposeFile removes a compose file given the ETag of its content
+// in If-Match, its content is kept as a version
+func DeleteComposeFile(c *gin.Context) {
+	name := c.Param("name")
+	path, err := editableComposePath(name)
+	if err != nil {
+		c.JSON(400, err.Error())
+		return
+	}
+	if err := checkEditable(); err != nil {
+		c.JSON(errorStatus(err), err.Error())
+		return
+	}
+
+	unlock, err := lockDeploy(c, []string{deployedFile(path)})
+	if err != nil {
+		c.JSON(errorStatus(err), err.Error())
+		return
+	}
+	defer unlock()
+
+	current, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		c.JSON(404, "compose file not found")
+		return
+	}
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	if status, msg := checkPrecondition(c, current, true); status != 0 {
+		c.JSON(status, msg)
+		return
+	}
+
+	if err := saveVersion(name, current); err != nil {
+		handleError(c, err)
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		handleError(c, err)
+		return
+	}
+
+	c.JSON(200, true)
+}
+
+// ListComposeVersions lists the previous versions of a compose file, newest first
+func ListComposeVersions(c *gin.Context) {
+	name := c.Param("name")
+	if _, err := editableComposePath(name); err != nil {
+		c.JSON(400, err.Error())
+		return
+	}
+
+	versions, err := composeVersions(name)
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	c.JSON(200, versions)
+}
+
+// GetComposeVersion returns the content of a previous version of a compose file
+func GetComposeVersion(c *gin.Context) {
+	redact, ok := redactionFor(c)
+	if !ok {
+		return
+	}
+
+	name := c.Param("name")
+	if _, err := editableComposePath(name); err != nil {
+		c.JSON(400, err.Error())
+		return
+	}
+	id := c.Param("version")
+	if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+		c.JSON(400, "invalid version: "+id)
+		return
+	}
+
+	in, err := ioutil.ReadFile(filepath.Join(versionsDir, name, id))
+	if os.IsNotExist(err) {
+		c.JSON(404, "version not found")
+		return
+	}
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	c.Header("ETag", etag(in))
+	if redact {
+		in = []byte(redactText(string(in)))
+	}
+	c.Data(200, "application/x-yaml", in)
+}
+
+// editableComposePath resolves the path of a compose file of the compose
+// directory or of its subdirectories (the layers common/ and <hostname>/),
+// the name must be clean and the path, links resolved, stay in the directory
+func editableComposePath(name string) (string, error) {
+	invalid := errors.New("invalid compose file name: " + name)
+	if name == "" || filepath.ToSlash(filepath.Clean(name)) != name || strings.HasPrefix(name, "/") || strings.Contains(name, `\`) || !hasComposeExt(name) {
+		return "", invalid
+	}
+	// Hidden files and directories, such as .git, are never edited
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return "", invalid
+		}
+	}
+
+	file, err := composeFilePath(filepath.FromSlash(name))
+	if err != nil {
+		return "", err
+	}
+
+	root, err := filepath.EvalSymlinks(composesDir)
+	if err != nil {
+		return file, nil
+	}
+	// The deepest existing parent of a new compose file is resolved
+	resolved := file
+	for {
+		if real, err := filepath.EvalSymlinks(resolved); err == nil {
+			if rel, err := filepath.Rel(root, real); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				return "", invalid
+			}
+			return file, nil
+		}
+		parent := filepath.Dir(resolved)
+		if parent == resolved {
+			return file, nil
+		}
+		resolved = parent
+	}
+}
+
+// checkEditable refuses to edit the compose files managed by git
+// or by the catalog of the server, they would be overwritten
+func checkEditable() error {
+	gmx.RLock()
+	repo := gitops.Repo
+	gmx.RUnlock()
+
+	if repo != "" {
+		return conflictError("compose files are managed by git: " + repo)
+	}
+	if catalogEnabled {
+		return conflictError("compose files are managed by the catalog of the server")
+	}
+	return nil
+}
+
+// checkPrecondition compares the If-Match header to the current content
+// and returns the status and the message of the response when it fails
+func checkPrecondition(c *gin.Context, current []byte, exists bool) (int, string) {
+	ifMatch := c.Request.Header.Get("If-Match")
+	ifNoneMatch := c.Request.Header.Get("If-None-Match")
+
+	switch {
+	case ifNoneMatch == "*" && exists:
+		return 412, "compose file already exists"
+	case !exists && ifMatch != "":
+		return 412, "compose file not found"
+	case exists && ifMatch == "":
+		return 428, "If-Match header with the ETag of the compose file is required"
+	case exists && ifMatch != "*" && !matchETag(ifMatch, current):
+		return 412, "compose file modified since it was read, its hash is now " + contentHash(current)
+	}
+
+	return 0, ""
+}
+
+func etag(content []byte) string {
+	return `"` + contentHash(content) + `"`
+}
+
+// matchETag tells if one of the ETags of a If-Match header matches the content
+func matchETag(header string, content []byte) bool {
+	hash := contentHash(content)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.Trim(strings.TrimPrefix(strings.TrimSpace(tag), "W/"), `"`)
+		if tag == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// validateCompose checks a compose file is valid YAML and defines
+// services with an image or a build, a template is rendered for the node
+func validateCompose(name string, in []byte) error {
+	compose, err := parseCompose(name, in)
+	if err != nil {
+		return err
+	}
+	return checkServices(compose)
+}
+
+// validateOverlay checks an overlay of the node merged on its common
+// compose file, the overlay alone may not define the images
+func validateOverlay(base string, overlay string, in []byte) error {
+	baseIn, err := ioutil.ReadFile(base)
+	if err != nil {
+		return err
+	}
+	baseIn, err = renderTemplate(base, baseIn)
+	if err != nil {
+		return err
+	}
+	in, err = renderTemplate(overlay, in)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(base)
+	env, err := composeEnv(dir)
+	if err != nil {
+		return err
+	}
+	doc, err := decodeCompose(baseIn, env)
+	if err != nil {
+		return fmt.Errorf("%s: %s", composeName(base), err)
+	}
+	overlayDoc, err := decodeCompose(in, env)
+	if err != nil {
+		return err
+	}
+	doc.merge(overlayDoc)
+
+	compose, err := doc.normalize(dir, env)
+	if err != nil {
+		return err
+	}
+	return checkServices(compose)
+}
+
+// checkServices checks a compose file defines services with an image or a build
+func checkServices(compose *RawCompose) error {
+	if len(compose.Services) == 0 {
+		return errors.New("no services defined")
+	}
+
+	for _, name := range sortedServices(compose) {
+		composeService := compose.Services[name]
+		_, hasImage := composeService["image"]
+		_, hasBuild := composeService["build"]
+		if !hasImage && !hasBuild {
+			return fmt.Errorf("service %s: image or build is required", name)
+		}
+	}
+
+	return nil
+}
+
+// saveVersion keeps a previous content of a compose file and removes
+// the oldest versions
+func saveVersion(name string, content []byte) error {
+	dir := filepath.Join(versionsDir, name)
+	id := strconv.FormatInt(time.Now().UnixNano(), 10)
+	if err := writeComposeFile(filepath.Join(dir, id), content); err != nil {
+		return err
+	}
+
+	versions, err := composeVersions(name)
+	if err != nil {
+		return err
+	}
+	for i := versionsKept; i < len(versions); i++ {
+		if err := os.Remove(filepath.Join(dir, versions[i].ID)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// composeVersions lists the versions of a compose file, newest first
+func composeVersions(name string) ([]composeVersion, error) {
+	files, err := ioutil.ReadDir(filepath.Join(versionsDir, name))
+	if os.IsNotExist(err) {
+		return []composeVersion{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []composeVersion{}
+	for _, f := range files {
+		nano, err := strconv.ParseInt(f.Name(), 10, 64)
+		if err != nil || f.IsDir() {
+			continue
+		}
+		in, err := ioutil.ReadFile(filepath.Join(versionsDir, name, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, composeVersion{
+			ID:   f.Name(),
+			Date: nano / int64(time.Second),
+			Hash: contentHash(in),
+			Size: f.Size(),
+		})
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].ID > versions[j].ID
+	})
+
+	return versions, nil
+}
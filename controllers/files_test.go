@@ -0,0 +1,188 @@
+package controllers
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMatchETag(t *testing.T) {
+	content := []byte("services: {}")
+	hash := contentHash(content)
+
+	tests := []struct {
+		header   string
+		expected bool
+	}{
+		{hash, true},
+		{`"` + hash + `"`, true},
+		{`W/"` + hash + `"`, true},
+		{`"abc", "` + hash + `"`, true},
+		{`"abc"`, false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		if match := matchETag(test.header, content); match != test.expected {
+			t.Errorf("%q: expected %v, got %v", test.header, test.expected, match)
+		}
+	}
+}
+
+func TestEditableComposePath(t *testing.T) {
+	dir, cleanup := useComposesDir(t)
+	defer cleanup()
+
+	outside, err := ioutil.TempDir("", "squid-outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	if err := os.Symlink(outside, filepath.Join(dir, "linked")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(outside, "x.yml"), []byte("services: {}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "x.yml"), filepath.Join(dir, "link.yml")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"web.yml", true},
+		{"web.yaml", true},
+		{"common/es.yml", true},
+		{"node1/es.yml", true},
+		{"apps/front/web.yml", true},
+		{"", false},
+		{"web.txt", false},
+		{"common", false},
+		{"../web.yml", false},
+		{"common/../../web.yml", false},
+		{"common/../web.yml", false},
+		{"common//es.yml", false},
+		{"./web.yml", false},
+		{"/etc/web.yml", false},
+		{`common\es.yml`, false},
+		{".git/web.yml", false},
+		{"common/.es.yml", false},
+		{"linked/x.yml", false},
+		{"link.yml", false},
+	}
+
+	for _, test := range tests {
+		path, err := editableComposePath(test.name)
+		if (err == nil) != test.valid {
+			t.Errorf("%q: expected valid %v, got %v", test.name, test.valid, err)
+			continue
+		}
+		if test.valid && path != filepath.Join(dir, filepath.FromSlash(test.name)) {
+			t.Errorf("%q: unexpected path %s", test.name, path)
+		}
+	}
+}
+
+func TestComposeFileRoute(t *testing.T) {
+	_, overlay, cleanup := useLayers(t)
+	defer cleanup()
+
+	versions, err := ioutil.TempDir("", "squid-versions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(versions)
+	defer func(dir string) { versionsDir = dir }(versionsDir)
+	versionsDir = versions
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(func(c *gin.Context) { c.Set(gin.AuthUserKey, "ba") })
+	router.GET("/api/compose/files", ListComposeFiles)
+	router.GET("/api/compose/files/*path", ComposeFileRoute)
+	router.PUT("/api/compose/files/*path", ComposeFileRoute)
+	router.DELETE("/api/compose/files/*path", ComposeFileRoute)
+
+	overlayIn, _ := ioutil.ReadFile(overlay)
+	request := func(method string, url string, body string, ifMatch string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	tests := []struct {
+		name    string
+		method  string
+		url     string
+		body    string
+		ifMatch string
+		code    int
+	}{
+		{"list", "GET", "/api/compose/files", "", "", 200},
+		{"common file", "GET", "/api/compose/files/common/es.yml", "", "", 200},
+		{"overlay escaped", "GET", "/api/compose/files/node1%2Fes.yml", "", "", 200},
+		{"rendered overlay", "GET", "/api/compose/files/node1/es.yml/rendered", "", "", 200},
+		{"versions of the overlay", "GET", "/api/compose/files/node1/es.yml/versions", "", "", 200},
+		{"missing version", "GET", "/api/compose/files/node1/es.yml/versions/1", "", "", 404},
+		{"escaping", "GET", "/api/compose/files/common/../../es.yml", "", "", 400},
+		{"overlay without image", "PUT", "/api/compose/files/node1/es.yml", "services:\n  es:\n    mem_limit: 2g\n", etag(overlayIn), 200},
+		{"standalone file without image", "PUT", "/api/compose/files/node1/kibana.yml", "services:\n  kibana:\n    mem_limit: 2g\n", "", 400},
+		{"invalid overlay", "PUT", "/api/compose/files/node1/es.yml", "services:\n  es:\n    extends: missing\n", "*", 400},
+	}
+
+	for _, test := range tests {
+		if w := request(test.method, test.url, test.body, test.ifMatch); w.Code != test.code {
+			t.Errorf("%s: expected %d, got %d %s", test.name, test.code, w.Code, w.Body.String())
+		}
+	}
+
+	updated, _ := ioutil.ReadFile(overlay)
+	if string(updated) != "services:\n  es:\n    mem_limit: 2g\n" {
+		t.Errorf("expected the overlay to be updated, got %q", updated)
+	}
+	if w := request("GET", "/api/compose/files/node1/es.yml/versions", "", ""); !bytes.Contains(w.Body.Bytes(), []byte(contentHash(overlayIn))) {
+		t.Errorf("expected the previous overlay to be kept as a version, got %s", w.Body.String())
+	}
+}
+
+func TestEditComposeFileGlobalLock(t *testing.T) {
+	dir, cleanup := useComposesDir(t)
+	defer cleanup()
+	defer useServerLock(t)()
+
+	web := filepath.Join(dir, "web.yml")
+	if err := writeComposeFile(web, []byte("services:\n  web:\n    image: nginx\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := acquireGlobalLock("rollout of web.yml by ba", 60); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, handler := range []gin.HandlerFunc{PutComposeFile, DeleteComposeFile} {
+		c, w, _ := gin.CreateTestContext()
+		c.Request, _ = http.NewRequest("PUT", "/api/compose/files/web.yml", bytes.NewBufferString("services:\n  web:\n    image: nginx:1.13\n"))
+		c.Request.Header.Set("If-Match", "*")
+		c.Params = gin.Params{{Key: "name", Value: "web.yml"}}
+		handler(c)
+
+		if w.Code != 409 {
+			t.Errorf("expected the edit to wait for the rollout, got %d %s", w.Code, w.Body.String())
+		}
+	}
+
+	if in, _ := ioutil.ReadFile(web); string(in) != "services:\n  web:\n    image: nginx\n" {
+		t.Errorf("expected the compose file unchanged, got %q", in)
+	}
+}
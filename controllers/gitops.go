@@ -0,0 +1,274 @@
+package controllers
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	gitops = gitopsState{}
+	gmx    sync.RWMutex
+
+	gitDeployOnChange = false
+	gitSyncNow        = make(chan struct{}, 1)
+)
+
+const kindGitOps = "gitops"
+
+type gitopsState struct {
+	Repo     string `json:"repo"`
+	Ref      string `json:"ref"`
+	Commit   string `json:"commit"`
+	LastSync int64  `json:"lastSync"`
+	Error    string `json:"error,omitempty"`
+
+	// Compose files changed by a commit not deployed yet
+	Pending []string `json:"pending,omitempty"`
+}
+
+// SyncGit checks out periodically a branch or a tag of a git repository
+// in the compose directory and deploys the compose files changed by
+// a new commit if deployOnChange is set
+func SyncGit(repo string, ref string, period int, deployOnChange bool) {
+	gmx.Lock()
+	gitops.Repo = repo
+	gitops.Ref = ref
+	gitDeployOnChange = deployOnChange
+	gmx.Unlock()
+
+	ticker := time.NewTicker(time.Duration(period) * time.Second)
+	for {
+		syncGit()
+
+		select {
+		case <-ticker.C:
+		case <-gitSyncNow:
+		}
+	}
+}
+
+// deployedCommit is the commit checked out in the compose directory
+func deployedCommit() string {
+	gmx.RLock()
+	defer gmx.RUnlock()
+	return gitops.Commit
+}
+
+func GetGitOps(c *gin.Context) {
+	gmx.RLock()
+	defer gmx.RUnlock()
+
+	if gitops.Repo == "" {
+		c.JSON(404, "gitops is not enabled")
+		return
+	}
+
+	c.JSON(200, gitops)
+}
+
+// SyncGitOps triggers a synchronization without waiting the next period
+func SyncGitOps(c *gin.Context) {
+	gmx.RLock()
+	enabled := gitops.Repo != ""
+	gmx.RUnlock()
+
+	if !enabled {
+		c.JSON(404, "gitops is not enabled")
+		return
+	}
+
+	select {
+	case gitSyncNow <- struct{}{}:
+	default:
+	}
+
+	c.JSON(200, true)
+}
+
+func syncGit() {
+	gmx.RLock()
+	repo, ref, pending := gitops.Repo, gitops.Ref, gitops.Pending
+	gmx.RUnlock()
+
+	previous, commit, err := checkoutGit(repo, ref)
+
+	gmx.Lock()
+	gitops.LastSync = time.Now().Unix()
+	gitops.Error = ""
+	if err != nil {
+		gitops.Error = err.Error()
+	} else {
+		gitops.Commit = commit
+	}
+	gmx.Unlock()
+
+	if err != nil {
+		logrus.WithError(err).Errorf("Fail to sync %s@%s", repo, ref)
+		return
+	}
+
+	if previous != commit {
+		logrus.WithField("commit", commit).Infof("Checkout %s@%s", repo, ref)
+
+		changed, err := changedComposeFiles(previous, commit)
+		if err != nil {
+			logrus.WithError(err).Error("Fail to list the changed compose files")
+		}
+		pending = mergeFiles(pending, changed)
+	}
+
+	if gitDeployOnChange && len(pending) > 0 {
+		pending = deployGitChanges(commit, pending)
+	}
+
+	gmx.Lock()
+	gitops.Pending = pending
+	gmx.Unlock()
+}
+
+// checkoutGit fetches the repository and checks out the commit of the ref,
+// it returns the commit checked out before and after
+func checkoutGit(repo string, ref string) (string, string, error) {
+	if _, err := os.Stat(filepath.Join(composesDir, ".git")); os.IsNotExist(err) {
+		if err := os.MkdirAll(composesDir, 0755); err != nil {
+			return "", "", err
+		}
+		if _, err := git("init"); err != nil {
+			return "", "", err
+		}
+	}
+
+	if _, err := git("config", "remote.origin.url", repo); err != nil {
+		return "", "", err
+	}
+	if _, err := git("config", "remote.origin.fetch", "+refs/heads/*:refs/remotes/origin/*"); err != nil {
+		return "", "", err
+	}
+	if _, err := git("fetch", "--prune", "--tags", "--force", "origin"); err != nil {
+		return "", "", err
+	}
+
+	commit, err := resolveGitRef(ref)
+	if err != nil {
+		return "", "", err
+	}
+
+	// HEAD does not exist before the first checkout
+	previous, _ := git("rev-parse", "--verify", "--quiet", "HEAD")
+	if previous == commit {
+		return previous, commit, nil
+	}
+
+	if _, err := git("checkout", "--force", "--detach", commit); err != nil {
+		return "", "", err
+	}
+
+	return previous, commit, nil
+}
+
+// resolveGitRef finds the commit of a branch, a tag or a commit
+func resolveGitRef(ref string) (string, error) {
+	for _, candidate := range []string{"refs/remotes/origin/" + ref, "refs/tags/" + ref, ref} {
+		if commit, err := git("rev-parse", "--verify", "--quiet", candidate+"^{commit}"); err == nil {
+			return commit, nil
+		}
+	}
+	return "", errors.New("unknown branch, tag or commit " + ref)
+}
+
+// changedComposeFiles lists the compose files still existing changed
+// between two commits, all of them when there is no previous commit
+func changedComposeFiles(previous string, commit string) ([]string, error) {
+	if previous == "" {
+		return listComposeFiles()
+	}
+
+	out, err := git("diff", "--name-only", previous, commit)
+	if err != nil {
+		return nil, err
+	}
+
+	// The compose files of the other nodes are not deployed and
+	// a changed overlay deploys its common compose file
+	listed, err := listComposeFiles()
+	if err != nil {
+		return nil, err
+	}
+	deployed := map[string]bool{}
+	for _, path := range listed {
+		deployed[path] = true
+	}
+
+	composeFiles := []string{}
+	seen := map[string]bool{}
+	for _, name := range strings.Split(out, "\n") {
+		if !isComposeFile(name) {
+			continue
+		}
+		path := deployedFile(filepath.Join(composesDir, name))
+		if deployed[path] && !seen[path] {
+			seen[path] = true
+			composeFiles = append(composeFiles, path)
+		}
+	}
+
+	return composeFiles, nil
+}
+
+// deployGitChanges deploys the compose files changed by a commit and
+// returns the ones to retry later because they are locked
+func deployGitChanges(commit string, composeFiles []string) []string {
+	if err := checkGlobalLock(); err != nil {
+		logrus.WithError(err).Warn("Postpone the deployment of the git changes")
+		return composeFiles
+	}
+
+	unlock, err := lockComposes(composeFiles, kindGitOps)
+	if err != nil {
+		logrus.WithError(err).Warn("Postpone the deployment of the git changes")
+		return composeFiles
+	}
+	defer unlock()
+
+	e := deploy(kindGitOps, composeFiles)
+	e.User = kindGitOps
+	e.Commit = commit
+	rollbacks := rollbackUnhealthy(e)
+	recordExecution(e)
+	for _, rb := range rollbacks {
+		recordExecution(rb)
+	}
+
+	return []string{}
+}
+
+// mergeFiles merges two lists of files without duplicates
+func mergeFiles(files []string, others []string) []string {
+	seen := map[string]bool{}
+	merged := []string{}
+	for _, file := range append(append([]string{}, files...), others...) {
+		if !seen[file] {
+			seen[file] = true
+			merged = append(merged, file)
+		}
+	}
+	return merged
+}
+
+// git runs a git command in the compose directory
+func git(args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", composesDir}, args...)...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", errors.New("git " + strings.Join(args, " ") + ": " + strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,210 @@
+package controllers
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// gitRepo creates a repository on the branch master, the returned
+// function commits files in it and returns the commit
+func gitRepo(t *testing.T) (string, func(files map[string]string, tag string) string, func()) {
+	dir, err := ioutil.TempDir("", "squid-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-C", dir, "-c", "user.name=squid", "-c", "user.email=squid@localhost"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %s: %s", strings.Join(args, " "), out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	run("init")
+	run("symbolic-ref", "HEAD", "refs/heads/master")
+
+	commit := func(files map[string]string, tag string) string {
+		for name, content := range files {
+			path := filepath.Join(dir, name)
+			if content == "" {
+				run("rm", "-q", name)
+				continue
+			}
+			if err := writeComposeFile(path, []byte(content)); err != nil {
+				t.Fatal(err)
+			}
+			run("add", name)
+		}
+		run("commit", "-q", "-m", "update")
+		if tag != "" {
+			run("tag", tag)
+		}
+		return run("rev-parse", "HEAD")
+	}
+
+	return dir, commit, func() { os.RemoveAll(dir) }
+}
+
+func TestCheckoutGit(t *testing.T) {
+	_, cleanup := useComposesDir(t)
+	defer cleanup()
+	repo, commit, cleanupRepo := gitRepo(t)
+	defer cleanupRepo()
+
+	first := commit(map[string]string{
+		"web.yml":    "services:\n  web:\n    image: nginx:1.12\n",
+		"db.yml":     "services:\n  db:\n    image: postgres:9\n",
+		"README.md":  "compose files",
+		"old/es.yml": "services:\n  es:\n    image: es:5\n",
+	}, "v1")
+
+	previous, checkedOut, err := checkoutGit(repo, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if previous != "" || checkedOut != first {
+		t.Errorf("expected the first checkout of %s, got %q -> %q", first, previous, checkedOut)
+	}
+	changed, err := changedComposeFiles(previous, checkedOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{composePath("db.yml"), composePath("old/es.yml"), composePath("web.yml")}; !reflect.DeepEqual(changed, expected) {
+		t.Errorf("expected all the compose files deployed first, got %v", changed)
+	}
+
+	second := commit(map[string]string{
+		"web.yml":    "services:\n  web:\n    image: nginx:1.13\n",
+		"README.md":  "compose files of the cluster",
+		"old/es.yml": "",
+	}, "")
+
+	tests := []struct {
+		ref      string
+		previous string
+		commit   string
+		changed  []string
+	}{
+		// Nothing new
+		{"v1", first, first, []string{}},
+		{"master", first, second, []string{composePath("web.yml")}},
+		{"master", second, second, []string{}},
+		{first, second, first, []string{composePath("old/es.yml"), composePath("web.yml")}},
+	}
+
+	for _, test := range tests {
+		previous, checkedOut, err := checkoutGit(repo, test.ref)
+		if err != nil {
+			t.Errorf("%s: %s", test.ref, err)
+			continue
+		}
+		if previous != test.previous || checkedOut != test.commit {
+			t.Errorf("%s: expected %s -> %s, got %s -> %s", test.ref, test.previous, test.commit, previous, checkedOut)
+		}
+		if previous == checkedOut {
+			continue
+		}
+		changed, err := changedComposeFiles(previous, checkedOut)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(changed, test.changed) {
+			t.Errorf("%s: expected the changed compose files %v, got %v", test.ref, test.changed, changed)
+		}
+	}
+
+	if _, _, err := checkoutGit(repo, "v2"); err == nil {
+		t.Error("expected an unknown ref to be refused")
+	}
+	if _, _, err := checkoutGit(filepath.Join(repo, "missing"), "master"); err == nil {
+		t.Error("expected an unknown repository to be refused")
+	}
+}
+
+func composePath(name string) string {
+	return filepath.Join(composesDir, filepath.FromSlash(name))
+}
+
+func TestMergeFiles(t *testing.T) {
+	tests := []struct {
+		files    []string
+		others   []string
+		expected []string
+	}{
+		{nil, nil, []string{}},
+		{[]string{"a.yml"}, nil, []string{"a.yml"}},
+		{[]string{"a.yml", "b.yml"}, []string{"b.yml", "c.yml"}, []string{"a.yml", "b.yml", "c.yml"}},
+		{[]string{"a.yml", "a.yml"}, []string{"a.yml"}, []string{"a.yml"}},
+	}
+
+	for _, test := range tests {
+		if merged := mergeFiles(test.files, test.others); !reflect.DeepEqual(merged, test.expected) {
+			t.Errorf("%v + %v: expected %v, got %v", test.files, test.others, test.expected, merged)
+		}
+	}
+}
+
+func TestSyncGit(t *testing.T) {
+	_, cleanup := useComposesDir(t)
+	defer cleanup()
+	repo, commit, cleanupRepo := gitRepo(t)
+	defer cleanupRepo()
+
+	first := commit(map[string]string{"web.yml": "services:\n  web:\n    image: nginx:1.12\n"}, "")
+	gmx.Lock()
+	gitops = gitopsState{Repo: repo, Ref: "master"}
+	gmx.Unlock()
+	defer func() {
+		gmx.Lock()
+		gitops = gitopsState{}
+		gmx.Unlock()
+	}()
+
+	tests := []struct {
+		ref     string
+		commit  string
+		error   bool
+		pending []string
+	}{
+		{"master", first, false, []string{composePath("web.yml")}},
+		// The commit checked out is kept on error
+		{"v2", first, true, []string{composePath("web.yml")}},
+		{"master", first, false, []string{composePath("web.yml")}},
+	}
+
+	for i, test := range tests {
+		gmx.Lock()
+		gitops.Ref = test.ref
+		gmx.Unlock()
+
+		syncGit()
+
+		gmx.RLock()
+		state := gitops
+		gmx.RUnlock()
+		if state.Commit != test.commit || (state.Error != "") != test.error || state.LastSync == 0 {
+			t.Errorf("%d: unexpected state %+v", i, state)
+		}
+		if !reflect.DeepEqual(state.Pending, test.pending) {
+			t.Errorf("%d: expected the pending compose files %v, got %v", i, test.pending, state.Pending)
+		}
+	}
+}
+
+func TestGitOpsDisabled(t *testing.T) {
+	for _, handler := range []gin.HandlerFunc{GetGitOps, SyncGitOps} {
+		c, w, _ := gin.CreateTestContext()
+		handler(c)
+		if w.Code != 404 {
+			t.Errorf("expected 404 when gitops is not enabled, got %d", w.Code)
+		}
+	}
+}
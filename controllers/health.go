@@ -0,0 +1,271 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/types"
+	"golang.org/x/net/context"
+)
+
+var (
+	healthTimeout      = time.Duration(0)
+	healthCheckPeriod  = time.Duration(2) * time.Second
+	probeTimeout       = time.Duration(5) * time.Second
+	autoRollbackHealth = false
+
+	// Containers without healthcheck must be up for this duration to be healthy
+	healthMinUptime = time.Duration(10) * time.Second
+
+	// Label of a service defining a probe: http(s)://host:port/path or tcp://host:port
+	probeLabel = "squid.probe"
+
+	// rollbackCompose restores and deploys the last good definition of a compose file
+	rollbackCompose = rollback
+)
+
+const (
+	healthHealthy   = "healthy"
+	healthUnhealthy = "unhealthy"
+)
+
+type verification struct {
+	Status   string            `json:"status"`
+	Duration string            `json:"duration"`
+	Services map[string]string `json:"services"`
+}
+
+// SetHealthCheck enables the verification of the deployed services during
+// timeout seconds (0 to disable) and the automatic rollback of the unhealthy ones
+func SetHealthCheck(timeout int, rollback bool) {
+	healthTimeout = time.Duration(timeout) * time.Second
+	autoRollbackHealth = rollback
+}
+
+// verifyCompose waits for all the services of a compose file to be running
+// and healthy until the health timeout
+func verifyCompose(compose *RawCompose) *verification {
+	start := time.Now()
+	deadline := start.Add(healthTimeout)
+
+	for {
+		states, healthy := composeHealth(compose)
+
+		if healthy || time.Now().After(deadline) {
+			v := &verification{
+				Status:   healthHealthy,
+				Duration: time.Since(start).String(),
+				Services: states,
+			}
+			if !healthy {
+				v.Status = healthUnhealthy
+			}
+			return v
+		}
+
+		time.Sleep(healthCheckPeriod)
+	}
+}
+
+// composeHealth gets the health state of each service of a compose file
+func composeHealth(compose *RawCompose) (map[string]string, bool) {
+	states := map[string]string{}
+
+	containers, err := dockerStatus()
+	if err != nil {
+		for name := range compose.Services {
+			states[name] = err.Error()
+		}
+		return states, false
+	}
+
+	healthy := true
+	for name, composeService := range compose.Services {
+		state := serviceHealth(containers, compose, name, composeService)
+		if state != healthHealthy {
+			healthy = false
+		}
+		states[name] = state
+	}
+
+	return states, healthy
+}
+
+func serviceHealth(containers []types.Container, compose *RawCompose, name string, composeService map[string]interface{}) string {
+	containerName := serviceContainerName(name, composeService)
+	image := serviceImage(compose, name, composeService)
+
+	found := false
+	for _, container := range containers {
+		if !matchContainer(strings.Replace(container.Names[0], "/", "", -1), container.Image, containerName, image) {
+			continue
+		}
+		found = true
+
+		if state := containerHealth(container.ID); state != healthHealthy {
+			return state
+		}
+	}
+	if !found {
+		return "not found"
+	}
+
+	if probe, ok := serviceLabels(composeService)[probeLabel]; ok {
+		if err := runProbe(probe); err != nil {
+			return "probe failed: " + err.Error()
+		}
+	}
+
+	return healthHealthy
+}
+
+// containerState is the part of docker inspect used to check the health
+// of a container, the docker healthcheck is not known by the vendored client
+type containerState struct {
+	State struct {
+		Running    bool
+		Restarting bool
+		ExitCode   int
+		StartedAt  time.Time
+		Health     *struct {
+			Status string
+		}
+	}
+}
+
+func containerHealth(id string) string {
+	_, raw, err := dockerClient.ContainerInspectWithRaw(context.Background(), id, false)
+	if err != nil {
+		return err.Error()
+	}
+
+	var c containerState
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return err.Error()
+	}
+
+	return c.health()
+}
+
+// health is the health state of a container inspected
+func (c *containerState) health() string {
+	switch {
+	case c.State.Restarting:
+		return "restarting"
+	case !c.State.Running:
+		return fmt.Sprintf("exited (%d)", c.State.ExitCode)
+	case c.State.Health != nil:
+		// Use the docker healthcheck when defined
+		return c.State.Health.Status
+	case time.Since(c.State.StartedAt) < healthMinUptime:
+		return "starting"
+	default:
+		return healthHealthy
+	}
+}
+
+// serviceLabels reads the labels of a service declared as a map or a list
+func serviceLabels(composeService map[string]interface{}) map[string]string {
+	labels := map[string]string{}
+
+	switch l := composeService["labels"].(type) {
+	case map[string]interface{}:
+		for k, v := range l {
+			labels[k] = fmt.Sprint(v)
+		}
+	case []interface{}:
+		for _, kv := range l {
+			parts := strings.SplitN(fmt.Sprint(kv), "=", 2)
+			if len(parts) == 2 {
+				labels[parts[0]] = parts[1]
+			} else {
+				labels[parts[0]] = ""
+			}
+		}
+	}
+
+	return labels
+}
+
+func runProbe(probe string) error {
+	u, err := url.Parse(probe)
+	if err != nil {
+		return err
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		client := http.Client{Timeout: probeTimeout}
+		resp, err := client.Get(probe)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return fmt.Errorf("status %d", resp.StatusCode)
+		}
+		return nil
+	case "tcp":
+		conn, err := net.DialTimeout("tcp", u.Host, probeTimeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	default:
+		return fmt.Errorf("unsupported probe %s", probe)
+	}
+}
+
+// unhealthyServices formats the services not healthy of a verification
+func (v *verification) unhealthyServices() string {
+	services := []string{}
+	for name, state := range v.Services {
+		if state != healthHealthy {
+			services = append(services, name+": "+state)
+		}
+	}
+	sort.Strings(services)
+	return strings.Join(services, ", ")
+}
+
+// rollbackUnhealthy restores the previous version of the compose files
+// which failed the verification of an execution not yet historized
+func rollbackUnhealthy(e *execution) []*execution {
+	rollbacks := []*execution{}
+	if !autoRollbackHealth {
+		return rollbacks
+	}
+
+	if e.ID == "" {
+		e.ID = newExecutionID()
+	}
+
+	for _, result := range e.Results {
+		if result.Verification == nil || result.Verification.Status == healthHealthy {
+			continue
+		}
+
+		rb, err := rollbackCompose(result.Compose, "")
+		if err != nil {
+			logrus.WithError(err).Errorf("Fail to roll back %s", result.Compose)
+			result.Error += "; rollback: " + err.Error()
+			continue
+		}
+
+		rb.ID = newExecutionID()
+		rb.User = e.User
+		rb.Cause = e.ID
+		rb.RollbackOf = e.ID
+		result.RolledBack = rb.ID
+		rollbacks = append(rollbacks, rb)
+	}
+
+	return rollbacks
+}
@@ -0,0 +1,200 @@
+package controllers
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/docker/engine-api/types"
+)
+
+func TestRunProbe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+			w.WriteHeader(200)
+		case "/moved":
+			http.Redirect(w, r, "/health", http.StatusFound)
+		case "/not-modified":
+			w.WriteHeader(304)
+		default:
+			w.WriteHeader(503)
+		}
+	}))
+	defer server.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	tests := []struct {
+		probe   string
+		healthy bool
+	}{
+		{server.URL + "/health", true},
+		{server.URL + "/moved", true},
+		{server.URL + "/not-modified", true},
+		{server.URL + "/down", false},
+		{"http://" + closedAddr + "/health", false},
+		{"tcp://" + listener.Addr().String(), true},
+		{"tcp://" + closedAddr, false},
+		{"udp://" + listener.Addr().String(), false},
+		{"://invalid", false},
+	}
+
+	for _, test := range tests {
+		if err := runProbe(test.probe); (err == nil) != test.healthy {
+			t.Errorf("%s: expected healthy %v, got %v", test.probe, test.healthy, err)
+		}
+	}
+}
+
+func TestContainerStateHealth(t *testing.T) {
+	state := func(running bool, restarting bool, exitCode int, uptime time.Duration, health string) *containerState {
+		c := &containerState{}
+		c.State.Running = running
+		c.State.Restarting = restarting
+		c.State.ExitCode = exitCode
+		c.State.StartedAt = time.Now().Add(-uptime)
+		if health != "" {
+			c.State.Health = &struct{ Status string }{health}
+		}
+		return c
+	}
+
+	tests := []struct {
+		name     string
+		state    *containerState
+		expected string
+	}{
+		{"up for long", state(true, false, 0, time.Minute, ""), healthHealthy},
+		{"just started", state(true, false, 0, time.Second, ""), "starting"},
+		{"healthcheck healthy", state(true, false, 0, time.Second, "healthy"), healthHealthy},
+		{"healthcheck starting", state(true, false, 0, time.Minute, "starting"), "starting"},
+		{"healthcheck unhealthy", state(true, false, 0, time.Minute, "unhealthy"), healthUnhealthy},
+		{"restarting", state(false, true, 1, time.Minute, ""), "restarting"},
+		{"exited", state(false, false, 137, time.Minute, ""), "exited (137)"},
+	}
+
+	for _, test := range tests {
+		if health := test.state.health(); health != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, health)
+		}
+	}
+}
+
+func TestServiceHealthNotFound(t *testing.T) {
+	compose := &RawCompose{File: "web.yml", Services: RawServices{"web": {"image": "nginx"}}}
+	containers := []types.Container{{ID: "1", Names: []string{"/squid_db_1"}, Image: "postgres"}}
+
+	if state := serviceHealth(containers, compose, "web", compose.Services["web"]); state != "not found" {
+		t.Errorf("expected the service without container not found, got %s", state)
+	}
+}
+
+func TestServiceLabels(t *testing.T) {
+	tests := []struct {
+		labels   interface{}
+		expected map[string]string
+	}{
+		{nil, map[string]string{}},
+		{map[string]interface{}{probeLabel: "tcp://db:5432", "port": 80}, map[string]string{probeLabel: "tcp://db:5432", "port": "80"}},
+		{[]interface{}{probeLabel + "=http://web/health?a=b", "flag"}, map[string]string{probeLabel: "http://web/health?a=b", "flag": ""}},
+	}
+
+	for _, test := range tests {
+		labels := serviceLabels(map[string]interface{}{"labels": test.labels})
+		if len(labels) != len(test.expected) {
+			t.Errorf("%v: expected %v, got %v", test.labels, test.expected, labels)
+			continue
+		}
+		for k, v := range test.expected {
+			if labels[k] != v {
+				t.Errorf("%v: expected %v, got %v", test.labels, test.expected, labels)
+			}
+		}
+	}
+}
+
+func TestRollbackUnhealthy(t *testing.T) {
+	defer func(enabled bool) { autoRollbackHealth = enabled }(autoRollbackHealth)
+	defer func(f func(string, string) (*execution, error)) { rollbackCompose = f }(rollbackCompose)
+
+	rolledBack := []string{}
+	rollbackCompose = func(compose string, undo string) (*execution, error) {
+		if undo != "" {
+			t.Errorf("expected the last good definition of %s, got the one before %s", compose, undo)
+		}
+		if compose == "compose/cache.yml" {
+			return nil, notFoundError("no previous successful deployment of " + compose)
+		}
+		rolledBack = append(rolledBack, compose)
+		return &execution{Kind: kindRollback}, nil
+	}
+
+	unhealthy := &verification{Status: healthUnhealthy, Services: map[string]string{"web": "exited (1)"}}
+	results := func() []*cmdResult {
+		return []*cmdResult{
+			{Compose: "compose/db.yml", Status: resultSuccess},
+			{Compose: "compose/es.yml", Status: resultSuccess, Verification: &verification{Status: healthHealthy}},
+			{Compose: "compose/web.yml", Status: resultFailed, Error: "unhealthy", Verification: unhealthy},
+			{Compose: "compose/cache.yml", Status: resultFailed, Error: "unhealthy", Verification: unhealthy},
+		}
+	}
+
+	autoRollbackHealth = false
+	if rollbacks := rollbackUnhealthy(&execution{User: "ba", Results: results()}); len(rollbacks) != 0 || len(rolledBack) != 0 {
+		t.Fatalf("expected no rollback when disabled, got %v", rolledBack)
+	}
+
+	autoRollbackHealth = true
+	e := &execution{User: "ba", Results: results()}
+	rollbacks := rollbackUnhealthy(e)
+
+	if e.ID == "" {
+		t.Fatal("expected the execution to get its ID to be the cause of the rollbacks")
+	}
+	if len(rollbacks) != 1 || len(rolledBack) != 1 || rolledBack[0] != "compose/web.yml" {
+		t.Fatalf("expected only web.yml rolled back, got %v", rolledBack)
+	}
+	rb := rollbacks[0]
+	if rb.ID == "" || rb.ID == e.ID || rb.Cause != e.ID || rb.RollbackOf != e.ID || rb.User != "ba" {
+		t.Errorf("unexpected rollback %+v of %s", rb, e.ID)
+	}
+
+	tests := []struct {
+		rolledBack string
+		err        string
+	}{
+		{"", ""},
+		{"", ""},
+		{rb.ID, "unhealthy"},
+		{"", "unhealthy; rollback: no previous successful deployment of compose/cache.yml"},
+	}
+	for i, test := range tests {
+		result := e.Results[i]
+		if result.RolledBack != test.rolledBack || result.Error != test.err {
+			t.Errorf("%s: expected rolled back %q and error %q, got %q and %q", result.Compose, test.rolledBack, test.err, result.RolledBack, result.Error)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	historyResults = []*execution{}
+	mx             sync.RWMutex
+
+	lastExecutionID int64
+	idMutex         sync.Mutex
+
+	historyFile = "history.json"
+	historySize = 500
+
+	defaultPageLimit = 20
+	maxPageLimit     = 200
+)
+
+// InitHistory loads the executions persisted in file and bounds
+// the history to the size last executions
+func InitHistory(file string, size int) error {
+	mx.Lock()
+	defer mx.Unlock()
+
+	historyFile = file
+	historySize = size
+
+	if historyFile == "" {
+		return nil
+	}
+
+	in, err := ioutil.ReadFile(historyFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	executions := []*execution{}
+	if err := json.Unmarshal(in, &executions); err != nil {
+		return err
+	}
+	historyResults = trimHistory(executions)
+
+	return nil
+}
+
+// recordExecution historizes an execution and persists the history
+func recordExecution(e *execution) {
+	mx.Lock()
+	defer mx.Unlock()
+
+	if e.ID == "" {
+		e.ID = newExecutionID()
+	}
+	if e.Node == "" {
+		e.Node = hostname
+	}
+
+	historyResults = trimHistory(append(historyResults, e))
+
+	if err := saveHistory(); err != nil {
+		logrus.WithError(err).Error("Fail to persist executions history")
+	}
+}
+
+// newExecutionID generates an increasing execution ID
+func newExecutionID() string {
+	idMutex.Lock()
+	defer idMutex.Unlock()
+
+	id := time.Now().UnixNano()
+	if id <= lastExecutionID {
+		id = lastExecutionID + 1
+	}
+	lastExecutionID = id
+
+	return strconv.FormatInt(id, 36)
+}
+
+func trimHistory(executions []*execution) []*execution {
+	if historySize > 0 && len(executions) > historySize {
+		return executions[len(executions)-historySize:]
+	}
+	return executions
+}
+
+// saveHistory writes the history in a temporary file renamed
+// afterwards to never leave a truncated history on disk
+func saveHistory() error {
+	if historyFile == "" {
+		return nil
+	}
+
+	out, err := json.Marshal(historyResults)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(historyFile), ".history")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(out); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), historyFile)
+}
+
+type executionFilter struct {
+	Kind    string
+	Compose string
+	Status  string
+	Node    string
+	User    string
+	Since   int64
+	Until   int64
+}
+
+func (f executionFilter) match(e *execution) bool {
+	if f.Kind != "" && e.Kind != f.Kind {
+		return false
+	}
+	if f.Status != "" && e.Status != f.Status {
+		return false
+	}
+	if f.Node != "" && e.Node != f.Node {
+		return false
+	}
+	if f.User != "" && e.User != f.User {
+		return false
+	}
+	if f.Since > 0 && e.Date < f.Since {
+		return false
+	}
+	if f.Until > 0 && e.Date > f.Until {
+		return false
+	}
+	if f.Compose != "" {
+		for _, result := range e.Results {
+			if result.Compose == f.Compose || filepath.Base(result.Compose) == f.Compose {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+type executionsPage struct {
+	Total      int          `json:"total"`
+	Page       int          `json:"page"`
+	Limit      int          `json:"limit"`
+	Executions []*execution `json:"executions"`
+}
+
+// ComposeUpHistory lists the executions, most recent first, without their
+// output, redacted unless an admin asks for unredacted=true
+func ComposeUpHistory(c *gin.Context) {
+	redact, ok := redactionFor(c)
+	if !ok {
+		return
+	}
+
+	filter, err := parseExecutionFilter(c)
+	if err != nil {
+		c.JSON(400, err.Error())
+		return
+	}
+
+	page, err := queryInt(c, "page", 1)
+	if err != nil || page < 1 {
+		c.JSON(400, "page must be a positive integer")
+		return
+	}
+	limit, err := queryInt(c, "limit", defaultPageLimit)
+	if err != nil || limit < 1 || limit > maxPageLimit {
+		c.JSON(400, fmt.Sprintf("limit must be between 1 and %d", maxPageLimit))
+		return
+	}
+
+	mx.RLock()
+	matching := []*execution{}
+	for i := len(historyResults) - 1; i >= 0; i-- {
+		if filter.match(historyResults[i]) {
+			matching = append(matching, historyResults[i])
+		}
+	}
+	mx.RUnlock()
+
+	from := (page - 1) * limit
+	if from > len(matching) {
+		from = len(matching)
+	}
+	to := from + limit
+	if to > len(matching) {
+		to = len(matching)
+	}
+
+	executions := []*execution{}
+	for _, e := range matching[from:to] {
+		if redact {
+			e = e.redacted()
+		}
+		executions = append(executions, e.summary())
+	}
+
+	c.JSON(200, executionsPage{
+		Total:      len(matching),
+		Page:       page,
+		Limit:      limit,
+		Executions: executions,
+	})
+}
+
+// GetExecution returns an execution with the full output of its commands
+func GetExecution(c *gin.Context) {
+	redact, ok := redactionFor(c)
+	if !ok {
+		return
+	}
+
+	e := findExecution(c.Param("id"))
+	if e == nil {
+		c.JSON(404, "execution not found")
+		return
+	}
+
+	if redact {
+		e = e.redacted()
+	}
+	c.JSON(200, e)
+}
+
+func findExecution(id string) *execution {
+	mx.RLock()
+	defer mx.RUnlock()
+
+	for _, e := range historyResults {
+		if e.ID == id {
+			return e
+		}
+	}
+	return nil
+}
+
+// summary copies an execution without the output of its commands
+// nor the snapshots of the compose files
+func (e *execution) summary() *execution {
+	s := *e
+	s.Results = make([]*cmdResult, len(e.Results))
+	for i, result := range e.Results {
+		r := *result
+		r.Result = nil
+		r.Snapshot = ""
+		r.OverlaySnapshot = ""
+		s.Results[i] = &r
+	}
+	return &s
+}
+
+func parseExecutionFilter(c *gin.Context) (executionFilter, error) {
+	filter := executionFilter{
+		Kind:    c.Query("kind"),
+		Compose: c.Query("compose"),
+		Status:  c.Query("status"),
+		Node:    c.Query("node"),
+		User:    c.Query("user"),
+	}
+
+	var err error
+	if filter.Since, err = queryTimestamp(c, "since"); err != nil {
+		return filter, err
+	}
+	if filter.Until, err = queryTimestamp(c, "until"); err != nil {
+		return filter, err
+	}
+
+	return filter, nil
+}
+
+func queryInt(c *gin.Context, key string, defaultValue int) (int, error) {
+	value := c.Query(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// queryTimestamp reads a unix timestamp or a RFC3339 date
+func queryTimestamp(c *gin.Context, key string) (int64, error) {
+	value := strings.TrimSpace(c.Query(key))
+	if value == "" {
+		return 0, nil
+	}
+	if ts, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return ts, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return 0, errors.New(key + " must be a unix timestamp or a RFC3339 date")
+	}
+	return t.Unix(), nil
+}
+
+func authUser(c *gin.Context) string {
+	user, ok := c.Get(gin.AuthUserKey)
+	if !ok {
+		return ""
+	}
+	return user.(string)
+}
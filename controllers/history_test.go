@@ -0,0 +1,140 @@
+package controllers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestComposeUpHistory(t *testing.T) {
+	executions := []*execution{
+		{ID: "1", Kind: "up", Date: 100, Node: "node1", User: "ba", Status: executionSuccess, Results: []*cmdResult{{Compose: "compose/web.yml"}}},
+		{ID: "2", Kind: "up", Date: 200, Node: "node2", User: "ba", Status: executionFailed, Results: []*cmdResult{{Compose: "compose/db.yml"}}},
+		{ID: "3", Kind: "rollback", Date: 300, Node: "node1", User: "admin", Status: executionSuccess, Results: []*cmdResult{{Compose: "compose/web.yml"}}},
+		{ID: "4", Kind: "up", Date: 400, Node: "node1", User: "ba", Status: executionPartial, Results: []*cmdResult{{Compose: "compose/web.yml"}, {Compose: "compose/db.yml"}}},
+		{ID: "5", Kind: "up", Date: 500, Node: "node2", User: "admin", Status: executionSuccess, Results: []*cmdResult{{Compose: "compose/cache.yml"}}},
+	}
+	defer useHistory(executions...)()
+
+	tests := []struct {
+		query string
+		code  int
+		total int
+		ids   []string
+	}{
+		{"", 200, 5, []string{"5", "4", "3", "2", "1"}},
+		{"limit=2", 200, 5, []string{"5", "4"}},
+		{"limit=2&page=2", 200, 5, []string{"3", "2"}},
+		{"limit=2&page=3", 200, 5, []string{"1"}},
+		{"limit=2&page=4", 200, 5, []string{}},
+		{"kind=rollback", 200, 1, []string{"3"}},
+		{"status=success", 200, 3, []string{"5", "3", "1"}},
+		{"node=node2", 200, 2, []string{"5", "2"}},
+		{"user=admin", 200, 2, []string{"5", "3"}},
+		{"compose=db.yml", 200, 2, []string{"4", "2"}},
+		{"compose=compose/web.yml&kind=up", 200, 2, []string{"4", "1"}},
+		{"since=200&until=400", 200, 3, []string{"4", "3", "2"}},
+		{"since=1970-01-01T00:06:40Z", 200, 2, []string{"5", "4"}},
+		{"page=0", 400, 0, nil},
+		{"limit=0", 400, 0, nil},
+		{"limit=1000", 400, 0, nil},
+		{"page=first", 400, 0, nil},
+		{"since=yesterday", 400, 0, nil},
+	}
+
+	for _, test := range tests {
+		c, w, _ := gin.CreateTestContext()
+		c.Request, _ = http.NewRequest("GET", "/api/compose/history?"+test.query, nil)
+		ComposeUpHistory(c)
+
+		if w.Code != test.code {
+			t.Errorf("%q: expected %d, got %d %s", test.query, test.code, w.Code, w.Body.String())
+			continue
+		}
+		if test.code != 200 {
+			continue
+		}
+
+		var page executionsPage
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		ids := []string{}
+		for _, e := range page.Executions {
+			ids = append(ids, e.ID)
+		}
+		if page.Total != test.total || !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("%q: expected %d executions %v, got %d %v", test.query, test.total, test.ids, page.Total, ids)
+		}
+	}
+}
+
+func TestHistoryPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "squid-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(size int) { historySize = size }(historySize)
+	defer useHistory()()
+
+	file := filepath.Join(dir, "history.json")
+	if err := InitHistory(file, 3); err != nil {
+		t.Fatalf("expected a missing history to be empty, got %s", err)
+	}
+
+	for _, id := range []string{"1", "2", "3", "4", "5"} {
+		recordExecution(&execution{ID: id, Status: executionSuccess})
+	}
+
+	// The history is replaced atomically, no temporary file is left
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "history.json" {
+		t.Errorf("expected only the history file, got %d files", len(files))
+	}
+
+	tests := []struct {
+		size int
+		ids  []string
+	}{
+		{3, []string{"3", "4", "5"}},
+		{2, []string{"4", "5"}},
+		{0, []string{"3", "4", "5"}},
+	}
+
+	for _, test := range tests {
+		mx.Lock()
+		historyResults = []*execution{}
+		mx.Unlock()
+
+		if err := InitHistory(file, test.size); err != nil {
+			t.Fatal(err)
+		}
+		ids := []string{}
+		for _, e := range historyResults {
+			ids = append(ids, e.ID)
+			if e.Node != hostname {
+				t.Errorf("expected the node of the execution to be kept, got %q", e.Node)
+			}
+		}
+		if !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("size %d: expected %v reloaded, got %v", test.size, test.ids, ids)
+		}
+	}
+
+	if err := ioutil.WriteFile(file, []byte("{truncated"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := InitHistory(file, 3); err == nil {
+		t.Error("expected an invalid history to be refused")
+	}
+}
@@ -0,0 +1,237 @@
+package controllers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Directory of the compose files shared by all the nodes, the compose
+// directory is layered when it exists: compose/common/es.yml is merged
+// with the overlay compose/<hostname>/es.yml of the node
+const commonLayer = "common"
+
+// isLayered tells if the compose directory has a common layer
+func isLayered() bool {
+	f, err := os.Stat(filepath.Join(composesDir, commonLayer))
+	return err == nil && f.IsDir()
+}
+
+// listLayeredComposeFiles lists the compose files of the common layer
+// and the ones only defined by the layer of the node, the layers of
+// the other nodes are ignored
+func listLayeredComposeFiles() ([]string, error) {
+	common, err := walkComposeFiles(filepath.Join(composesDir, commonLayer))
+	if err != nil {
+		return nil, err
+	}
+	node, err := walkComposeFiles(filepath.Join(composesDir, hostname))
+	if err != nil {
+		return nil, err
+	}
+
+	composeFiles := common
+	for _, path := range node {
+		if _, ok := baseFile(path); !ok {
+			composeFiles = append(composeFiles, path)
+		}
+	}
+	sort.Strings(composeFiles)
+
+	return composeFiles, nil
+}
+
+// walkComposeFiles lists the compose files of a directory and its
+// subdirectories, a missing directory has none
+func walkComposeFiles(dir string) ([]string, error) {
+	composeFiles := []string{}
+
+	err := filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == dir {
+			return filepath.SkipDir
+		}
+		// Ignore the git repository of the gitops mode
+		if f != nil && f.IsDir() && f.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if f != nil && !f.IsDir() && isComposeFile(path) {
+			composeFiles = append(composeFiles, path)
+		}
+		return nil
+	})
+
+	return composeFiles, err
+}
+
+// layerPath splits the path of a compose file in its layer and its
+// path in the layer: common and es.yml for compose/common/es.yml
+func layerPath(path string) (string, string, bool) {
+	if !isLayered() {
+		return "", "", false
+	}
+	parts := strings.SplitN(filepath.ToSlash(composeName(path)), "/", 2)
+	if len(parts) != 2 || (parts[0] != commonLayer && parts[0] != hostname) {
+		return "", "", false
+	}
+	return parts[0], filepath.FromSlash(parts[1]), true
+}
+
+// overlayFile finds the overlay of the node of a common compose file
+func overlayFile(path string) (string, bool) {
+	layer, rel, ok := layerPath(path)
+	if !ok || layer != commonLayer {
+		return "", false
+	}
+	overlay := filepath.Join(composesDir, hostname, rel)
+	if _, err := os.Stat(overlay); err != nil {
+		return "", false
+	}
+	return overlay, true
+}
+
+// baseFile finds the common compose file an overlay of the node is merged on
+func baseFile(path string) (string, bool) {
+	layer, rel, ok := layerPath(path)
+	if !ok || layer != hostname {
+		return "", false
+	}
+	base := filepath.Join(composesDir, commonLayer, rel)
+	if _, err := os.Stat(base); err != nil {
+		return "", false
+	}
+	return base, true
+}
+
+// deployedFile is the compose file deployed when a file changes:
+// the common compose file for an overlay of the node
+func deployedFile(path string) string {
+	if base, ok := baseFile(path); ok {
+		return base
+	}
+	return path
+}
+
+// readComposeLayers reads a compose file and the overlay of the node
+// merged on it, the path of the overlay is empty when there is none
+func readComposeLayers(path string) ([]byte, string, []byte, error) {
+	in, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	overlay, ok := overlayFile(path)
+	if !ok {
+		return in, "", nil, nil
+	}
+	overlayIn, err := ioutil.ReadFile(overlay)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return in, overlay, overlayIn, nil
+}
+
+// layersHash hashes a compose file followed by its overlay
+// to detect the changes of both
+func layersHash(in []byte, overlay string, overlayIn []byte) string {
+	if overlay == "" {
+		return contentHash(in)
+	}
+	layers := append(append([]byte{}, in...), '\n')
+	return contentHash(append(layers, overlayIn...))
+}
+
+// restoreOverlay restores the overlay of the node deployed with a
+// common compose file, removed if the compose file had none
+func restoreOverlay(compose string, deployed *cmdResult) error {
+	if deployed.Overlay != "" {
+		return writeComposeFile(deployed.Overlay, []byte(deployed.OverlaySnapshot))
+	}
+	if overlay, ok := overlayFile(compose); ok {
+		return os.Remove(overlay)
+	}
+	return nil
+}
+
+// loadOverlay merges the overlay of the node of a common compose file and
+// returns the provenance of the fields of the services: the compose file
+// of the layer defining a field, both layers for the merged ones
+func loadOverlay(file string, doc *composeDoc, env map[string]string) (map[string]map[string]string, error) {
+	overlay, ok := overlayFile(file)
+	if !ok {
+		return nil, nil
+	}
+
+	in, err := ioutil.ReadFile(overlay)
+	if err != nil {
+		return nil, err
+	}
+	in, err = renderTemplate(overlay, in)
+	if err != nil {
+		return nil, err
+	}
+	overlayDoc, err := decodeCompose(in, env)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", composeName(overlay), err)
+	}
+
+	base, top := composeName(file), composeName(overlay)
+	provenance := map[string]map[string]string{}
+	for name, service := range doc.Services {
+		provenance[name] = map[string]string{}
+		for key := range service {
+			provenance[name][key] = base
+		}
+	}
+	for name, service := range overlayDoc.Services {
+		if provenance[name] == nil {
+			provenance[name] = map[string]string{}
+		}
+		for key, value := range service {
+			previous, defined := doc.Services[name][key]
+			if defined && mergedField(key, previous, value) {
+				provenance[name][key] = base + ", " + top
+			} else {
+				provenance[name][key] = top
+			}
+		}
+	}
+
+	doc.merge(overlayDoc)
+
+	return provenance, nil
+}
+
+// mergedField tells if the values of a field of two layers are merged
+// rather than replaced
+func mergedField(key string, base interface{}, override interface{}) bool {
+	if mappingKeys[key] || sequenceKeys[key] || mountKeys[key] {
+		return true
+	}
+	return isMapping(base) && isMapping(override)
+}
+
+func isMapping(value interface{}) bool {
+	_, ok := value.(map[string]interface{})
+	return ok
+}
+
+// deepMerge merges two mappings, the nested mappings are merged
+// and the other values replaced
+func deepMerge(base map[string]interface{}, override map[string]interface{}) map[string]interface{} {
+	merged := map[string]interface{}{}
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range override {
+		previous, _ := merged[k].(map[string]interface{})
+		mapping, ok := v.(map[string]interface{})
+		if previous != nil && ok {
+			merged[k] = deepMerge(previous, mapping)
+			continue
+		}
+		merged[k] = v
+	}
+	return merged
+}
@@ -0,0 +1,191 @@
+package controllers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// useLayers sets a layered compose directory with the common
+// compose file es.yml and its overlay for the node
+func useLayers(t *testing.T) (string, string, func()) {
+	dir, cleanup := useComposesDir(t)
+	previous := hostname
+	hostname = "node1"
+
+	common := filepath.Join(dir, commonLayer, "es.yml")
+	overlay := filepath.Join(dir, hostname, "es.yml")
+	for file, content := range map[string]string{
+		common:  "version: '2'\nservices:\n  es:\n    image: es:6\n",
+		overlay: "services:\n  es:\n    mem_limit: 4g\n",
+	} {
+		if err := writeComposeFile(file, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return common, overlay, func() {
+		hostname = previous
+		cleanup()
+	}
+}
+
+func TestHashComposeFilesWithOverlay(t *testing.T) {
+	common, overlay, cleanup := useLayers(t)
+	defer cleanup()
+
+	in, found, overlayIn, err := readComposeLayers(common)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != overlay {
+		t.Fatalf("expected the overlay %s, got %q", overlay, found)
+	}
+
+	// The hash of a deployment is the one the reconciliation compares to
+	hashes, err := hashComposeFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deployed := layersHash(in, found, overlayIn)
+	if hashes[common] != deployed {
+		t.Errorf("expected the hash %s, got %s", deployed, hashes[common])
+	}
+	if deployed == contentHash(in) {
+		t.Error("expected the hash to include the overlay")
+	}
+
+	if err := ioutil.WriteFile(overlay, []byte("services:\n  es:\n    mem_limit: 8g\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hashes, err = hashComposeFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashes[common] == deployed {
+		t.Error("expected a change of the overlay to change the hash")
+	}
+}
+
+func TestRestoreOverlay(t *testing.T) {
+	common, overlay, cleanup := useLayers(t)
+	defer cleanup()
+
+	deployed := &cmdResult{Compose: common, Overlay: overlay, OverlaySnapshot: "services:\n  es:\n    mem_limit: 2g\n"}
+	if err := restoreOverlay(common, deployed); err != nil {
+		t.Fatal(err)
+	}
+	in, err := ioutil.ReadFile(overlay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(in) != deployed.OverlaySnapshot {
+		t.Errorf("expected the overlay to be restored, got %q", in)
+	}
+
+	// Deployed without overlay
+	if err := restoreOverlay(common, &cmdResult{Compose: common}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(overlay); !os.IsNotExist(err) {
+		t.Errorf("expected the overlay to be removed, got %v", err)
+	}
+}
+
+func TestDiffExecutionsWithOverlay(t *testing.T) {
+	base := "services:\n  es:\n    image: es:6\n"
+	from := &execution{Results: []*cmdResult{{
+		Compose: "compose/common/es.yml", Hash: "a", Snapshot: base,
+		Overlay: "compose/node1/es.yml", OverlaySnapshot: "services:\n  es:\n    mem_limit: 2g\n",
+	}}}
+	to := &execution{Results: []*cmdResult{{
+		Compose: "compose/common/es.yml", Hash: "b", Snapshot: base,
+		Overlay: "compose/node1/es.yml", OverlaySnapshot: "services:\n  es:\n    mem_limit: 4g\n",
+	}}}
+
+	diffs := diffExecutions(from, to)
+	if len(diffs) != 2 {
+		t.Fatalf("expected a diff of the compose file and of its overlay, got %+v", diffs)
+	}
+	for _, d := range diffs {
+		switch d.Compose {
+		case "compose/common/es.yml":
+			if d.Changed {
+				t.Errorf("expected the common compose file unchanged, got %v", d.Diff)
+			}
+		case "compose/node1/es.yml":
+			if !d.Changed || len(d.Diff) != 4 {
+				t.Errorf("expected the overlay changed, got %v", d.Diff)
+			}
+		default:
+			t.Errorf("unexpected diff of %s", d.Compose)
+		}
+	}
+}
+
+func TestMergedField(t *testing.T) {
+	mapping := map[string]interface{}{"a": 1}
+
+	tests := []struct {
+		key      string
+		base     interface{}
+		override interface{}
+		expected bool
+	}{
+		{"environment", []interface{}{"A=1"}, mapping, true},
+		{"ports", []interface{}{"80:80"}, []interface{}{"443:443"}, true},
+		{"volumes", []interface{}{"/data:/data"}, []interface{}{"/logs:/logs"}, true},
+		{"logging", mapping, mapping, true},
+		{"logging", mapping, "none", false},
+		{"image", "nginx:1.12", "nginx:1.13", false},
+		{"command", []interface{}{"a"}, []interface{}{"b"}, false},
+	}
+
+	for _, test := range tests {
+		if merged := mergedField(test.key, test.base, test.override); merged != test.expected {
+			t.Errorf("%s %v %v: expected %v, got %v", test.key, test.base, test.override, test.expected, merged)
+		}
+	}
+}
+
+func TestDeepMerge(t *testing.T) {
+	tests := []struct {
+		base     map[string]interface{}
+		override map[string]interface{}
+		expected map[string]interface{}
+	}{
+		{
+			map[string]interface{}{"a": 1},
+			map[string]interface{}{},
+			map[string]interface{}{"a": 1},
+		},
+		{
+			map[string]interface{}{"a": 1, "b": 2},
+			map[string]interface{}{"b": 3, "c": 4},
+			map[string]interface{}{"a": 1, "b": 3, "c": 4},
+		},
+		{
+			map[string]interface{}{"m": map[string]interface{}{"x": 1, "n": map[string]interface{}{"y": 2}}},
+			map[string]interface{}{"m": map[string]interface{}{"n": map[string]interface{}{"z": 3}}},
+			map[string]interface{}{"m": map[string]interface{}{"x": 1, "n": map[string]interface{}{"y": 2, "z": 3}}},
+		},
+		{
+			map[string]interface{}{"m": map[string]interface{}{"x": 1}},
+			map[string]interface{}{"m": "replaced"},
+			map[string]interface{}{"m": "replaced"},
+		},
+		{
+			map[string]interface{}{"l": []interface{}{1}},
+			map[string]interface{}{"l": []interface{}{2}},
+			map[string]interface{}{"l": []interface{}{2}},
+		},
+	}
+
+	for i, test := range tests {
+		if merged := deepMerge(test.base, test.override); !reflect.DeepEqual(merged, test.expected) {
+			t.Errorf("%d: expected %v, got %v", i, test.expected, merged)
+		}
+	}
+}
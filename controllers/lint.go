@@ -0,0 +1,493 @@
+package controllers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+
+	statusInvalid = "Invalid"
+)
+
+var (
+	topLevelKeys = map[string]bool{
+		"version":  true,
+		"services": true,
+		"networks": true,
+		"volumes":  true,
+		"secrets":  true,
+		"configs":  true,
+	}
+
+	// Keys of a service in the v1, v2 and v3 formats
+	serviceKeys = map[string]bool{
+		"build": true, "cap_add": true, "cap_drop": true, "cgroup_parent": true, "command": true,
+		"configs": true, "container_name": true, "cpu_count": true, "cpu_percent": true,
+		"cpu_quota": true, "cpu_period": true, "cpu_rt_period": true, "cpu_rt_runtime": true,
+		"cpu_shares": true, "cpus": true, "cpuset": true, "credential_spec": true,
+		"depends_on": true, "deploy": true, "device_cgroup_rules": true, "devices": true,
+		"dns": true, "dns_opt": true, "dns_search": true, "domainname": true, "entrypoint": true,
+		"env_file": true, "environment": true, "expose": true, "extends": true,
+		"external_links": true, "extra_hosts": true, "group_add": true, "healthcheck": true,
+		"hostname": true, "image": true, "init": true, "ipc": true, "isolation": true,
+		"labels": true, "links": true, "log_driver": true, "log_opt": true, "logging": true,
+		"mac_address": true, "mem_limit": true, "mem_reservation": true, "mem_swappiness": true,
+		"memswap_limit": true, "net": true, "network_mode": true, "networks": true,
+		"oom_kill_disable": true, "oom_score_adj": true, "pid": true, "pids_limit": true,
+		"platform": true, "ports": true, "privileged": true, "read_only": true, "restart": true,
+		"runtime": true, "scale": true, "secrets": true, "security_opt": true, "shm_size": true,
+		"stdin_open": true, "stop_grace_period": true, "stop_signal": true, "storage_opt": true,
+		"sysctls": true, "tmpfs": true, "tty": true, "ulimits": true, "user": true,
+		"userns_mode": true, "volume_driver": true, "volumes": true, "volumes_from": true,
+		"working_dir": true,
+	}
+
+	// Keys of a service whose value must be a string
+	stringKeys = []string{"image", "container_name", "restart", "network_mode", "hostname", "user", "working_dir"}
+	// Keys of a service whose value must be a list
+	listKeys = []string{"ports", "expose", "volumes", "links", "external_links", "cap_add", "cap_drop", "devices", "volumes_from"}
+
+	yamlErrorLine = regexp.MustCompile(`line (\d+)`)
+)
+
+type diagnostic struct {
+	File     string `json:"file"`
+	Line     int    `json:"line,omitempty"`
+	Severity string `json:"severity"`
+	Rule     string `json:"rule"`
+	Message  string `json:"message"`
+}
+
+type lintResult struct {
+	File        string       `json:"file"`
+	Valid       bool         `json:"valid"`
+	Diagnostics []diagnostic `json:"diagnostics"`
+}
+
+// lintedCompose is a compose file being linted
+type lintedCompose struct {
+	file    string
+	lines   []string
+	compose *RawCompose
+	diags   []diagnostic
+}
+
+func (l *lintedCompose) add(severity string, rule string, line int, format string, args ...interface{}) {
+	l.diags = append(l.diags, diagnostic{
+		File:     l.file,
+		Line:     line,
+		Severity: severity,
+		Rule:     rule,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// LintComposes checks the compose files given in query (all of them by
+// default) and returns their diagnostics. The rules across files are
+// checked against all the compose files of the node.
+func LintComposes(c *gin.Context) {
+	files, err := listComposeFiles()
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	selected := map[string]bool{}
+	for _, name := range c.Request.URL.Query()["file"] {
+		path, err := composeFilePath(name)
+		if err != nil {
+			c.JSON(400, err.Error())
+			return
+		}
+		selected[composeName(path)] = true
+	}
+
+	results := []lintResult{}
+	for _, result := range lintComposeFiles(files) {
+		if len(selected) == 0 || selected[result.File] {
+			results = append(results, result)
+		}
+	}
+
+	c.JSON(200, results)
+}
+
+// lintComposeFiles checks compose files one by one then the rules across them
+func lintComposeFiles(files []string) []lintResult {
+	linted := []*lintedCompose{}
+	for _, file := range files {
+		linted = append(linted, lintComposeFile(file))
+	}
+
+	lintContainerNames(linted)
+	lintPortConflicts(linted)
+
+	results := []lintResult{}
+	for _, l := range linted {
+		sort.SliceStable(l.diags, func(i, j int) bool {
+			return l.diags[i].Line < l.diags[j].Line
+		})
+		result := lintResult{File: l.file, Valid: true, Diagnostics: l.diags}
+		for _, d := range l.diags {
+			if d.Severity == severityError {
+				result.Valid = false
+			}
+		}
+		results = append(results, result)
+	}
+
+	return results
+}
+
+// lintComposeFile checks the syntax and the schema of a compose file
+// and the rules only concerning the file
+func lintComposeFile(file string) *lintedCompose {
+	l := &lintedCompose{file: composeName(file), diags: []diagnostic{}}
+
+	in, err := ioutil.ReadFile(file)
+	if err != nil {
+		l.add(severityError, "read", 0, "%s", err)
+		return l
+	}
+	// The lines of a template are the ones of its rendering
+	in, err = renderTemplate(file, in)
+	if err != nil {
+		l.add(severityError, "template", templateLine(err), "%s", err)
+		return l
+	}
+	l.lines = strings.Split(string(in), "\n")
+
+	var raw interface{}
+	if err := yaml.Unmarshal(in, &raw); err != nil {
+		l.add(severityError, "syntax", errorLine(err), "%s", err)
+		return l
+	}
+
+	l.lintSchema(raw)
+
+	compose, err := loadCompose(file)
+	if err != nil {
+		l.add(severityError, "load", 0, "%s", err)
+		return l
+	}
+	l.compose = compose
+
+	if len(compose.Services) == 0 {
+		l.add(severityWarning, "no-services", 0, "no services defined")
+	}
+	for _, name := range sortedServices(compose) {
+		composeService := compose.Services[name]
+		l.lintImage(name, composeService)
+		if compose.HasServices {
+			l.lintNetworks(name, composeService)
+			l.lintVolumes(name, composeService)
+		}
+	}
+
+	return l
+}
+
+// lintSchema checks the keys and the types of the values of a compose file
+func (l *lintedCompose) lintSchema(raw interface{}) {
+	top, ok := raw.(map[string]interface{})
+	if !ok {
+		l.add(severityError, "schema", 1, "a compose file must be a mapping")
+		return
+	}
+
+	_, hasVersion := top["version"]
+	_, hasServices := top["services"]
+	services := top
+	prefix := []string{}
+	if hasVersion || hasServices {
+		for key := range top {
+			if !topLevelKeys[key] && !strings.HasPrefix(key, "x-") {
+				l.add(severityError, "schema", l.line(key), "unknown top-level key %s", key)
+			}
+		}
+		services, ok = top["services"].(map[string]interface{})
+		if !ok {
+			l.add(severityError, "schema", l.line("services"), "services must be a mapping")
+			return
+		}
+		prefix = []string{"services"}
+	}
+
+	names := []string{}
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if strings.HasPrefix(name, "x-") {
+			continue
+		}
+		path := append(append([]string{}, prefix...), name)
+
+		service, ok := services[name].(map[string]interface{})
+		if !ok {
+			l.add(severityError, "schema", l.line(path...), "service %s must be a mapping", name)
+			continue
+		}
+
+		for key, value := range service {
+			keyPath := append(append([]string{}, path...), key)
+			if !serviceKeys[key] && !strings.HasPrefix(key, "x-") {
+				l.add(severityError, "schema", l.line(keyPath...), "service %s: unknown key %s", name, key)
+				continue
+			}
+			if isIn(key, stringKeys) {
+				if _, ok := value.(string); !ok {
+					l.add(severityError, "schema", l.line(keyPath...), "service %s: %s must be a string", name, key)
+				}
+			}
+			if isIn(key, listKeys) {
+				if _, ok := value.([]interface{}); !ok {
+					l.add(severityError, "schema", l.line(keyPath...), "service %s: %s must be a list", name, key)
+				}
+			}
+		}
+	}
+}
+
+func (l *lintedCompose) lintImage(name string, composeService map[string]interface{}) {
+	_, hasImage := composeService["image"]
+	_, hasBuild := composeService["build"]
+	if !hasImage && !hasBuild {
+		l.add(severityError, "missing-image", l.serviceLine(name), "service %s: image or build is required", name)
+	}
+}
+
+// lintNetworks checks the networks of a service are declared
+func (l *lintedCompose) lintNetworks(name string, composeService map[string]interface{}) {
+	networks := []string{}
+	switch n := composeService["networks"].(type) {
+	case []interface{}:
+		for _, network := range n {
+			networks = append(networks, fmt.Sprint(network))
+		}
+	case map[string]interface{}:
+		for network := range n {
+			networks = append(networks, network)
+		}
+	}
+	sort.Strings(networks)
+
+	for _, network := range networks {
+		if _, ok := l.compose.Networks[network]; !ok && network != "default" {
+			l.add(severityError, "undefined-network", l.serviceLine(name, "networks"),
+				"service %s: network %s is not declared in networks", name, network)
+		}
+	}
+}
+
+// lintVolumes checks the named volumes of a service are declared
+func (l *lintedCompose) lintVolumes(name string, composeService map[string]interface{}) {
+	for _, volume := range toSequence(composeService["volumes"]) {
+		source := ""
+		switch v := volume.(type) {
+		case map[string]interface{}:
+			if t, _ := v["type"].(string); t == "volume" {
+				source, _ = v["source"].(string)
+			}
+		default:
+			parts := strings.Split(fmt.Sprint(v), ":")
+			if len(parts) > 1 {
+				source = parts[0]
+			}
+		}
+
+		// Host paths are not named volumes
+		if source == "" || strings.ContainsAny(source[:1], "/.~$") {
+			continue
+		}
+		if _, ok := l.compose.Volumes[source]; !ok {
+			l.add(severityError, "undefined-volume", l.serviceLine(name, "volumes"),
+				"service %s: volume %s is not declared in volumes", name, source)
+		}
+	}
+}
+
+// lintContainerNames checks a container_name is used by a single service
+func lintContainerNames(linted []*lintedCompose) {
+	owners := map[string][]string{}
+	for _, l := range linted {
+		if l.compose == nil {
+			continue
+		}
+		for _, name := range sortedServices(l.compose) {
+			if containerName, ok := l.compose.Services[name]["container_name"].(string); ok {
+				owners[containerName] = append(owners[containerName], l.file+"/"+name)
+			}
+		}
+	}
+
+	for _, l := range linted {
+		if l.compose == nil {
+			continue
+		}
+		for _, name := range sortedServices(l.compose) {
+			containerName, ok := l.compose.Services[name]["container_name"].(string)
+			if !ok || len(owners[containerName]) < 2 {
+				continue
+			}
+			others := []string{}
+			for _, owner := range owners[containerName] {
+				if owner != l.file+"/"+name {
+					others = append(others, owner)
+				}
+			}
+			l.add(severityError, "duplicate-container-name", l.serviceLine(name, "container_name"),
+				"service %s: container_name %s also used by %s", name, containerName, strings.Join(others, ", "))
+		}
+	}
+}
+
+// lintPortConflicts checks a host port is published by a single service
+func lintPortConflicts(linted []*lintedCompose) {
+	type published struct {
+		owner string
+		port  hostPort
+	}
+
+	all := []published{}
+	for _, l := range linted {
+		if l.compose == nil {
+			continue
+		}
+		for _, name := range sortedServices(l.compose) {
+			ports, err := serviceHostPorts(l.compose.Services[name])
+			if err != nil {
+				l.add(severityError, "schema", l.serviceLine(name, "ports"), "service %s: %s", name, err)
+				continue
+			}
+			for _, port := range ports {
+				all = append(all, published{owner: l.file + "/" + name, port: port})
+			}
+		}
+	}
+
+	for _, l := range linted {
+		if l.compose == nil {
+			continue
+		}
+		for _, name := range sortedServices(l.compose) {
+			ports, _ := serviceHostPorts(l.compose.Services[name])
+			owner := l.file + "/" + name
+			for i, port := range ports {
+				others := []string{}
+				for _, p := range all {
+					if p.owner != owner && p.port.conflicts(port) && !isIn(p.owner, others) {
+						others = append(others, p.owner)
+					}
+				}
+				// A service publishing twice the same port
+				for _, other := range ports[:i] {
+					if other.conflicts(port) && !isIn(owner, others) {
+						others = append(others, owner)
+					}
+				}
+				if len(others) > 0 {
+					l.add(severityError, "port-conflict", l.serviceLine(name, "ports"),
+						"service %s: host port %s also published by %s", name, port, strings.Join(others, ", "))
+				}
+			}
+		}
+	}
+}
+
+// serviceLine finds the line of a key of a service in the v1 or v2/v3 layout
+func (l *lintedCompose) serviceLine(name string, keys ...string) int {
+	path := append([]string{name}, keys...)
+	if l.compose != nil && l.compose.HasServices {
+		path = append([]string{"services"}, path...)
+	}
+	return l.line(path...)
+}
+
+// line finds the line of a key given its path from the top of the YAML
+// document, the line of the deepest key found when the key is not found
+func (l *lintedCompose) line(path ...string) int {
+	found := 0
+	start, indent := 0, -1
+
+	for _, key := range path {
+		childIndent := -1
+		match := -1
+		for i := start; i < len(l.lines); i++ {
+			trimmed := strings.TrimLeft(l.lines[i], " ")
+			if trimmed == "" || strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, "---") {
+				continue
+			}
+			current := len(l.lines[i]) - len(trimmed)
+			if current <= indent {
+				break
+			}
+			if childIndent < 0 {
+				childIndent = current
+			}
+			if current == childIndent && isYAMLKey(trimmed, key) {
+				match = i
+				break
+			}
+		}
+		if match < 0 {
+			return found
+		}
+		found = match + 1
+		start, indent = match+1, childIndent
+	}
+
+	return found
+}
+
+func isYAMLKey(line string, key string) bool {
+	for _, quoted := range []string{key, `"` + key + `"`, "'" + key + "'"} {
+		if strings.HasPrefix(line, quoted+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// errorLine extracts the line of a YAML syntax error
+func errorLine(err error) int {
+	m := yamlErrorLine.FindStringSubmatch(err.Error())
+	if m == nil {
+		return 0
+	}
+	line, _ := strconv.Atoi(m[1])
+	return line
+}
+
+func isIn(s string, list []string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// invalidComposeService flags a compose file that can't be loaded in the status
+func invalidComposeService(file string, err string) Service {
+	return Service{
+		Name:       filepath.Base(file),
+		Compose:    file,
+		Status:     statusInvalid,
+		FullStatus: "Invalid compose file: " + err,
+		Definition: []string{},
+	}
+}
@@ -0,0 +1,137 @@
+package controllers
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// lintFiles writes compose files in the compose directory and lints them,
+// the diagnostics are formatted as file:line severity rule
+func lintFiles(t *testing.T, files map[string]string) map[string][]string {
+	dir, cleanup := useComposesDir(t)
+	defer cleanup()
+
+	paths := []string{}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := writeComposeFile(path, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	diags := map[string][]string{}
+	for _, result := range lintComposeFiles(paths) {
+		formatted := []string{}
+		for _, d := range result.Diagnostics {
+			formatted = append(formatted, fmt.Sprintf("%s:%d %s %s", d.File, d.Line, d.Severity, d.Rule))
+		}
+		diags[result.File] = formatted
+	}
+	return diags
+}
+
+func TestLintComposeFile(t *testing.T) {
+	tests := []struct {
+		content  string
+		expected []string
+	}{
+		{"version: '2'\nservices:\n  web:\n    image: nginx\n", []string{}},
+		// v1 layout
+		{"web:\n  image: nginx\n  ports:\n    - 80:80\n", []string{}},
+		{"version: '2'\nservices:\n  web:\n    image: nginx\n   ports: [80]\n", []string{"test.yml:4 error syntax"}},
+		{"- web\n- db\n", []string{"test.yml:0 error load", "test.yml:1 error schema"}},
+		{"version: '2'\nservice:\n  web:\n    image: nginx\n", []string{"test.yml:0 error schema", "test.yml:0 warning no-services", "test.yml:2 error schema"}},
+		{"version: '2'\nservices:\n  web:\n    build: .\n  db:\n    restart: always\n", []string{"test.yml:5 error missing-image"}},
+		{
+			"version: '2'\nservices:\n  web:\n    image: nginx\n    port: 80\n    ports: 80\n    x-squid:\n      maxInstances: 1\n",
+			[]string{"test.yml:5 error schema", "test.yml:6 error schema"},
+		},
+		{"version: '2'\nservices: {}\n", []string{"test.yml:0 warning no-services"}},
+		{
+			"version: '2'\nservices:\n  web:\n    image: nginx\n    networks:\n      - front\n      - default\nnetworks:\n  back: {}\n",
+			[]string{"test.yml:5 error undefined-network"},
+		},
+		{
+			"version: '2'\nservices:\n  db:\n    image: postgres\n    volumes:\n      - data:/var/lib/postgresql\n      - ./conf:/etc/postgresql\n      - /logs:/var/log\n      - logs:/var/log/postgresql\nvolumes:\n  logs: {}\n",
+			[]string{"test.yml:5 error undefined-volume"},
+		},
+		{
+			"version: '3.2'\nservices:\n  db:\n    image: postgres\n    volumes:\n      - type: volume\n        source: data\n        target: /data\n      - type: bind\n        source: conf\n        target: /conf\n",
+			[]string{"test.yml:5 error undefined-volume"},
+		},
+		{
+			"version: '2'\nservices:\n  web:\n    image: nginx\n    ports:\n      - 80:80\n      - 8080:80\n      - 80:8080\n",
+			[]string{"test.yml:5 error port-conflict"},
+		},
+	}
+
+	for i, test := range tests {
+		diags := lintFiles(t, map[string]string{"test.yml": test.content})
+		if !reflect.DeepEqual(diags["test.yml"], test.expected) {
+			t.Errorf("%d: expected %v, got %v", i, test.expected, diags["test.yml"])
+		}
+	}
+}
+
+func TestLintAcrossComposeFiles(t *testing.T) {
+	diags := lintFiles(t, map[string]string{
+		"web.yml":    "version: '2'\nservices:\n  web:\n    image: nginx\n    container_name: web\n    ports:\n      - 80:80\n",
+		"proxy.yml":  "version: '2'\nservices:\n  proxy:\n    image: traefik\n    ports:\n      - 127.0.0.1:8080:8080\n      - 80:80\n",
+		"admin.yml":  "version: '2'\nservices:\n  admin:\n    image: nginx\n    ports:\n      - 10.0.0.1:8080:80\n",
+		"legacy.yml": "web:\n  image: nginx:1.10\n  container_name: web\n",
+		"broken.yml": "version: '2'\nservices:\n  web: [\n",
+	})
+
+	expected := map[string][]string{
+		"web.yml":    {"web.yml:5 error duplicate-container-name", "web.yml:6 error port-conflict"},
+		"proxy.yml":  {"proxy.yml:5 error port-conflict"},
+		"admin.yml":  {},
+		"legacy.yml": {"legacy.yml:3 error duplicate-container-name"},
+		"broken.yml": {"broken.yml:3 error syntax"},
+	}
+	if !reflect.DeepEqual(diags, expected) {
+		t.Errorf("expected %v, got %v", expected, diags)
+	}
+}
+
+func TestLintLine(t *testing.T) {
+	l := &lintedCompose{lines: []string{
+		"version: '2'",
+		"# web",
+		"services:",
+		"  web:",
+		"    image: nginx",
+		"",
+		"    'ports':",
+		"      - 80:80",
+		"  db:",
+		"    image: postgres",
+		"networks:",
+		"  image: {}",
+	}}
+
+	tests := []struct {
+		path     []string
+		expected int
+	}{
+		{[]string{"version"}, 1},
+		{[]string{"services"}, 3},
+		{[]string{"services", "web", "image"}, 5},
+		{[]string{"services", "web", "ports"}, 7},
+		{[]string{"services", "db", "image"}, 10},
+		{[]string{"networks", "image"}, 12},
+		// The line of the deepest key found
+		{[]string{"services", "db", "ports"}, 9},
+		{[]string{"services", "es"}, 3},
+		{[]string{"volumes"}, 0},
+	}
+
+	for _, test := range tests {
+		if line := l.line(test.path...); line != test.expected {
+			t.Errorf("%v: expected line %d, got %d", test.path, test.expected, line)
+		}
+	}
+}
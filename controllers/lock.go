@@ -0,0 +1,270 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	composeLocks = map[string]*deployLock{}
+	globalLock   *deployLock
+	lmx          sync.Mutex
+
+	collectorURL = ""
+	// Deploy when the server can't be asked for the global lock
+	lockFailOpen = false
+
+	defaultLockTTL = 1800
+	// Header carrying the token of the global lock on the requests of the
+	// operations orchestrated by the server, the agents check it with the server
+	lockHeader = "X-Squid-Lock"
+)
+
+type deployLock struct {
+	Token   string `json:"token,omitempty"`
+	Owner   string `json:"owner"`
+	Since   int64  `json:"since"`
+	Expires int64  `json:"expires,omitempty"`
+	// Held tells if the token given to check the lock holds it
+	Held bool `json:"held,omitempty"`
+}
+
+func (l *deployLock) expired() bool {
+	return l.Expires > 0 && time.Now().Unix() > l.Expires
+}
+
+func (l *deployLock) String() string {
+	return "locked by " + l.Owner + " since " + time.Unix(l.Since, 0).UTC().Format(time.RFC3339)
+}
+
+// SetCollector sets the URL of the server an agent checks the global lock on
+func SetCollector(collector string) {
+	collectorURL = strings.TrimRight(collector, "/")
+}
+
+// SetLockFailOpen lets the node deploy when the server can't be reached
+// to check the global lock, the deployments are refused otherwise
+func SetLockFailOpen(enabled bool) {
+	lockFailOpen = enabled
+}
+
+// lockComposes locks compose files for an owner or fails if one of
+// them is already locked. The returned function releases the locks.
+func lockComposes(composeFiles []string, owner string) (func(), error) {
+	lmx.Lock()
+	defer lmx.Unlock()
+
+	locked := []string{}
+	for _, compose := range composeFiles {
+		if l, ok := composeLocks[compose]; ok {
+			locked = append(locked, compose+" "+l.String())
+		}
+	}
+	if len(locked) > 0 {
+		sort.Strings(locked)
+		return nil, conflictError(strings.Join(locked, ", "))
+	}
+
+	now := time.Now().Unix()
+	for _, compose := range composeFiles {
+		composeLocks[compose] = &deployLock{Owner: owner, Since: now}
+	}
+
+	return func() {
+		lmx.Lock()
+		defer lmx.Unlock()
+		for _, compose := range composeFiles {
+			delete(composeLocks, compose)
+		}
+	}, nil
+}
+
+// lockDeploy checks the global lock of the server then locks the compose
+// files deployed by a request. The requests of the operation holding the
+// global lock carry its token.
+func lockDeploy(c *gin.Context, composeFiles []string) (func(), error) {
+	owner, err := checkGlobalLockToken(c.Request.Header.Get(lockHeader))
+	if err != nil {
+		return nil, err
+	}
+	if owner == "" {
+		owner = authUser(c)
+	}
+
+	return lockComposes(composeFiles, owner)
+}
+
+// checkGlobalLock asks the server if a cluster-wide operation is in progress
+func checkGlobalLock() error {
+	_, err := checkGlobalLockToken("")
+	return err
+}
+
+// checkGlobalLockToken asks the server if a cluster-wide operation is in
+// progress, unless it holds the global lock with the token: its owner
+// is returned
+func checkGlobalLockToken(token string) (string, error) {
+	if collectorURL == "" {
+		return "", nil
+	}
+
+	var l *deployLock
+	if err := lockedCollectorGet("/lock", token, &l); err != nil {
+		if lockFailOpen {
+			logrus.WithError(err).Warn("Fail to check the global lock")
+			return "", nil
+		}
+		return "", unavailableError("fail to check the global lock: " + err.Error())
+	}
+	if l == nil || l.expired() {
+		return "", nil
+	}
+	if l.Held {
+		return l.Owner, nil
+	}
+
+	return "", conflictError("cluster " + l.String())
+}
+
+// acquireGlobalLock takes the global lock of the server during ttl seconds
+func acquireGlobalLock(owner string, ttl int) (string, error) {
+	lmx.Lock()
+	defer lmx.Unlock()
+
+	if globalLock != nil && !globalLock.expired() {
+		return "", conflictError("cluster " + globalLock.String())
+	}
+	if ttl <= 0 {
+		ttl = defaultLockTTL
+	}
+
+	now := time.Now().Unix()
+	token, err := newLockToken()
+	if err != nil {
+		return "", err
+	}
+
+	globalLock = &deployLock{
+		Token:   token,
+		Owner:   owner,
+		Since:   now,
+		Expires: now + int64(ttl),
+	}
+
+	return globalLock.Token, nil
+}
+
+// newLockToken generates a token which can't be guessed
+func newLockToken() (string, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// renewGlobalLock extends the expiry of the global lock held with a token
+func renewGlobalLock(token string, ttl int) error {
+	lmx.Lock()
+	defer lmx.Unlock()
+
+	if globalLock == nil || globalLock.Token != token {
+		return errors.New("global lock lost")
+	}
+	if ttl <= 0 {
+		ttl = defaultLockTTL
+	}
+	globalLock.Expires = time.Now().Unix() + int64(ttl)
+
+	return nil
+}
+
+func releaseGlobalLock(token string) {
+	lmx.Lock()
+	defer lmx.Unlock()
+
+	if globalLock != nil && globalLock.Token == token {
+		globalLock = nil
+	}
+}
+
+type lockRequest struct {
+	TTL int `json:"ttl"`
+}
+
+// GetLock returns the global lock of the server, null when free, and
+// tells if the token given in the lock header holds it
+func GetLock(c *gin.Context) {
+	lmx.Lock()
+	defer lmx.Unlock()
+
+	if globalLock == nil || globalLock.expired() {
+		c.JSON(200, nil)
+		return
+	}
+
+	l := *globalLock
+	l.Held = holdsGlobalLock(c.Request.Header.Get(lockHeader))
+	l.Token = ""
+	c.JSON(200, l)
+}
+
+// holdsGlobalLock tells if a token holds the global lock, lmx is locked
+func holdsGlobalLock(token string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(globalLock.Token)) == 1
+}
+
+// AcquireLock takes the global lock, for a maintenance for example
+func AcquireLock(c *gin.Context) {
+	var req lockRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(400, err.Error())
+			return
+		}
+	}
+
+	token, err := acquireGlobalLock(authUser(c), req.TTL)
+	if err != nil {
+		c.JSON(errorStatus(err), err.Error())
+		return
+	}
+
+	c.JSON(200, gin.H{"token": token})
+}
+
+// ReleaseLock releases the global lock given its token in the lock
+// header, the admin can release it without
+func ReleaseLock(c *gin.Context) {
+	lmx.Lock()
+	defer lmx.Unlock()
+
+	if globalLock == nil {
+		c.JSON(200, true)
+		return
+	}
+	if !holdsGlobalLock(c.Request.Header.Get(lockHeader)) && !isAdmin(c) && !globalLock.expired() {
+		c.JSON(403, "the token of the lock is required, cluster "+globalLock.String())
+		return
+	}
+
+	globalLock = nil
+	c.JSON(200, true)
+}
+
+// ListComposeLocks lists the compose files being deployed on the node
+func ListComposeLocks(c *gin.Context) {
+	lmx.Lock()
+	defer lmx.Unlock()
+
+	c.JSON(200, composeLocks)
+}
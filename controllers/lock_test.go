@@ -0,0 +1,130 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// useServerLock starts a server answering the global lock to the agents,
+// the returned function stops it and releases the lock
+func useServerLock(t *testing.T) func() {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/api/lock", func(c *gin.Context) {
+		if c.Request.URL.RawQuery != "" {
+			t.Errorf("expected the token in the lock header, got the query %s", c.Request.URL.RawQuery)
+		}
+		GetLock(c)
+	})
+	server := httptest.NewServer(router)
+
+	previous := collectorURL
+	collectorURL = server.URL
+
+	return func() {
+		collectorURL = previous
+		server.Close()
+		lmx.Lock()
+		globalLock = nil
+		lmx.Unlock()
+	}
+}
+
+func TestCheckGlobalLockToken(t *testing.T) {
+	defer useServerLock(t)()
+
+	if owner, err := checkGlobalLockToken(""); owner != "" || err != nil {
+		t.Fatalf("expected no lock, got %q %v", owner, err)
+	}
+
+	token, err := acquireGlobalLock("rollout of web.yml by ba", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		token    string
+		owner    string
+		conflict bool
+	}{
+		{token, "rollout of web.yml by ba", false},
+		{"", "", true},
+		{"squid server", "", true},
+		{token + "0", "", true},
+	}
+
+	for _, test := range tests {
+		owner, err := checkGlobalLockToken(test.token)
+		if owner != test.owner {
+			t.Errorf("token %q: expected owner %q, got %q", test.token, test.owner, owner)
+		}
+		if (errorStatus(err) == 409) != test.conflict {
+			t.Errorf("token %q: expected a conflict %v, got %v", test.token, test.conflict, err)
+		}
+	}
+}
+
+func TestReleaseLock(t *testing.T) {
+	defer useServerLock(t)()
+	defer func(admin string) { adminUsername = admin }(adminUsername)
+	adminUsername = "admin"
+
+	release := func(user string, token string) int {
+		c, w, _ := gin.CreateTestContext()
+		c.Request, _ = http.NewRequest("DELETE", "/api/lock", nil)
+		c.Request.Header.Set(lockHeader, token)
+		c.Set(gin.AuthUserKey, user)
+		ReleaseLock(c)
+		return w.Code
+	}
+
+	token, err := acquireGlobalLock("ba", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// All the users share the credentials of the owner
+	if code := release("ba", ""); code != 403 {
+		t.Errorf("expected the release without token to be forbidden, got %d", code)
+	}
+	if code := release("ba", token); code != 200 {
+		t.Errorf("expected the release with the token, got %d", code)
+	}
+
+	if _, err := acquireGlobalLock("ba", 60); err != nil {
+		t.Fatal(err)
+	}
+	if code := release("admin", ""); code != 200 {
+		t.Errorf("expected the admin to release the lock, got %d", code)
+	}
+}
+
+func TestCheckGlobalLockUnreachable(t *testing.T) {
+	defer func(previous string, failOpen bool) { collectorURL, lockFailOpen = previous, failOpen }(collectorURL, lockFailOpen)
+
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	collectorURL = server.URL
+
+	tests := []struct {
+		failOpen bool
+		code     int
+	}{
+		{false, 503},
+		{true, 0},
+	}
+
+	for _, test := range tests {
+		SetLockFailOpen(test.failOpen)
+		owner, err := checkGlobalLockToken("")
+		code := 0
+		if err != nil {
+			code = errorStatus(err)
+		}
+		if owner != "" || code != test.code {
+			t.Errorf("fail open %v: expected %d, got %q %v", test.failOpen, test.code, owner, err)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package controllers
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/context"
+)
+
+const (
+	defaultLogsTail = "100"
+
+	streamStdout = "stdout"
+	streamStderr = "stderr"
+)
+
+type logLine struct {
+	Stream string `json:"stream"`
+	Text   string `json:"text"`
+}
+
+// GetContainerLogs returns the logs of a container given the number of
+// last lines (tail, 100 by default or all), the date or duration to show
+// them since (since), the timestamps and the streams (stdout=false or
+// stderr=false to hide one). With follow=true the logs are streamed as
+// server-sent events named by stream.
+func GetContainerLogs(c *gin.Context) {
+	name := c.Param("name")
+
+	cli, err := getDockerClient()
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	options := types.ContainerLogsOptions{
+		ShowStdout: c.Query("stdout") != "false",
+		ShowStderr: c.Query("stderr") != "false",
+		Since:      c.Query("since"),
+		Timestamps: c.Query("timestamps") == "true",
+		Follow:     c.Query("follow") == "true",
+		Tail:       c.DefaultQuery("tail", defaultLogsTail),
+	}
+	if !options.ShowStdout && !options.ShowStderr {
+		c.JSON(400, "stdout or stderr must be shown")
+		return
+	}
+
+	// Stop reading the logs when the client is gone
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	// The logs of a container with a TTY are not multiplexed
+	container, err := cli.ContainerInspect(ctx, name)
+	if client.IsErrContainerNotFound(err) {
+		c.JSON(404, "container "+name+" not found")
+		return
+	}
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	logs, err := cli.ContainerLogs(ctx, name, options)
+	if err != nil {
+		c.JSON(400, err.Error())
+		return
+	}
+	defer logs.Close()
+
+	lines := make(chan logLine)
+	go func() {
+		defer close(lines)
+		readLogs(logs, container.Config.Tty, lines, ctx.Done())
+	}()
+
+	if !options.Follow {
+		all := []logLine{}
+		for line := range lines {
+			all = append(all, line)
+		}
+		c.JSON(200, all)
+		return
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Stream(func(w io.Writer) bool {
+		line, ok := <-lines
+		if !ok {
+			c.SSEvent("end", container.Name)
+			return false
+		}
+		c.SSEvent(line.Stream, line.Text)
+		return true
+	})
+}
+
+// readLogs splits the logs of a container in lines. The logs of a
+// container without TTY are frames of stdout or stderr prefixed by a
+// header: the stream (1 or 2), 3 zero bytes and the size (big endian).
+// The reading stops when done is closed.
+func readLogs(logs io.Reader, tty bool, lines chan<- logLine, done <-chan struct{}) {
+	send := func(line logLine) bool {
+		select {
+		case lines <- line:
+			return true
+		case <-done:
+			return false
+		}
+	}
+
+	if tty {
+		scanner := bufio.NewScanner(logs)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			if !send(logLine{Stream: streamStdout, Text: strings.TrimSuffix(scanner.Text(), "\r")}) {
+				return
+			}
+		}
+		return
+	}
+
+	// The lines of each stream not ended yet
+	pending := map[string]string{}
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(logs, header); err != nil {
+			break
+		}
+		frame := make([]byte, binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.ReadFull(logs, frame); err != nil {
+			break
+		}
+
+		stream := streamStdout
+		if header[0] == 2 {
+			stream = streamStderr
+		}
+		parts := strings.Split(pending[stream]+string(frame), "\n")
+		for _, text := range parts[:len(parts)-1] {
+			if !send(logLine{Stream: stream, Text: text}) {
+				return
+			}
+		}
+		pending[stream] = parts[len(parts)-1]
+	}
+
+	for _, stream := range []string{streamStdout, streamStderr} {
+		if pending[stream] != "" {
+			send(logLine{Stream: stream, Text: pending[stream]})
+		}
+	}
+}
+
+// NodeContainerLogs returns the logs of a container of a node
+// with the options of GetContainerLogs
+func NodeContainerLogs(c *gin.Context) {
+	proxyAgent(c, c.Param("node"), "/containers/"+url.PathEscape(c.Param("name"))+"/logs")
+}
@@ -0,0 +1,97 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// logFrame builds a frame of the multiplexed logs of a container
+func logFrame(stream byte, text string) []byte {
+	header := make([]byte, 8)
+	header[0] = stream
+	binary.BigEndian.PutUint32(header[4:], uint32(len(text)))
+	return append(header, text...)
+}
+
+func collectLogs(in []byte, tty bool, done chan struct{}) []logLine {
+	lines := make(chan logLine)
+	go func() {
+		defer close(lines)
+		readLogs(bytes.NewReader(in), tty, lines, done)
+	}()
+
+	all := []logLine{}
+	for line := range lines {
+		all = append(all, line)
+	}
+	return all
+}
+
+func TestReadLogs(t *testing.T) {
+	join := func(frames ...[]byte) []byte { return bytes.Join(frames, nil) }
+
+	tests := []struct {
+		in       []byte
+		tty      bool
+		expected []logLine
+	}{
+		{nil, false, []logLine{}},
+		{
+			join(logFrame(1, "started\n"), logFrame(2, "warning\n"), logFrame(1, "ready\n")),
+			false,
+			[]logLine{{streamStdout, "started"}, {streamStderr, "warning"}, {streamStdout, "ready"}},
+		},
+		// A frame with several lines, an empty line
+		{logFrame(1, "a\n\nb\n"), false, []logLine{{streamStdout, "a"}, {streamStdout, ""}, {streamStdout, "b"}}},
+		// A line split across frames interleaved with the other stream
+		{
+			join(logFrame(1, "star"), logFrame(2, "err"), logFrame(1, "ted\nrea"), logFrame(2, "or\n"), logFrame(1, "dy\n")),
+			false,
+			[]logLine{{streamStdout, "started"}, {streamStderr, "error"}, {streamStdout, "ready"}},
+		},
+		// The lines not ended are sent at the end
+		{join(logFrame(2, "fatal"), logFrame(1, "exit")), false, []logLine{{streamStdout, "exit"}, {streamStderr, "fatal"}}},
+		// A truncated frame is dropped
+		{join(logFrame(1, "started\n"), logFrame(1, "ready\n")[:10]), false, []logLine{{streamStdout, "started"}}},
+		{[]byte("started\r\nready\nexit"), true, []logLine{{streamStdout, "started"}, {streamStdout, "ready"}, {streamStdout, "exit"}}},
+		// Not parsed as frames with a TTY
+		{logFrame(1, "x\n")[4:], true, []logLine{{streamStdout, "\x00\x00\x00\x02x"}}},
+	}
+
+	for i, test := range tests {
+		if lines := collectLogs(test.in, test.tty, make(chan struct{})); !reflect.DeepEqual(lines, test.expected) {
+			t.Errorf("%d: expected %q, got %q", i, test.expected, lines)
+		}
+	}
+}
+
+func TestReadLogsDone(t *testing.T) {
+	for _, tty := range []bool{false, true} {
+		in := logFrame(1, "a\nb\nc\n")
+		if tty {
+			in = []byte("a\nb\nc\n")
+		}
+
+		done := make(chan struct{})
+		lines := make(chan logLine)
+		finished := make(chan struct{})
+		go func() {
+			readLogs(bytes.NewReader(in), tty, lines, done)
+			close(finished)
+		}()
+
+		if line := <-lines; line.Text != "a" {
+			t.Errorf("tty %v: expected the first line, got %q", tty, line.Text)
+		}
+		// The client is gone, the other lines are not read
+		close(done)
+		select {
+		case <-finished:
+		case <-time.After(time.Second):
+			t.Fatalf("tty %v: the reading did not stop", tty)
+		}
+	}
+}
@@ -0,0 +1,358 @@
+package controllers
+
+import (
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/types"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/context"
+)
+
+const (
+	statusNotDeclared = "_NotDeclared"
+
+	kindOrphans = "orphans"
+
+	// What is done with an orphan
+	orphanIgnored = "ignored"
+	orphanKept    = "kept"
+	orphanGrace   = "grace"
+	orphanRemove  = "remove"
+
+	composeProjectLabel = "com.docker.compose.project"
+	composeServiceLabel = "com.docker.compose.service"
+	composeLabelsPrefix = "com.docker.compose."
+)
+
+var (
+	// Patterns (path.Match syntax) of the names or images of the orphans to ignore
+	orphanIgnore        = []string{}
+	orphanGraceDuration = time.Duration(1) * time.Hour
+	// Allow to remove the orphans, they are only reported otherwise
+	orphanRemoval = false
+
+	// Date each orphan was first seen, in memory: the grace period
+	// starts again when squid restarts
+	orphansSince = map[string]time.Time{}
+	omx          sync.Mutex
+)
+
+// orphan is a container not declared in a compose file
+type orphan struct {
+	ID      string            `json:"id"`
+	Name    string            `json:"name"`
+	Image   string            `json:"image"`
+	State   string            `json:"state"`
+	Status  string            `json:"status"`
+	Created int64             `json:"created"`
+	Age     int64             `json:"age"`
+	Since   int64             `json:"since"`
+	Project string            `json:"project,omitempty"`
+	Service string            `json:"service,omitempty"`
+	Labels  map[string]string `json:"labels"`
+	// Managed tells if the container belongs to a project of a compose file
+	Managed bool   `json:"managed"`
+	Action  string `json:"action"`
+	Reason  string `json:"reason"`
+}
+
+type orphanReport struct {
+	DryRun  bool       `json:"dryRun"`
+	Removal bool       `json:"removal"`
+	Grace   string     `json:"grace"`
+	Orphans []orphan   `json:"orphans"`
+	Removed *execution `json:"removed,omitempty"`
+}
+
+// SetOrphans sets the patterns of the orphans to ignore, the grace
+// period before removing the orphans of the managed projects and
+// if they can be removed
+func SetOrphans(ignore []string, grace int, remove bool) {
+	orphanIgnore = ignore
+	orphanGraceDuration = time.Duration(grace) * time.Second
+	orphanRemoval = remove
+}
+
+// ListOrphans returns the containers not declared in a compose file with
+// what a cleaning would do with them, nothing is removed
+func ListOrphans(c *gin.Context) {
+	orphans, err := findOrphans()
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	c.JSON(200, orphanReport{DryRun: true, Removal: orphanRemoval, Grace: orphanGraceDuration.String(), Orphans: orphans})
+}
+
+// CleanOrphans removes the orphans of the managed projects after their
+// grace period if the removal is enabled, dry-run=true only reports them
+func CleanOrphans(c *gin.Context) {
+	dryRun := c.Query("dry-run") == "true"
+	if !dryRun && !orphanRemoval {
+		c.JSON(403, "the removal of the orphans is not enabled (-orphan-remove), only dry-run=true is allowed")
+		return
+	}
+
+	// The orphans depend on all the compose files, none is deployed
+	// while they are removed
+	if !dryRun {
+		composeFiles, err := listComposeFiles()
+		if err != nil {
+			handleError(c, err)
+			return
+		}
+		unlock, err := lockDeploy(c, composeFiles)
+		if err != nil {
+			c.JSON(errorStatus(err), err.Error())
+			return
+		}
+		defer unlock()
+	}
+
+	orphans, err := findOrphans()
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	report := orphanReport{DryRun: dryRun, Removal: orphanRemoval, Grace: orphanGraceDuration.String(), Orphans: orphans}
+	if !dryRun {
+		report.Removed = removeOrphans(orphans, authUser(c))
+	}
+
+	c.JSON(200, report)
+}
+
+// RemoveOrphans removes the orphans of the managed projects after their
+// grace period every period seconds
+func RemoveOrphans(period int) {
+	for range time.Tick(time.Duration(period) * time.Second) {
+		if err := removeOrphansLocked(); err != nil {
+			logrus.WithError(err).Error("Fail to remove the orphan containers")
+		}
+	}
+}
+
+// removeOrphansLocked removes the orphans unless a compose file
+// is being deployed, they will be removed at the next period
+func removeOrphansLocked() error {
+	if err := checkGlobalLock(); err != nil {
+		return err
+	}
+	composeFiles, err := listComposeFiles()
+	if err != nil {
+		return err
+	}
+	unlock, err := lockComposes(composeFiles, kindOrphans)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	orphans, err := findOrphans()
+	if err != nil {
+		return err
+	}
+	removeOrphans(orphans, "squid")
+	return nil
+}
+
+// findOrphans lists the containers not declared in a compose file and
+// decides if they are removed: the orphans ignored or not from a project
+// of a compose file are kept, the others are removed after the grace period
+func findOrphans() ([]orphan, error) {
+	containers, err := dockerStatus()
+	if err != nil {
+		return nil, err
+	}
+	composes, err := listComposes()
+	if err != nil {
+		return nil, err
+	}
+
+	return collectOrphans(containers, composes, time.Now()), nil
+}
+
+func collectOrphans(containers []types.Container, composes []RawCompose, now time.Time) []orphan {
+	declared, names := declaredServices(composes)
+
+	// The services of an invalid compose file are not declared anymore,
+	// their containers are kept until it is fixed
+	invalid := map[string]string{}
+	for _, compose := range composes {
+		if compose.Error != "" {
+			invalid[projectName(filepath.Dir(filepath.Join(composesDir, compose.File)))] = compose.File
+		}
+	}
+
+	omx.Lock()
+	defer omx.Unlock()
+
+	orphans := []orphan{}
+	seen := map[string]bool{}
+	for _, container := range containers {
+		name := strings.Replace(container.Names[0], "/", "", -1)
+		if isDeclared(container, name, declared, names) {
+			continue
+		}
+
+		since, ok := orphansSince[container.ID]
+		if !ok {
+			since = now
+			orphansSince[container.ID] = since
+		}
+		seen[container.ID] = true
+
+		o := newOrphan(container, name, now)
+		o.Since = since.Unix()
+		o.Managed = declared[o.Project] != nil
+		o.Action, o.Reason = orphanAction(o, invalid, since, now)
+		orphans = append(orphans, o)
+	}
+
+	// Forget the containers removed or declared again
+	for id := range orphansSince {
+		if !seen[id] {
+			delete(orphansSince, id)
+		}
+	}
+
+	sort.Slice(orphans, func(i, j int) bool {
+		return orphans[i].Name < orphans[j].Name
+	})
+
+	return orphans
+}
+
+// declaredServices lists the services declared by the valid compose files
+// by project, the files of a same directory share their project, and the
+// names of their containers
+func declaredServices(composes []RawCompose) (map[string]map[string]bool, map[string]bool) {
+	declared := map[string]map[string]bool{}
+	names := map[string]bool{}
+	for _, compose := range composes {
+		if compose.Error != "" {
+			continue
+		}
+		if declared[compose.Project] == nil {
+			declared[compose.Project] = map[string]bool{}
+		}
+		for key, service := range compose.Services {
+			declared[compose.Project][key] = true
+			names[serviceContainerName(key, service)] = true
+		}
+	}
+	return declared, names
+}
+
+// isDeclared tells if a container is declared in a compose file: by the
+// project and service labels of docker-compose whatever its image (a tag
+// not deployed yet, an image ID after a pull), by its name without them
+func isDeclared(container types.Container, name string, declared map[string]map[string]bool, names map[string]bool) bool {
+	project, service := container.Labels[composeProjectLabel], container.Labels[composeServiceLabel]
+	if project == "" || service == "" {
+		return names[name]
+	}
+	return declared[project][service]
+}
+
+func newOrphan(container types.Container, name string, now time.Time) orphan {
+	o := orphan{
+		ID:      container.ID,
+		Name:    name,
+		Image:   container.Image,
+		State:   container.State,
+		Status:  container.Status,
+		Created: container.Created,
+		Age:     now.Unix() - container.Created,
+		Project: container.Labels[composeProjectLabel],
+		Service: container.Labels[composeServiceLabel],
+		Labels:  map[string]string{},
+	}
+	// The labels of docker-compose tell where the container comes from
+	for k, v := range container.Labels {
+		if strings.HasPrefix(k, composeLabelsPrefix) {
+			o.Labels[k] = v
+		}
+	}
+	return o
+}
+
+func orphanAction(o orphan, invalid map[string]string, since time.Time, now time.Time) (string, string) {
+	for _, pattern := range orphanIgnore {
+		for _, value := range []string{o.Name, o.Image} {
+			if ok, _ := path.Match(pattern, value); ok {
+				return orphanIgnored, "matches " + pattern
+			}
+		}
+	}
+	if o.Project == "" {
+		return orphanKept, "not created by docker-compose"
+	}
+	if !o.Managed {
+		return orphanKept, "project " + o.Project + " has no compose file"
+	}
+	if file, ok := invalid[o.Project]; ok {
+		return orphanKept, "compose file " + file + " is invalid"
+	}
+	if remaining := orphanGraceDuration - now.Sub(since); remaining > 0 {
+		return orphanGrace, "removable in " + remaining.Round(time.Second).String()
+	}
+	return orphanRemove, "service " + o.Service + " no longer declared in project " + o.Project
+}
+
+// removeOrphans removes the orphans to remove and records it in the
+// history, nil when there is nothing to remove
+func removeOrphans(orphans []orphan, user string) *execution {
+	cli, err := getDockerClient()
+	if err != nil {
+		logrus.WithError(err).Error("Fail to remove the orphan containers")
+		return nil
+	}
+
+	now := time.Now().Unix()
+	results := []*cmdResult{}
+	for _, o := range orphans {
+		if o.Action != orphanRemove {
+			continue
+		}
+
+		result := &cmdResult{
+			Date:      now,
+			Container: o.Name,
+			Status:    resultSuccess,
+			Cmd:       map[string]interface{}{"action": "remove", "container": o.Name},
+			Result:    []string{"remove " + o.Name + ": " + o.Reason},
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), deployTimeout)
+		err := cli.ContainerRemove(ctx, o.ID, types.ContainerRemoveOptions{Force: true})
+		cancel()
+		if err != nil {
+			result.Status = resultFailed
+			result.ExitCode = -1
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	if len(results) == 0 {
+		return nil
+	}
+
+	e := &execution{
+		Kind:    kindOrphans,
+		Date:    now,
+		User:    user,
+		Results: results,
+	}
+	e.Status = executionStatus(results)
+	recordExecution(e)
+
+	return e
+}
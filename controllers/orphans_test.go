@@ -0,0 +1,163 @@
+package controllers
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/engine-api/types"
+	"github.com/gin-gonic/gin"
+)
+
+func composeContainer(id string, name string, image string, project string, service string) types.Container {
+	container := types.Container{ID: id, Names: []string{"/" + name}, Image: image, Labels: map[string]string{}}
+	if project != "" {
+		container.Labels[composeProjectLabel] = project
+		container.Labels[composeServiceLabel] = service
+	}
+	return container
+}
+
+func TestCollectOrphans(t *testing.T) {
+	defer func(grace time.Duration) { orphanGraceDuration = grace }(orphanGraceDuration)
+	orphanGraceDuration = 0
+
+	// Both files are directly in the compose directory: project compose
+	composes := []RawCompose{
+		{File: "web.yml", Project: "compose", Services: RawServices{
+			"web": {"image": "nginx:1.25"},
+		}},
+		{File: "db.yml", Project: "compose", Services: RawServices{
+			"db": {"image": "postgres:16", "container_name": "db"},
+		}},
+		{File: "api/api.yml", Project: "api", Services: RawServices{
+			"api": {"image": "api:2"},
+		}},
+	}
+	containers := []types.Container{
+		// The tag was edited but not deployed yet
+		composeContainer("1", "compose_web_1", "nginx:1.24", "compose", "web"),
+		// docker ps reports an image ID after a pull
+		composeContainer("2", "db", "sha256:4f2a", "compose", "db"),
+		// Removed from its file, shares the project of the other files
+		composeContainer("3", "compose_cache_1", "redis:7", "compose", "cache"),
+		composeContainer("4", "api_api_1", "api:1", "api", "api"),
+		// Not created by docker-compose
+		composeContainer("5", "db", "postgres:16", "", ""),
+		composeContainer("6", "manual", "busybox", "", ""),
+		// Project without compose file
+		composeContainer("7", "other_app_1", "app", "other", "app"),
+	}
+
+	orphans := collectOrphans(containers, composes, time.Now())
+
+	expected := map[string]string{
+		"compose_cache_1": orphanRemove,
+		"manual":          orphanKept,
+		"other_app_1":     orphanKept,
+	}
+	if len(orphans) != len(expected) {
+		t.Fatalf("expected %d orphans, got %+v", len(expected), orphans)
+	}
+	for _, o := range orphans {
+		action, ok := expected[o.Name]
+		if !ok {
+			t.Errorf("%s is declared, not an orphan", o.Name)
+			continue
+		}
+		if o.Action != action {
+			t.Errorf("%s: expected action %s, got %s (%s)", o.Name, action, o.Action, o.Reason)
+		}
+	}
+}
+
+func TestCollectOrphansInvalidFileOfProject(t *testing.T) {
+	defer func(grace time.Duration) { orphanGraceDuration = grace }(orphanGraceDuration)
+	orphanGraceDuration = 0
+
+	composes := []RawCompose{
+		{File: "web.yml", Project: "compose", Services: RawServices{"web": {"image": "nginx"}}},
+		{File: "db.yml", Error: "yaml: line 3: mapping values are not allowed"},
+	}
+	containers := []types.Container{
+		composeContainer("1", "compose_db_1", "postgres", "compose", "db"),
+	}
+
+	orphans := collectOrphans(containers, composes, time.Now())
+	if len(orphans) != 1 || orphans[0].Action != orphanKept {
+		t.Fatalf("expected the orphan to be kept, got %+v", orphans)
+	}
+}
+
+func TestOrphanAction(t *testing.T) {
+	defer func(ignore []string, grace time.Duration) {
+		orphanIgnore, orphanGraceDuration = ignore, grace
+	}(orphanIgnore, orphanGraceDuration)
+	orphanIgnore = []string{"tmp-*", "*/debug:*"}
+	orphanGraceDuration = time.Hour
+
+	now := time.Now()
+	invalid := map[string]string{"broken": "broken/docker-compose.yml"}
+
+	tests := []struct {
+		name   string
+		o      orphan
+		since  time.Time
+		action string
+	}{
+		{"ignored by name", orphan{Name: "tmp-1", Project: "compose", Managed: true}, now.Add(-2 * time.Hour), orphanIgnored},
+		{"ignored by image", orphan{Name: "x", Image: "acme/debug:1", Project: "compose", Managed: true}, now.Add(-2 * time.Hour), orphanIgnored},
+		{"no project", orphan{Name: "x"}, now.Add(-2 * time.Hour), orphanKept},
+		{"project not managed", orphan{Name: "x", Project: "other"}, now.Add(-2 * time.Hour), orphanKept},
+		{"invalid compose file", orphan{Name: "x", Project: "broken", Managed: true}, now.Add(-2 * time.Hour), orphanKept},
+		{"in grace period", orphan{Name: "x", Project: "compose", Managed: true}, now.Add(-time.Minute), orphanGrace},
+		{"after grace period", orphan{Name: "x", Project: "compose", Managed: true}, now.Add(-2 * time.Hour), orphanRemove},
+	}
+
+	for _, test := range tests {
+		action, reason := orphanAction(test.o, invalid, test.since, now)
+		if action != test.action {
+			t.Errorf("%s: expected %s, got %s (%s)", test.name, test.action, action, reason)
+		}
+	}
+}
+
+func TestCleanOrphansRefused(t *testing.T) {
+	dir, cleanup := useComposesDir(t)
+	defer cleanup()
+	defer func(remove bool) { orphanRemoval = remove }(orphanRemoval)
+
+	compose := filepath.Join(dir, "web.yml")
+	if err := writeComposeFile(compose, []byte("services:\n  web:\n    image: nginx\n")); err != nil {
+		t.Fatal(err)
+	}
+	unlock, err := lockComposes([]string{compose}, "ba")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+
+	tests := []struct {
+		remove bool
+		code   int
+	}{
+		{false, 403},
+		// A compose file is being deployed
+		{true, 409},
+	}
+
+	for _, test := range tests {
+		orphanRemoval = test.remove
+		c, w, _ := gin.CreateTestContext()
+		c.Request, _ = http.NewRequest("POST", "/api/orphans/clean", nil)
+		CleanOrphans(c)
+		if w.Code != test.code {
+			t.Errorf("removal %v: expected %d, got %d %s", test.remove, test.code, w.Code, w.Body.String())
+		}
+	}
+
+	if err := removeOrphansLocked(); errorStatus(err) != 409 {
+		t.Errorf("expected the periodic removal to be postponed, got %v", err)
+	}
+}
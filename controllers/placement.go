@@ -0,0 +1,178 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+var (
+	clusterNodes      = map[string]NodeStatus{}
+	clusterNodesDate  time.Time
+	clusterNodesTTL   = time.Duration(30) * time.Second
+	clusterNodesMutex sync.Mutex
+
+	// Key of the squid options in a compose file and in a service
+	squidKey = "x-squid"
+)
+
+const statusNotScheduled = "NotScheduled"
+
+// squidOptions are the x-squid annotations of a compose file or a service,
+// they constrain the nodes it runs on and exempt it from policy rules
+type squidOptions struct {
+	// Hostnames patterns (path.Match syntax) of the allowed nodes
+	Hostnames []string `json:"hostnames"`
+	// Labels the node must have
+	Labels map[string]string `json:"labels"`
+	// Maximum number of nodes, the first eligible nodes by hostname are chosen
+	MaxInstances int `json:"maxInstances"`
+	// Policy rules not applied
+	Exempt []string `json:"exempt"`
+}
+
+// scheduleCompose computes the services of a compose file not scheduled
+// on this node with the reason why
+func scheduleCompose(compose *RawCompose) map[string]string {
+	unscheduled := map[string]string{}
+
+	if reason := compose.Squid.schedule(); reason != "" {
+		for name := range compose.Services {
+			unscheduled[name] = reason
+		}
+		return unscheduled
+	}
+
+	for name, composeService := range compose.Services {
+		rule, err := serviceOptions(composeService)
+		if err != nil {
+			unscheduled[name] = err.Error()
+			continue
+		}
+		if reason := rule.schedule(); reason != "" {
+			unscheduled[name] = reason
+		}
+	}
+
+	return unscheduled
+}
+
+func serviceOptions(composeService map[string]interface{}) (*squidOptions, error) {
+	raw, ok := composeService[squidKey]
+	if !ok {
+		return nil, nil
+	}
+
+	in, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var rule squidOptions
+	if err := json.Unmarshal(in, &rule); err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", squidKey, err)
+	}
+
+	return &rule, nil
+}
+
+// schedule returns why the rule does not place on this node, empty if it does
+func (p *squidOptions) schedule() string {
+	if p == nil {
+		return ""
+	}
+
+	if !p.eligible(hostname, nodeLabels) {
+		return "not placed on " + hostname
+	}
+
+	if p.MaxInstances > 0 {
+		eligibles := []string{}
+		for node, status := range getClusterNodes() {
+			// Ignore the nodes no longer reporting
+			if node != hostname && time.Since(time.Unix(status.Date, 0)) > ttl {
+				continue
+			}
+			if p.eligible(node, status.Labels) {
+				eligibles = append(eligibles, node)
+			}
+		}
+		sort.Strings(eligibles)
+
+		rank := sort.SearchStrings(eligibles, hostname)
+		if rank >= p.MaxInstances {
+			return fmt.Sprintf("max instances %d reached", p.MaxInstances)
+		}
+	}
+
+	return ""
+}
+
+func (p *squidOptions) eligible(node string, labels map[string]string) bool {
+	if len(p.Hostnames) > 0 {
+		allowed := false
+		for _, pattern := range p.Hostnames {
+			if ok, _ := path.Match(pattern, node); ok {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+
+	return matchLabels(labels, p.Labels)
+}
+
+// getClusterNodes gets the nodes known by the server and this node,
+// the server is asked at most every 30s
+func getClusterNodes() map[string]NodeStatus {
+	clusterNodesMutex.Lock()
+	defer clusterNodesMutex.Unlock()
+
+	if collectorURL != "" && time.Since(clusterNodesDate) > clusterNodesTTL {
+		nodes := map[string]NodeStatus{}
+		if err := collectorGet("/nodes/status", &nodes); err != nil {
+			logrus.WithError(err).Warn("Fail to get the nodes of the cluster")
+		} else {
+			clusterNodes = nodes
+		}
+		clusterNodesDate = time.Now()
+	}
+
+	nodes := map[string]NodeStatus{}
+	for node, status := range clusterNodes {
+		nodes[node] = status
+	}
+	nodes[hostname] = NodeStatus{Node: hostname, Labels: nodeLabels}
+
+	return nodes
+}
+
+// scheduledServices lists the services to start of a compose file, sorted
+func scheduledServices(compose *RawCompose, unscheduled map[string]string) []string {
+	services := []string{}
+	for name := range compose.Services {
+		if _, ok := unscheduled[name]; !ok {
+			services = append(services, name)
+		}
+	}
+	sort.Strings(services)
+	return services
+}
+
+// unscheduledReason formats why the services of a compose file are not scheduled
+func unscheduledReason(unscheduled map[string]string) string {
+	reasons := []string{}
+	for name, reason := range unscheduled {
+		reasons = append(reasons, name+": "+reason)
+	}
+	sort.Strings(reasons)
+	return "not scheduled: " + strings.Join(reasons, ", ")
+}
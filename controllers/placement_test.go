@@ -0,0 +1,141 @@
+package controllers
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// useCluster sets the nodes known by the server, this node being node2,
+// the returned function restores the previous ones
+func useCluster(nodes map[string]NodeStatus, labels map[string]string) func() {
+	clusterNodesMutex.Lock()
+	previousNodes, previousDate, previousURL := clusterNodes, clusterNodesDate, collectorURL
+	clusterNodes, clusterNodesDate, collectorURL = nodes, time.Now(), ""
+	clusterNodesMutex.Unlock()
+	previousHostname, previousLabels := hostname, nodeLabels
+	hostname, nodeLabels = "node2", labels
+
+	return func() {
+		hostname, nodeLabels = previousHostname, previousLabels
+		clusterNodesMutex.Lock()
+		clusterNodes, clusterNodesDate, collectorURL = previousNodes, previousDate, previousURL
+		clusterNodesMutex.Unlock()
+	}
+}
+
+func TestEligible(t *testing.T) {
+	tests := []struct {
+		options  squidOptions
+		node     string
+		labels   map[string]string
+		expected bool
+	}{
+		{squidOptions{}, "node1", nil, true},
+		{squidOptions{Hostnames: []string{"node1"}}, "node1", nil, true},
+		{squidOptions{Hostnames: []string{"node1"}}, "node2", nil, false},
+		{squidOptions{Hostnames: []string{"db-*", "node[12]"}}, "node2", nil, true},
+		{squidOptions{Hostnames: []string{"db-*"}}, "db-eu-1", nil, true},
+		{squidOptions{Hostnames: []string{"db-*"}}, "web-1", nil, false},
+		{squidOptions{Labels: map[string]string{"ssd": "true"}}, "node1", map[string]string{"ssd": "true", "zone": "eu"}, true},
+		{squidOptions{Labels: map[string]string{"ssd": "true"}}, "node1", map[string]string{"zone": "eu"}, false},
+		{squidOptions{Hostnames: []string{"node1"}, Labels: map[string]string{"ssd": "true"}}, "node2", map[string]string{"ssd": "true"}, false},
+	}
+
+	for i, test := range tests {
+		if eligible := test.options.eligible(test.node, test.labels); eligible != test.expected {
+			t.Errorf("%d: expected %v, got %v", i, test.expected, eligible)
+		}
+	}
+}
+
+func TestServiceOptions(t *testing.T) {
+	tests := []struct {
+		service  map[string]interface{}
+		expected *squidOptions
+		error    bool
+	}{
+		{map[string]interface{}{"image": "nginx"}, nil, false},
+		{
+			map[string]interface{}{squidKey: map[string]interface{}{"hostnames": []interface{}{"node*"}, "maxInstances": 2}},
+			&squidOptions{Hostnames: []string{"node*"}, MaxInstances: 2}, false,
+		},
+		{
+			map[string]interface{}{squidKey: map[string]interface{}{"labels": map[string]interface{}{"zone": "eu"}, "exempt": []interface{}{"privileged"}}},
+			&squidOptions{Labels: map[string]string{"zone": "eu"}, Exempt: []string{"privileged"}}, false,
+		},
+		{map[string]interface{}{squidKey: map[string]interface{}{"maxInstances": "two"}}, nil, true},
+		{map[string]interface{}{squidKey: "node1"}, nil, true},
+	}
+
+	for i, test := range tests {
+		options, err := serviceOptions(test.service)
+		if (err != nil) != test.error {
+			t.Errorf("%d: expected error %v, got %v", i, test.error, err)
+			continue
+		}
+		if !reflect.DeepEqual(options, test.expected) {
+			t.Errorf("%d: expected %+v, got %+v", i, test.expected, options)
+		}
+	}
+}
+
+func TestScheduleCompose(t *testing.T) {
+	now := time.Now().Unix()
+	defer useCluster(map[string]NodeStatus{
+		"node1": {Node: "node1", Date: now, Labels: map[string]string{"zone": "eu"}},
+		"node3": {Node: "node3", Date: now, Labels: map[string]string{"zone": "us"}},
+		// No longer reporting
+		"node0": {Node: "node0", Date: now - 3600, Labels: map[string]string{"zone": "eu"}},
+	}, map[string]string{"zone": "eu"})()
+
+	tests := []struct {
+		compose  string
+		expected map[string]string
+	}{
+		{"services:\n  web:\n    image: nginx\n", map[string]string{}},
+		{
+			"x-squid:\n  hostnames: [node1]\nservices:\n  web:\n    image: nginx\n  db:\n    image: postgres\n",
+			map[string]string{"web": "not placed on node2", "db": "not placed on node2"},
+		},
+		{"x-squid:\n  labels:\n    zone: eu\nservices:\n  web:\n    image: nginx\n", map[string]string{}},
+		{
+			"services:\n  web:\n    image: nginx\n    x-squid:\n      labels:\n        zone: us\n  db:\n    image: postgres\n",
+			map[string]string{"web": "not placed on node2"},
+		},
+		// node1 comes first among node1 and node2 in zone eu
+		{
+			"services:\n  web:\n    image: nginx\n    x-squid:\n      labels:\n        zone: eu\n      maxInstances: 1\n",
+			map[string]string{"web": "max instances 1 reached"},
+		},
+		{"services:\n  web:\n    image: nginx\n    x-squid:\n      labels:\n        zone: eu\n      maxInstances: 2\n", map[string]string{}},
+		{"services:\n  web:\n    image: nginx\n    x-squid:\n      hostnames: [node2, node3]\n      maxInstances: 1\n", map[string]string{}},
+		{
+			"services:\n  web:\n    image: nginx\n    x-squid:\n      maxInstances: many\n",
+			map[string]string{"web": "invalid x-squid: json: cannot unmarshal string into Go struct field squidOptions.maxInstances of type int"},
+		},
+	}
+
+	for i, test := range tests {
+		compose, err := parseCompose("test.yml", []byte(test.compose))
+		if err != nil {
+			t.Errorf("%d: %s", i, err)
+			continue
+		}
+		if unscheduled := scheduleCompose(compose); !reflect.DeepEqual(unscheduled, test.expected) {
+			t.Errorf("%d: expected %v, got %v", i, test.expected, unscheduled)
+		}
+	}
+}
+
+func TestScheduledServices(t *testing.T) {
+	compose := &RawCompose{Services: RawServices{"web": {}, "db": {}, "es": {}}}
+	unscheduled := map[string]string{"es": "not placed on node2", "db": "max instances 1 reached"}
+
+	if services := scheduledServices(compose, unscheduled); !reflect.DeepEqual(services, []string{"web"}) {
+		t.Errorf("expected web only, got %v", services)
+	}
+	if reason := unscheduledReason(unscheduled); reason != "not scheduled: db: max instances 1 reached, es: not placed on node2" {
+		t.Errorf("unexpected reason %q", reason)
+	}
+}
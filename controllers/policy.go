@@ -0,0 +1,250 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	policyWarn = "warn"
+	policyDeny = "deny"
+
+	ruleNoPrivileged  = "no-privileged"
+	ruleMemoryLimit   = "memory-limit"
+	ruleNoLatest      = "no-latest"
+	ruleNoHostNetwork = "no-host-network"
+	ruleRegistry      = "registry"
+)
+
+var (
+	// Severity of each enabled rule
+	policyRules = map[string]string{}
+	// Registries allowed by the registry rule
+	allowedRegistries = []string{}
+
+	policyChecks = map[string]func(map[string]interface{}) string{
+		ruleNoPrivileged:  checkPrivileged,
+		ruleMemoryLimit:   checkMemoryLimit,
+		ruleNoLatest:      checkLatest,
+		ruleNoHostNetwork: checkHostNetwork,
+		ruleRegistry:      checkRegistry,
+	}
+)
+
+type violation struct {
+	Compose  string `json:"compose"`
+	Service  string `json:"service"`
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+func (v violation) String() string {
+	return v.Service + ": " + v.Message + " (" + v.Rule + ")"
+}
+
+type complianceReport struct {
+	Compliant  bool        `json:"compliant"`
+	Violations []violation `json:"violations"`
+}
+
+// SetPolicy enables policy rules given their severity (warn or deny)
+// and the registries the images must come from
+func SetPolicy(rules map[string]string, registries []string) error {
+	for rule, severity := range rules {
+		if _, ok := policyChecks[rule]; !ok {
+			return errors.New("unknown policy rule " + rule)
+		}
+		if severity != policyWarn && severity != policyDeny {
+			return fmt.Errorf("invalid severity %s for %s: warn or deny", severity, rule)
+		}
+	}
+	if _, ok := rules[ruleRegistry]; ok && len(registries) == 0 {
+		return errors.New("the registry rule requires allowed registries")
+	}
+
+	policyRules = rules
+	allowedRegistries = registries
+	return nil
+}
+
+// GetPolicy returns the rules enabled on the node and their violations
+// by the compose files
+func GetPolicy(c *gin.Context) {
+	report, err := nodeCompliance()
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"rules":      policyRules,
+		"registries": allowedRegistries,
+		"report":     report,
+	})
+}
+
+// ClusterCompliance returns the compliance report of each node
+func ClusterCompliance(c *gin.Context) {
+	m.RLock()
+	defer m.RUnlock()
+
+	reports := map[string]*complianceReport{}
+	for node, status := range statuses {
+		reports[node] = status.Compliance
+	}
+
+	c.JSON(200, reports)
+}
+
+// nodeCompliance evaluates the policy against all the compose files
+func nodeCompliance() (*complianceReport, error) {
+	composes, err := listComposes()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &complianceReport{Compliant: true, Violations: []violation{}}
+	for i := range composes {
+		if composes[i].Error != "" {
+			continue
+		}
+		for _, v := range evaluatePolicy(&composes[i]) {
+			if v.Severity == policyDeny {
+				report.Compliant = false
+			}
+			report.Violations = append(report.Violations, v)
+		}
+	}
+
+	return report, nil
+}
+
+// evaluatePolicy checks the services of a compose file against the enabled
+// rules, except the rules the compose file or the service is exempt from
+func evaluatePolicy(compose *RawCompose) []violation {
+	violations := []violation{}
+
+	rules := []string{}
+	for rule := range policyRules {
+		if compose.Squid == nil || !isIn(rule, compose.Squid.Exempt) {
+			rules = append(rules, rule)
+		}
+	}
+	sort.Strings(rules)
+
+	for _, name := range sortedServices(compose) {
+		composeService := compose.Services[name]
+
+		exempt := []string{}
+		if options, err := serviceOptions(composeService); err == nil && options != nil {
+			exempt = options.Exempt
+		}
+
+		for _, rule := range rules {
+			if isIn(rule, exempt) {
+				continue
+			}
+			if message := policyChecks[rule](composeService); message != "" {
+				violations = append(violations, violation{
+					Compose:  compose.File,
+					Service:  name,
+					Rule:     rule,
+					Severity: policyRules[rule],
+					Message:  message,
+				})
+			}
+		}
+	}
+
+	return violations
+}
+
+// deniedBy formats the violations denying a deployment, empty if none
+func deniedBy(violations []violation) string {
+	denied := []string{}
+	for _, v := range violations {
+		if v.Severity == policyDeny {
+			denied = append(denied, v.String())
+		}
+	}
+	if len(denied) == 0 {
+		return ""
+	}
+	return "denied by policy: " + strings.Join(denied, ", ")
+}
+
+func checkPrivileged(composeService map[string]interface{}) string {
+	if privileged, _ := composeService["privileged"].(bool); privileged {
+		return "privileged container"
+	}
+	return ""
+}
+
+func checkMemoryLimit(composeService map[string]interface{}) string {
+	if _, ok := composeService["mem_limit"]; ok {
+		return ""
+	}
+	// v3: deploy.resources.limits.memory
+	deploy, _ := composeService["deploy"].(map[string]interface{})
+	resources, _ := deploy["resources"].(map[string]interface{})
+	limits, _ := resources["limits"].(map[string]interface{})
+	if _, ok := limits["memory"]; ok {
+		return ""
+	}
+	return "no memory limit"
+}
+
+func checkLatest(composeService map[string]interface{}) string {
+	image, ok := composeService["image"].(string)
+	if !ok || strings.Contains(image, "@") {
+		return ""
+	}
+	if tag := imageTag(image); tag == "" || tag == "latest" {
+		return "image " + image + " uses the latest tag"
+	}
+	return ""
+}
+
+func checkHostNetwork(composeService map[string]interface{}) string {
+	for _, key := range []string{"network_mode", "net"} {
+		if mode, _ := composeService[key].(string); mode == "host" {
+			return "host network"
+		}
+	}
+	return ""
+}
+
+func checkRegistry(composeService map[string]interface{}) string {
+	image, ok := composeService["image"].(string)
+	if !ok {
+		return ""
+	}
+	registry := imageRegistry(image)
+	if !isIn(registry, allowedRegistries) {
+		return "image " + image + " is not from an allowed registry"
+	}
+	return ""
+}
+
+// imageTag is the tag of an image, empty if not tagged
+func imageTag(image string) string {
+	name := image[strings.LastIndex(image, "/")+1:]
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		return name[i+1:]
+	}
+	return ""
+}
+
+// imageRegistry is the registry of an image, docker.io by default
+func imageRegistry(image string) string {
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return parts[0]
+	}
+	return "docker.io"
+}
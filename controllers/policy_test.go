@@ -0,0 +1,106 @@
+package controllers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPolicyChecks(t *testing.T) {
+	defer func(registries []string) { allowedRegistries = registries }(allowedRegistries)
+	allowedRegistries = []string{"docker.io", "registry.example.com:5000"}
+
+	tests := []struct {
+		rule     string
+		service  map[string]interface{}
+		violated bool
+	}{
+		{ruleNoPrivileged, map[string]interface{}{"privileged": true}, true},
+		{ruleNoPrivileged, map[string]interface{}{"privileged": false}, false},
+		{ruleNoPrivileged, map[string]interface{}{}, false},
+		{ruleMemoryLimit, map[string]interface{}{}, true},
+		{ruleMemoryLimit, map[string]interface{}{"mem_limit": "512m"}, false},
+		{ruleMemoryLimit, map[string]interface{}{"deploy": map[string]interface{}{
+			"resources": map[string]interface{}{"limits": map[string]interface{}{"memory": "512M"}},
+		}}, false},
+		{ruleMemoryLimit, map[string]interface{}{"deploy": map[string]interface{}{"replicas": 2}}, true},
+		{ruleNoLatest, map[string]interface{}{"image": "nginx"}, true},
+		{ruleNoLatest, map[string]interface{}{"image": "nginx:latest"}, true},
+		{ruleNoLatest, map[string]interface{}{"image": "registry.example.com:5000/nginx"}, true},
+		{ruleNoLatest, map[string]interface{}{"image": "registry.example.com:5000/nginx:1.13"}, false},
+		{ruleNoLatest, map[string]interface{}{"image": "nginx@sha256:abc"}, false},
+		{ruleNoLatest, map[string]interface{}{"build": "."}, false},
+		{ruleNoHostNetwork, map[string]interface{}{"network_mode": "host"}, true},
+		{ruleNoHostNetwork, map[string]interface{}{"net": "host"}, true},
+		{ruleNoHostNetwork, map[string]interface{}{"network_mode": "bridge"}, false},
+		{ruleRegistry, map[string]interface{}{"image": "nginx:1.13"}, false},
+		{ruleRegistry, map[string]interface{}{"image": "thbkrkr/squid:1.0"}, false},
+		{ruleRegistry, map[string]interface{}{"image": "registry.example.com:5000/nginx:1.13"}, false},
+		{ruleRegistry, map[string]interface{}{"image": "quay.io/coreos/etcd:3.2"}, true},
+		{ruleRegistry, map[string]interface{}{"image": "localhost/nginx:1.13"}, true},
+	}
+
+	for _, test := range tests {
+		message := policyChecks[test.rule](test.service)
+		if (message != "") != test.violated {
+			t.Errorf("%s %v: expected a violation %v, got %q", test.rule, test.service, test.violated, message)
+		}
+	}
+}
+
+func TestEvaluatePolicy(t *testing.T) {
+	defer func(rules map[string]string, registries []string) {
+		policyRules, allowedRegistries = rules, registries
+	}(policyRules, allowedRegistries)
+
+	if err := SetPolicy(map[string]string{ruleNoPrivileged: policyDeny, ruleNoLatest: policyWarn}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	compose := &RawCompose{File: "web.yml", Services: RawServices{
+		"web":   {"image": "nginx", "privileged": true},
+		"proxy": {"image": "traefik", "privileged": true, squidKey: map[string]interface{}{"exempt": []interface{}{ruleNoPrivileged}}},
+	}}
+
+	violations := evaluatePolicy(compose)
+	expected := []violation{
+		{Compose: "web.yml", Service: "proxy", Rule: ruleNoLatest, Severity: policyWarn, Message: "image traefik uses the latest tag"},
+		{Compose: "web.yml", Service: "web", Rule: ruleNoLatest, Severity: policyWarn, Message: "image nginx uses the latest tag"},
+		{Compose: "web.yml", Service: "web", Rule: ruleNoPrivileged, Severity: policyDeny, Message: "privileged container"},
+	}
+	if !reflect.DeepEqual(violations, expected) {
+		t.Errorf("expected %v, got %v", expected, violations)
+	}
+	if denied := deniedBy(violations); denied != "denied by policy: web: privileged container (no-privileged)" {
+		t.Errorf("unexpected denial %q", denied)
+	}
+
+	// The whole compose file is exempt
+	compose.Squid = &squidOptions{Exempt: []string{ruleNoPrivileged, ruleNoLatest}}
+	if violations := evaluatePolicy(compose); len(violations) != 0 {
+		t.Errorf("expected no violation, got %v", violations)
+	}
+}
+
+func TestSetPolicy(t *testing.T) {
+	defer func(rules map[string]string, registries []string) {
+		policyRules, allowedRegistries = rules, registries
+	}(policyRules, allowedRegistries)
+
+	tests := []struct {
+		rules      map[string]string
+		registries []string
+		valid      bool
+	}{
+		{map[string]string{ruleNoLatest: policyWarn, ruleMemoryLimit: policyDeny}, nil, true},
+		{map[string]string{"no-root": policyWarn}, nil, false},
+		{map[string]string{ruleNoLatest: "error"}, nil, false},
+		{map[string]string{ruleRegistry: policyDeny}, nil, false},
+		{map[string]string{ruleRegistry: policyDeny}, []string{"docker.io"}, true},
+	}
+
+	for _, test := range tests {
+		if err := SetPolicy(test.rules, test.registries); (err == nil) != test.valid {
+			t.Errorf("%v %v: expected valid %v, got %v", test.rules, test.registries, test.valid, err)
+		}
+	}
+}
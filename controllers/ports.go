@@ -0,0 +1,371 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/engine-api/types"
+	"github.com/gin-gonic/gin"
+)
+
+// Maximum number of ports of a range published by a service
+var maxPortRange = 1000
+
+// hostPort is a port of the host published by a service
+type hostPort struct {
+	IP       string `json:"ip,omitempty"`
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+}
+
+func (p hostPort) String() string {
+	s := strconv.Itoa(p.Port) + "/" + p.Protocol
+	if p.IP != "" {
+		s = p.IP + ":" + s
+	}
+	return s
+}
+
+// portBinding is a host port declared by a service of a compose file
+// or published by a container
+type portBinding struct {
+	hostPort
+	Compose   string `json:"compose,omitempty"`
+	Service   string `json:"service,omitempty"`
+	Container string `json:"container,omitempty"`
+	Conflict  bool   `json:"conflict,omitempty"`
+}
+
+// owner identifies the service or the container binding a port, the
+// container of a declared service is owned by the service
+func (b portBinding) owner() string {
+	if b.Compose != "" {
+		return b.Compose + "/" + b.Service
+	}
+	return "container " + b.Container
+}
+
+// GetPorts lists the host ports of the node declared in the compose
+// files and published by the containers with the conflicts flagged
+func GetPorts(c *gin.Context) {
+	bindings, err := nodePorts()
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	c.JSON(200, bindings)
+}
+
+// ClusterPorts lists the host ports reported by each node
+func ClusterPorts(c *gin.Context) {
+	m.RLock()
+	defer m.RUnlock()
+
+	ports := map[string][]portBinding{}
+	for node, status := range statuses {
+		ports[node] = status.Ports
+	}
+
+	c.JSON(200, ports)
+}
+
+func nodePorts() ([]portBinding, error) {
+	containers, err := dockerStatus()
+	if err != nil {
+		return nil, err
+	}
+
+	composes, err := listComposes()
+	if err != nil {
+		return nil, err
+	}
+
+	bindings := portBindings(composes, containers)
+	for i := range bindings {
+		for j := range bindings {
+			if bindings[i].owner() != bindings[j].owner() && bindings[i].conflicts(bindings[j].hostPort) {
+				bindings[i].Conflict = true
+			}
+		}
+	}
+
+	return bindings, nil
+}
+
+// portBindings lists the host ports declared by the services scheduled on
+// the node and published by the running containers
+func portBindings(composes []RawCompose, containers []types.Container) []portBinding {
+	bindings := []portBinding{}
+
+	for i := range composes {
+		compose := &composes[i]
+		if compose.Error != "" {
+			continue
+		}
+		for _, name := range sortedServices(compose) {
+			if _, ok := compose.Unscheduled[name]; ok {
+				continue
+			}
+			// Invalid ports are reported by the linter
+			ports, _ := serviceHostPorts(compose.Services[name])
+			for _, port := range ports {
+				bindings = append(bindings, portBinding{hostPort: port, Compose: compose.File, Service: name})
+			}
+		}
+	}
+
+	for _, container := range containers {
+		if container.State != "running" {
+			continue
+		}
+		containerName := strings.Replace(container.Names[0], "/", "", -1)
+		composeFile, service := declaringService(composes, containerName, container.Image)
+
+		for _, p := range container.Ports {
+			if p.PublicPort == 0 {
+				continue
+			}
+			ip := p.IP
+			if ip == "0.0.0.0" || ip == "::" {
+				ip = ""
+			}
+			bindings = append(bindings, portBinding{
+				hostPort:  hostPort{IP: ip, Port: p.PublicPort, Protocol: p.Type},
+				Compose:   composeFile,
+				Service:   service,
+				Container: containerName,
+			})
+		}
+	}
+
+	return bindings
+}
+
+// declaringService finds the compose file and the service of a container
+func declaringService(composes []RawCompose, containerName string, containerImage string) (string, string) {
+	for i := range composes {
+		compose := &composes[i]
+		for name, composeService := range compose.Services {
+			if matchContainer(containerName, containerImage, serviceContainerName(name, composeService), serviceImage(compose, name, composeService)) {
+				return compose.File, name
+			}
+		}
+	}
+	return "", ""
+}
+
+// portConflicts lists the host ports declared by compose files to deploy
+// already bound by the services of the other compose files or by the
+// containers not belonging to the deployed compose files
+func portConflicts(deploying map[string]*RawCompose) ([]string, error) {
+	containers, err := dockerStatus()
+	if err != nil {
+		return nil, err
+	}
+
+	composes, err := listComposes()
+	if err != nil {
+		return nil, err
+	}
+
+	return collectPortConflicts(deploying, composes, containers), nil
+}
+
+// collectPortConflicts lists the port conflicts of the compose files to
+// deploy given the compose files of the node and its containers
+func collectPortConflicts(deploying map[string]*RawCompose, composes []RawCompose, containers []types.Container) []string {
+	// Replace the deployed compose files by their new definition
+	merged := []RawCompose{}
+	for _, compose := range composes {
+		if _, ok := deploying[compose.File]; !ok {
+			merged = append(merged, compose)
+		}
+	}
+	for file, compose := range deploying {
+		c := *compose
+		c.File = file
+		c.Unscheduled = scheduleCompose(&c)
+		merged = append(merged, c)
+	}
+
+	bindings := portBindings(merged, containers)
+
+	conflicts := map[string]bool{}
+	for _, b := range bindings {
+		if _, ok := deploying[b.Compose]; !ok || b.Container != "" {
+			continue
+		}
+		for _, other := range bindings {
+			// The containers of the deployed compose files are recreated
+			if _, ok := deploying[other.Compose]; ok && (other.Container != "" || other.owner() == b.owner()) {
+				continue
+			}
+			if other.owner() != b.owner() && b.conflicts(other.hostPort) {
+				conflicts[fmt.Sprintf("%s: host port %s already bound by %s", b.owner(), b.hostPort, other.owner())] = true
+			}
+		}
+	}
+
+	messages := []string{}
+	for message := range conflicts {
+		messages = append(messages, message)
+	}
+	sort.Strings(messages)
+
+	return messages
+}
+
+// checkPortConflicts refuses to deploy compose files binding host ports
+// already bound, definitions are the compose files not written yet
+func checkPortConflicts(composeFiles []string, definitions map[string][]byte) error {
+	deploying := map[string]*RawCompose{}
+	for _, path := range composeFiles {
+		var compose *RawCompose
+		var err error
+		if definition, ok := definitions[path]; ok {
+			compose, err = parseCompose(path, definition)
+		} else {
+			compose, err = loadCompose(path)
+		}
+		// A compose file that can't be loaded is skipped by the deployment
+		if err != nil {
+			continue
+		}
+		deploying[composeName(path)] = compose
+	}
+
+	conflicts, err := portConflicts(deploying)
+	if err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		return conflictError("port conflicts (use force to deploy anyway): " + strings.Join(conflicts, ", "))
+	}
+
+	return nil
+}
+
+// conflicts tells if two published ports can't be bound at the same time
+func (p hostPort) conflicts(other hostPort) bool {
+	if p.Port != other.Port || p.Protocol != other.Protocol {
+		return false
+	}
+	return p.IP == "" || other.IP == "" || p.IP == other.IP
+}
+
+// serviceHostPorts lists the ports of the host published by a service,
+// the ports without host port are published on a random port and ignored
+func serviceHostPorts(composeService map[string]interface{}) ([]hostPort, error) {
+	ports := []hostPort{}
+
+	for _, entry := range toSequence(composeService["ports"]) {
+		var published []hostPort
+		var err error
+
+		if m, ok := entry.(map[string]interface{}); ok {
+			published, err = parseLongPort(m)
+		} else {
+			published, err = parsePort(fmt.Sprint(entry))
+		}
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, published...)
+	}
+
+	return ports, nil
+}
+
+// parsePort parses [[ip:]host_port:]container_port[/protocol]
+// where the ports can be ranges
+func parsePort(spec string) ([]hostPort, error) {
+	protocol := "tcp"
+	if i := strings.LastIndex(spec, "/"); i >= 0 {
+		protocol = spec[i+1:]
+		spec = spec[:i]
+	}
+
+	ip, host := "", ""
+	parts := strings.Split(spec, ":")
+	switch len(parts) {
+	case 1:
+		return []hostPort{}, nil
+	case 2:
+		host = parts[0]
+	default:
+		// The IP can be IPv6 and contain colons
+		ip = strings.Trim(strings.Join(parts[:len(parts)-2], ":"), "[]")
+		host = parts[len(parts)-2]
+	}
+	if host == "" {
+		return []hostPort{}, nil
+	}
+	if ip == "0.0.0.0" {
+		ip = ""
+	}
+
+	first, last, err := parsePortRange(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %s: %s", spec, err)
+	}
+
+	ports := []hostPort{}
+	for port := first; port <= last; port++ {
+		ports = append(ports, hostPort{IP: ip, Port: port, Protocol: protocol})
+	}
+	return ports, nil
+}
+
+// parseLongPort parses a port declared with the long syntax
+func parseLongPort(m map[string]interface{}) ([]hostPort, error) {
+	published, ok := m["published"]
+	if !ok || published == nil {
+		return []hostPort{}, nil
+	}
+
+	protocol := "tcp"
+	if p, ok := m["protocol"].(string); ok && p != "" {
+		protocol = p
+	}
+	ip, _ := m["host_ip"].(string)
+	if ip == "0.0.0.0" {
+		ip = ""
+	}
+
+	first, last, err := parsePortRange(fmt.Sprint(published))
+	if err != nil {
+		return nil, fmt.Errorf("invalid published port %v: %s", published, err)
+	}
+
+	ports := []hostPort{}
+	for port := first; port <= last; port++ {
+		ports = append(ports, hostPort{IP: ip, Port: port, Protocol: protocol})
+	}
+	return ports, nil
+}
+
+func parsePortRange(s string) (int, int, error) {
+	bounds := strings.SplitN(s, "-", 2)
+	first, err := strconv.Atoi(bounds[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	last := first
+	if len(bounds) == 2 {
+		if last, err = strconv.Atoi(bounds[1]); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if first < 1 || last > 65535 || last < first {
+		return 0, 0, errors.New("out of range")
+	}
+	if last-first >= maxPortRange {
+		return 0, 0, fmt.Errorf("range larger than %d ports", maxPortRange)
+	}
+	return first, last, nil
+}
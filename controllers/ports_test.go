@@ -0,0 +1,91 @@
+package controllers
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/docker/engine-api/types"
+)
+
+func TestParsePort(t *testing.T) {
+	tests := []struct {
+		spec     string
+		expected []hostPort
+		err      bool
+	}{
+		{"80", []hostPort{}, false},
+		{":80", []hostPort{}, false},
+		{"8080:80", []hostPort{{Port: 8080, Protocol: "tcp"}}, false},
+		{"53:53/udp", []hostPort{{Port: 53, Protocol: "udp"}}, false},
+		{"127.0.0.1:8080:80", []hostPort{{IP: "127.0.0.1", Port: 8080, Protocol: "tcp"}}, false},
+		{"0.0.0.0:8080:80", []hostPort{{Port: 8080, Protocol: "tcp"}}, false},
+		{"[::1]:8080:80", []hostPort{{IP: "::1", Port: 8080, Protocol: "tcp"}}, false},
+		{"127.0.0.1::80", []hostPort{}, false},
+		{"9000-9001:9000-9001", []hostPort{{Port: 9000, Protocol: "tcp"}, {Port: 9001, Protocol: "tcp"}}, false},
+		{"http:80", nil, true},
+		{"70000:80", nil, true},
+		{"9001-9000:80", nil, true},
+		{"1-2000:80", nil, true},
+	}
+
+	for _, test := range tests {
+		ports, err := parsePort(test.spec)
+		if (err != nil) != test.err {
+			t.Errorf("%s: expected an error %v, got %v", test.spec, test.err, err)
+			continue
+		}
+		if !reflect.DeepEqual(ports, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.spec, test.expected, ports)
+		}
+	}
+}
+
+func TestCollectPortConflicts(t *testing.T) {
+	service := func(image string, ports ...interface{}) map[string]interface{} {
+		return map[string]interface{}{"image": image, "ports": ports}
+	}
+	composes := []RawCompose{
+		{File: "web.yml", Services: RawServices{"web": service("nginx", "80:80")}},
+		{File: "db.yml", Services: RawServices{"db": service("postgres", "127.0.0.1:5432:5432")}},
+	}
+	containers := []types.Container{
+		{Names: []string{"/squid_web_1"}, Image: "nginx", State: "running", Ports: []types.Port{{PublicPort: 80, PrivatePort: 80, Type: "tcp"}}},
+		{Names: []string{"/manual"}, Image: "redis", State: "running", Ports: []types.Port{{IP: "0.0.0.0", PublicPort: 6379, PrivatePort: 6379, Type: "tcp"}}},
+		{Names: []string{"/stopped"}, Image: "redis", State: "exited", Ports: []types.Port{{PublicPort: 7000, PrivatePort: 7000, Type: "tcp"}}},
+	}
+
+	tests := []struct {
+		name      string
+		deploying map[string]*RawCompose
+		expected  []string
+	}{
+		{"redeployed with its ports", map[string]*RawCompose{
+			"web.yml": {Services: RawServices{"web": service("nginx", "80:80")}},
+		}, []string{}},
+		{"port of another compose file", map[string]*RawCompose{
+			"api.yml": {Services: RawServices{"api": service("api", "5432:5432")}},
+		}, []string{"api.yml/api: host port 5432/tcp already bound by db.yml/db"}},
+		{"other IP", map[string]*RawCompose{
+			"api.yml": {Services: RawServices{"api": service("api", "10.0.0.1:5432:5432")}},
+		}, []string{}},
+		{"other protocol", map[string]*RawCompose{
+			"dns.yml": {Services: RawServices{"dns": service("dns", "80:80/udp")}},
+		}, []string{}},
+		{"port of a container", map[string]*RawCompose{
+			"cache.yml": {Services: RawServices{"cache": service("redis", "6379:6379")}},
+		}, []string{"cache.yml/cache: host port 6379/tcp already bound by container manual"}},
+		{"port of a stopped container", map[string]*RawCompose{
+			"cache.yml": {Services: RawServices{"cache": service("redis", "7000:7000")}},
+		}, []string{}},
+		{"port moved between deployed compose files", map[string]*RawCompose{
+			"web.yml": {Services: RawServices{"web": service("nginx", "8080:80")}},
+			"api.yml": {Services: RawServices{"api": service("api", "80:80")}},
+		}, []string{}},
+	}
+
+	for _, test := range tests {
+		if conflicts := collectPortConflicts(test.deploying, composes, containers); !reflect.DeepEqual(conflicts, test.expected) {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, conflicts)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package controllers
+
+import (
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const kindReconcile = "reconcile"
+
+// Reconcile scans the compose directory every period seconds and deploys
+// the compose files whose content differs from their last deployment
+// once no change has been seen during debounce seconds
+func Reconcile(period int, debounce int) {
+	ticker := time.NewTicker(time.Duration(period) * time.Second)
+	quiet := time.Duration(debounce) * time.Second
+
+	// The content found at startup is considered as deployed
+	// for the compose files never deployed
+	baseline, err := hashComposeFiles()
+	if err != nil {
+		logrus.WithError(err).Error("Fail to scan the compose files")
+		baseline = map[string]string{}
+	}
+
+	observed := baseline
+	lastChange := time.Now()
+
+	for range ticker.C {
+		current, err := hashComposeFiles()
+		if err != nil {
+			logrus.WithError(err).Error("Fail to scan the compose files")
+			continue
+		}
+
+		// Wait for a burst of changes to end
+		if !sameHashes(current, observed) {
+			observed = current
+			lastChange = time.Now()
+			continue
+		}
+		if time.Since(lastChange) < quiet {
+			continue
+		}
+
+		changed := reconcileChanges(current, baseline)
+		if len(changed) == 0 {
+			continue
+		}
+
+		reconcile(changed)
+	}
+}
+
+// reconcileChanges lists the compose files whose content differs from
+// their last deployment, or from the baseline if never deployed
+func reconcileChanges(current map[string]string, baseline map[string]string) []string {
+	changed := []string{}
+	for compose, hash := range current {
+		expected, ok := lastDeployedHash(compose)
+		if !ok {
+			expected = baseline[compose]
+		}
+		if hash != expected {
+			changed = append(changed, compose)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// reconcile deploys the changed compose files unless they are locked,
+// they will be retried at the next scan
+func reconcile(composeFiles []string) {
+	if err := checkGlobalLock(); err != nil {
+		logrus.WithError(err).Warn("Postpone the reconciliation")
+		return
+	}
+
+	unlock, err := lockComposes(composeFiles, kindReconcile)
+	if err != nil {
+		logrus.WithError(err).Warn("Postpone the reconciliation")
+		return
+	}
+	defer unlock()
+
+	logrus.WithField("composes", composeFiles).Info("Reconcile changed compose files")
+
+	e := deploy(kindReconcile, composeFiles)
+	e.User = kindReconcile
+	e.Commit = deployedCommit()
+	rollbacks := rollbackUnhealthy(e)
+	recordExecution(e)
+	for _, rb := range rollbacks {
+		recordExecution(rb)
+	}
+}
+
+// hashComposeFiles hashes the content of each compose file with its overlay
+func hashComposeFiles() (map[string]string, error) {
+	composeFiles, err := listComposeFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := map[string]string{}
+	for _, compose := range composeFiles {
+		in, overlay, overlayIn, err := readComposeLayers(compose)
+		if err != nil {
+			return nil, err
+		}
+		hashes[compose] = layersHash(in, overlay, overlayIn)
+	}
+
+	return hashes, nil
+}
+
+func sameHashes(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// lastDeployedHash finds the hash of the last deployment of a compose file
+func lastDeployedHash(compose string) (string, bool) {
+	_, result := lastDeployment(compose)
+	if result == nil {
+		return "", false
+	}
+	return result.Hash, true
+}
+
+// lastDeployment finds the last execution deploying a compose file on the node
+func lastDeployment(compose string) (*execution, *cmdResult) {
+	mx.RLock()
+	defer mx.RUnlock()
+
+	for i := len(historyResults) - 1; i >= 0; i-- {
+		// The executions of the server concern other nodes
+		if historyResults[i].Node != hostname {
+			continue
+		}
+		for _, result := range historyResults[i].Results {
+			if result.Compose == compose && result.Hash != "" {
+				return historyResults[i], result
+			}
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,98 @@
+package controllers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSameHashes(t *testing.T) {
+	tests := []struct {
+		a        map[string]string
+		b        map[string]string
+		expected bool
+	}{
+		{map[string]string{}, map[string]string{}, true},
+		{map[string]string{"web.yml": "1"}, map[string]string{"web.yml": "1"}, true},
+		{map[string]string{"web.yml": "1"}, map[string]string{"web.yml": "2"}, false},
+		{map[string]string{"web.yml": "1"}, map[string]string{"db.yml": "1"}, false},
+		{map[string]string{"web.yml": "1"}, map[string]string{"web.yml": "1", "db.yml": "1"}, false},
+		// A removed compose file
+		{map[string]string{"web.yml": "1", "db.yml": ""}, map[string]string{"web.yml": "1"}, false},
+	}
+
+	for i, test := range tests {
+		if same := sameHashes(test.a, test.b); same != test.expected {
+			t.Errorf("%d: expected %v, got %v", i, test.expected, same)
+		}
+	}
+}
+
+func TestLastDeployedHash(t *testing.T) {
+	defer useHistory(
+		deployed("1", hostname, "compose/web.yml", resultSuccess, "v1"),
+		deployed("2", hostname, "compose/db.yml", resultSuccess, "db"),
+		deployed("3", hostname, "compose/web.yml", resultFailed, "v2"),
+		deployed("4", "node2", "compose/web.yml", resultSuccess, "v3"),
+		deployed("5", "node2", "compose/es.yml", resultSuccess, "es"),
+	)()
+
+	tests := []struct {
+		compose  string
+		expected string
+		found    bool
+	}{
+		// The last deployment, even failed, is not retried
+		{"compose/web.yml", contentHash([]byte("v2")), true},
+		{"compose/db.yml", contentHash([]byte("db")), true},
+		// Deployed on another node only
+		{"compose/es.yml", "", false},
+		{"compose/kibana.yml", "", false},
+	}
+
+	for _, test := range tests {
+		hash, found := lastDeployedHash(test.compose)
+		if hash != test.expected || found != test.found {
+			t.Errorf("%s: expected %q %v, got %q %v", test.compose, test.expected, test.found, hash, found)
+		}
+	}
+}
+
+func TestReconcileChanges(t *testing.T) {
+	defer useHistory(
+		deployed("1", hostname, "compose/web.yml", resultSuccess, "v1"),
+		deployed("2", hostname, "compose/web.yml", resultSuccess, "v2"),
+		deployed("3", "node2", "compose/db.yml", resultSuccess, "db2"),
+	)()
+
+	hash := func(content string) string { return contentHash([]byte(content)) }
+	baseline := map[string]string{
+		"compose/web.yml": hash("v0"),
+		"compose/db.yml":  hash("db1"),
+	}
+
+	tests := []struct {
+		current  map[string]string
+		expected []string
+	}{
+		{map[string]string{}, []string{}},
+		// Compared to the last deployment rather than the baseline
+		{map[string]string{"compose/web.yml": hash("v2")}, []string{}},
+		{map[string]string{"compose/web.yml": hash("v0")}, []string{"compose/web.yml"}},
+		{map[string]string{"compose/web.yml": hash("v1")}, []string{"compose/web.yml"}},
+		// Never deployed on this node, compared to the baseline
+		{map[string]string{"compose/db.yml": hash("db1")}, []string{}},
+		{map[string]string{"compose/db.yml": hash("db2")}, []string{"compose/db.yml"}},
+		// Added after startup
+		{map[string]string{"compose/es.yml": hash("es")}, []string{"compose/es.yml"}},
+		{
+			map[string]string{"compose/web.yml": hash("v3"), "compose/db.yml": hash("db3"), "compose/es.yml": hash("es")},
+			[]string{"compose/db.yml", "compose/es.yml", "compose/web.yml"},
+		},
+	}
+
+	for i, test := range tests {
+		if changed := reconcileChanges(test.current, baseline); !reflect.DeepEqual(changed, test.expected) {
+			t.Errorf("%d: expected %v, got %v", i, test.expected, changed)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package controllers
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const redactedValue = "********"
+
+var (
+	// Substrings of the keys whose values are secrets, lower case
+	redactKeys = []string{"password", "passwd", "secret", "token", "apikey", "api_key", "private_key", "credential"}
+	// Redact the password of the URLs with credentials
+	redactURLs = true
+	// Redact all the values of the environment and the labels
+	redactEnvironment = false
+	environmentKeys   = map[string]bool{"environment": true, "labels": true}
+
+	adminUsername = ""
+
+	urlCredentials = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://[^:/@\s]+):[^@\s]+@`)
+	// A key: value or a KEY=value line of a compose file
+	yamlKeyValue = regexp.MustCompile(`^(\s*(?:-\s*)?["']?)([A-Za-z0-9_.-]+)(["']?\s*[:=]\s*)(\S.*)$`)
+	// The environment: or labels: key of a compose file
+	yamlEnvironment = regexp.MustCompile(`^(\s*)(environment|labels)(\s*:\s*)(.*)$`)
+	// A variable taken from the environment of docker-compose: - KEY
+	yamlBareItem = regexp.MustCompile(`^\s*-\s*["']?[A-Za-z0-9_.-]+["']?\s*$`)
+)
+
+// SetRedaction sets the substrings of the keys whose values are redacted
+// in the definitions served by the API, if the passwords of the URLs are
+// redacted and if all the values of the environment and labels are
+func SetRedaction(keys []string, urls bool, environment bool) {
+	redactKeys = []string{}
+	for _, key := range keys {
+		redactKeys = append(redactKeys, strings.ToLower(key))
+	}
+	redactURLs = urls
+	redactEnvironment = environment
+}
+
+// SetAdmin sets the user allowed to see the secrets with unredacted=true
+func SetAdmin(username string) {
+	adminUsername = username
+}
+
+func isAdmin(c *gin.Context) bool {
+	return adminUsername != "" && authUser(c) == adminUsername
+}
+
+// redactionFor tells if a response must be redacted: the secrets are only
+// served to an admin asking for them with unredacted=true, the others
+// asking for them are answered 403 and false is returned
+func redactionFor(c *gin.Context) (bool, bool) {
+	if c.Query("unredacted") != "true" {
+		return true, true
+	}
+	if !isAdmin(c) {
+		c.JSON(403, "unredacted views are reserved to the admin")
+		return false, false
+	}
+	return false, true
+}
+
+// agentRedactionFor is redactionFor for the responses the agents need
+// unredacted (the catalog and the template variables): the agents are
+// also allowed to ask for them with unredacted=true
+func agentRedactionFor(c *gin.Context) (bool, bool) {
+	if c.Query("unredacted") == "true" && agentUsername != "" && authUser(c) == agentUsername {
+		return false, true
+	}
+	return redactionFor(c)
+}
+
+func sensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, k := range redactKeys {
+		if strings.Contains(key, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactURL hides the password of the URLs with credentials of a string
+func redactURL(s string) string {
+	if !redactURLs {
+		return s
+	}
+	return urlCredentials.ReplaceAllString(s, "$1:"+redactedValue+"@")
+}
+
+// redactDefinition copies a definition with the values of the sensitive
+// keys (in maps and KEY=value lists) and the passwords of URLs redacted
+func redactDefinition(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		m := map[string]interface{}{}
+		for k, val := range v {
+			if redactEnvironment && environmentKeys[k] {
+				m[k] = redactValues(val)
+				continue
+			}
+			if isScalar(val) && sensitiveKey(k) {
+				m[k] = redactedValue
+				continue
+			}
+			m[k] = redactDefinition(val)
+		}
+		return m
+	case []interface{}:
+		l := []interface{}{}
+		for _, val := range v {
+			l = append(l, redactDefinition(val))
+		}
+		return l
+	case string:
+		if parts := strings.SplitN(v, "=", 2); len(parts) == 2 && sensitiveKey(parts[0]) {
+			return parts[0] + "=" + redactedValue
+		}
+		return redactURL(v)
+	default:
+		return value
+	}
+}
+
+// redactValues redacts all the values of an environment or labels
+// mapping, declared as a map or a list of KEY=value
+func redactValues(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		m := map[string]interface{}{}
+		for k, val := range v {
+			if val == nil {
+				m[k] = nil
+				continue
+			}
+			m[k] = redactedValue
+		}
+		return m
+	case []interface{}:
+		l := []interface{}{}
+		for _, val := range v {
+			if parts := strings.SplitN(fmt.Sprint(val), "=", 2); len(parts) == 2 {
+				l = append(l, parts[0]+"="+redactedValue)
+				continue
+			}
+			l = append(l, val)
+		}
+		return l
+	case nil:
+		return nil
+	default:
+		return redactedValue
+	}
+}
+
+func isScalar(value interface{}) bool {
+	switch value.(type) {
+	case string, float64, bool:
+		return true
+	}
+	return false
+}
+
+// redactText redacts the values of the sensitive keys of a compose file
+func redactText(s string) string {
+	r := newTextRedactor()
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		lines[i] = r.line(line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func redactLine(line string) string {
+	if m := yamlKeyValue.FindStringSubmatch(line); m != nil && sensitiveKey(m[2]) {
+		return m[1] + m[2] + m[3] + redactedValue
+	}
+	return redactURL(line)
+}
+
+// textRedactor redacts the lines of a compose file one after the other,
+// it remembers if they are in an environment or labels block whose values
+// are all redacted with redactEnvironment
+type textRedactor struct {
+	// Indentation of the environment or labels key, -1 out of the block
+	block int
+}
+
+func newTextRedactor() *textRedactor {
+	return &textRedactor{block: -1}
+}
+
+func (r *textRedactor) line(line string) string {
+	if !redactEnvironment {
+		return redactLine(line)
+	}
+
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+		return line
+	}
+	indent := len(line) - len(strings.TrimLeft(line, " "))
+
+	// The items of a list may have the indentation of its key
+	if r.block >= 0 && (indent > r.block || (indent == r.block && strings.HasPrefix(trimmed, "-"))) {
+		if m := yamlKeyValue.FindStringSubmatch(line); m != nil {
+			return m[1] + m[2] + m[3] + redactedValue
+		}
+		if yamlBareItem.MatchString(line) {
+			return line
+		}
+		return line[:indent] + redactedValue
+	}
+	r.block = -1
+
+	if m := yamlEnvironment.FindStringSubmatch(line); m != nil {
+		if m[4] == "" || strings.HasPrefix(m[4], "#") {
+			r.block = len(m[1])
+			return line
+		}
+		// A flow mapping or list: environment: {KEY: value}
+		return m[1] + m[2] + m[3] + redactedValue
+	}
+	return redactLine(line)
+}
+
+func redactServices(services Services) Services {
+	redacted := Services{}
+	for _, s := range services {
+		s.Definition = redactDefinition(s.Definition)
+		s.FullStatus = redactURL(s.FullStatus)
+		redacted = append(redacted, s)
+	}
+	return redacted
+}
+
+// redactVars copies template variables with the values of the sensitive
+// keys and the passwords of URLs redacted
+func redactVars(vars map[string]string) map[string]string {
+	redacted := map[string]string{}
+	for k, v := range vars {
+		if sensitiveKey(k) {
+			redacted[k] = redactedValue
+			continue
+		}
+		redacted[k] = redactURL(v)
+	}
+	return redacted
+}
+
+// redacted copies an execution with the snapshots and the outputs redacted
+func (e *execution) redacted() *execution {
+	r := *e
+	r.Results = make([]*cmdResult, len(e.Results))
+	for i, result := range e.Results {
+		res := *result
+		res.Snapshot = redactText(result.Snapshot)
+		res.OverlaySnapshot = redactText(result.OverlaySnapshot)
+		res.Error = redactURL(result.Error)
+		res.Result = []string{}
+		for _, line := range result.Result {
+			res.Result = append(res.Result, redactLine(line))
+		}
+		r.Results[i] = &res
+	}
+	return &r
+}
+
+func (d composeDiff) redacted() composeDiff {
+	r := newTextRedactor()
+	lines := []string{}
+	for _, line := range d.Diff {
+		// Keep the diff marker
+		if len(line) > 0 {
+			line = line[:1] + r.line(line[1:])
+		}
+		lines = append(lines, line)
+	}
+	d.Diff = lines
+	return d
+}
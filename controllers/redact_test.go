@@ -0,0 +1,189 @@
+package controllers
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRedactText(t *testing.T) {
+	in := `version: '2'
+services:
+  db:
+    image: postgres
+    environment:
+      POSTGRES_PASSWORD: s3cr3t
+      POSTGRES_DB: app
+    command: --url=postgres://app:hunter2@db/app`
+	expected := `version: '2'
+services:
+  db:
+    image: postgres
+    environment:
+      POSTGRES_PASSWORD: ********
+      POSTGRES_DB: app
+    command: --url=postgres://app:********@db/app`
+
+	if out := redactText(in); out != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, out)
+	}
+}
+
+func TestRedactTextEnvironment(t *testing.T) {
+	defer func(environment bool) { redactEnvironment = environment }(redactEnvironment)
+	redactEnvironment = true
+
+	in := `services:
+  web:
+    image: nginx
+    environment:
+      LOG_LEVEL: debug
+      MOTD: |
+        hello
+    labels:
+    - traefik.frontend.rule=Host:example.com
+    - FROM_ENV
+    ports:
+    - 80:80
+  api:
+    environment: {API_URL: http://api}
+    labels: ["a=b"]`
+	expected := `services:
+  web:
+    image: nginx
+    environment:
+      LOG_LEVEL: ********
+      MOTD: ********
+        ********
+    labels:
+    - traefik.frontend.rule=********
+    - FROM_ENV
+    ports:
+    - 80:80
+  api:
+    environment: ********
+    labels: ********`
+
+	if out := redactText(in); out != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, out)
+	}
+}
+
+func TestRedactDefinitionEnvironment(t *testing.T) {
+	defer func(environment bool) { redactEnvironment = environment }(redactEnvironment)
+
+	service := map[string]interface{}{
+		"image":       "nginx",
+		"environment": map[string]interface{}{"LOG_LEVEL": "debug", "DB_PASSWORD": "s3cr3t", "FROM_ENV": nil},
+		"labels":      []interface{}{"traefik.port=80", "FROM_ENV"},
+	}
+
+	redactEnvironment = false
+	expected := map[string]interface{}{
+		"image":       "nginx",
+		"environment": map[string]interface{}{"LOG_LEVEL": "debug", "DB_PASSWORD": redactedValue, "FROM_ENV": nil},
+		"labels":      []interface{}{"traefik.port=80", "FROM_ENV"},
+	}
+	if out := redactDefinition(service); !reflect.DeepEqual(out, expected) {
+		t.Errorf("expected %v, got %v", expected, out)
+	}
+
+	redactEnvironment = true
+	expected = map[string]interface{}{
+		"image":       "nginx",
+		"environment": map[string]interface{}{"LOG_LEVEL": redactedValue, "DB_PASSWORD": redactedValue, "FROM_ENV": nil},
+		"labels":      []interface{}{"traefik.port=" + redactedValue, "FROM_ENV"},
+	}
+	if out := redactDefinition(service); !reflect.DeepEqual(out, expected) {
+		t.Errorf("expected %v, got %v", expected, out)
+	}
+}
+
+func TestRedactedResponses(t *testing.T) {
+	defer func(admin string, agent string) { adminUsername, agentUsername = admin, agent }(adminUsername, agentUsername)
+	adminUsername, agentUsername = "admin", "agent"
+
+	dir, err := ioutil.TempDir("", "squid-catalog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(previous string) { catalogDir = previous }(catalogDir)
+	catalogDir = dir
+	if err := ioutil.WriteFile(filepath.Join(dir, "db.yml"), []byte("services:\n  db:\n    environment:\n      DB_PASSWORD: s3cr3t\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	vmx.Lock()
+	previousVars := serverVars
+	serverVars = varsStore{Global: map[string]string{"db_password": "s3cr3t"}, Nodes: map[string]map[string]string{"node1": {"API_TOKEN": "s3cr3t"}}}
+	vmx.Unlock()
+	defer func() { vmx.Lock(); serverVars = previousVars; vmx.Unlock() }()
+
+	m.Lock()
+	previousStatuses := statuses
+	statuses = map[string]NodeStatus{"node1": {Node: "node1", Services: Services{{
+		Name:       "db",
+		Definition: map[string]interface{}{"environment": map[string]interface{}{"DB_PASSWORD": "s3cr3t"}},
+	}}}}
+	m.Unlock()
+	defer func() { m.Lock(); statuses = previousStatuses; m.Unlock() }()
+
+	handlers := []struct {
+		name    string
+		handler gin.HandlerFunc
+		params  gin.Params
+		agent   bool
+	}{
+		{"catalog file", GetCatalogFile, gin.Params{{Key: "name", Value: "db.yml"}}, true},
+		{"vars", ListVars, nil, false},
+		{"node vars", GetNodeVars, gin.Params{{Key: "node", Value: "node1"}}, true},
+		{"statuses", Statuses, nil, false},
+	}
+	tests := []struct {
+		user       string
+		unredacted bool
+	}{
+		{"ba", false},
+		{"ba", true},
+		{"agent", false},
+		{"agent", true},
+		{"admin", false},
+		{"admin", true},
+	}
+
+	for _, h := range handlers {
+		for _, test := range tests {
+			url := "/api"
+			if test.unredacted {
+				url += "?unredacted=true"
+			}
+			c, w, _ := gin.CreateTestContext()
+			c.Request, _ = http.NewRequest("GET", url, nil)
+			c.Params = h.params
+			c.Set(gin.AuthUserKey, test.user)
+			h.handler(c)
+
+			allowed := test.user == "admin" || test.user == "agent" && h.agent
+			expectedCode, expectedSecret := 200, false
+			if test.unredacted && allowed {
+				expectedSecret = true
+			} else if test.unredacted {
+				expectedCode = 403
+			}
+			if w.Code != expectedCode {
+				t.Errorf("%s by %s (unredacted %v): expected %d, got %d", h.name, test.user, test.unredacted, expectedCode, w.Code)
+				continue
+			}
+			if secret := strings.Contains(w.Body.String(), "s3cr3t"); expectedCode == 200 && secret != expectedSecret {
+				t.Errorf("%s by %s (unredacted %v): expected the secret %v, got %s", h.name, test.user, test.unredacted, expectedSecret, w.Body.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package controllers
+
+import (
+	"os"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ComposeRollback restores a compose file to the definition used by its last
+// successful deployment, the last one before an execution to undo if given,
+// and deploys it again
+func ComposeRollback(c *gin.Context) {
+	compose, err := composeFilePath(c.Query("file"))
+	if err != nil {
+		c.JSON(400, err.Error())
+		return
+	}
+
+	unlock, err := lockDeploy(c, []string{compose})
+	if err != nil {
+		c.JSON(errorStatus(err), err.Error())
+		return
+	}
+	defer unlock()
+
+	e, err := rollback(compose, c.Query("execution"))
+	if err != nil {
+		c.JSON(errorStatus(err), err.Error())
+		return
+	}
+	e.User = authUser(c)
+	recordExecution(e)
+
+	respondExecution(c, e)
+}
+
+// rollback restores the definition of the last successful deployment of a
+// compose file before the execution to undo (in all the history if empty)
+// and deploys it. The execution returned is not yet historized.
+func rollback(compose string, undo string) (*execution, error) {
+	current, overlay, currentOverlay, err := readComposeLayers(compose)
+	if os.IsNotExist(err) {
+		return nil, conflictError("compose file " + compose + " has been deleted, refusing to roll back")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	from, good, err := lastGoodSnapshot(compose, undo)
+	if err != nil {
+		return nil, err
+	}
+	if good == nil {
+		return nil, notFoundError("no previous successful deployment of " + compose)
+	}
+	if good.Hash == layersHash(current, overlay, currentOverlay) {
+		return nil, conflictError(compose + " is already the definition of its last successful deployment (execution " + from.ID + ")")
+	}
+
+	if err := writeComposeFile(compose, []byte(good.Snapshot)); err != nil {
+		return nil, err
+	}
+	if err := restoreOverlay(compose, good); err != nil {
+		return nil, err
+	}
+
+	// The execution undone is the last deployment unless given
+	if undo == "" {
+		if last, _ := lastDeployment(compose); last != nil {
+			undo = last.ID
+		}
+	}
+
+	e := deploy(kindRollback, []string{compose})
+	e.RollbackOf = undo
+	e.RestoredFrom = from.ID
+
+	return e, nil
+}
+
+// lastGoodSnapshot finds the most recent successful deployment of a compose
+// file on the node before an execution, in all the history if it is empty
+func lastGoodSnapshot(compose string, before string) (*execution, *cmdResult, error) {
+	mx.RLock()
+	defer mx.RUnlock()
+
+	i := len(historyResults) - 1
+	if before != "" {
+		for i >= 0 && historyResults[i].ID != before {
+			i--
+		}
+		if i < 0 {
+			return nil, nil, notFoundError("execution " + before + " not found")
+		}
+		i--
+	}
+
+	for ; i >= 0; i-- {
+		// The executions of the server concern other nodes
+		if historyResults[i].Node != hostname {
+			continue
+		}
+		for _, result := range historyResults[i].Results {
+			if result.Compose == compose && result.Status == resultSuccess && result.Snapshot != "" {
+				return historyResults[i], result, nil
+			}
+		}
+	}
+	return nil, nil, nil
+}
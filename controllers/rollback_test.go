@@ -0,0 +1,134 @@
+package controllers
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// useHistory replaces the executions history, the returned
+// function restores the previous one
+func useHistory(executions ...*execution) func() {
+	mx.Lock()
+	previous, previousFile := historyResults, historyFile
+	historyResults, historyFile = executions, ""
+	mx.Unlock()
+
+	return func() {
+		mx.Lock()
+		historyResults, historyFile = previous, previousFile
+		mx.Unlock()
+	}
+}
+
+func deployed(id string, node string, compose string, status string, content string) *execution {
+	return &execution{ID: id, Node: node, Results: []*cmdResult{{
+		Compose:  compose,
+		Status:   status,
+		Hash:     contentHash([]byte(content)),
+		Snapshot: content,
+	}}}
+}
+
+func TestLastGoodSnapshot(t *testing.T) {
+	defer useHistory(
+		deployed("1", hostname, "compose/web.yml", resultSuccess, "v1"),
+		deployed("2", hostname, "compose/db.yml", resultSuccess, "db"),
+		deployed("3", hostname, "compose/web.yml", resultSuccess, "v2"),
+		deployed("4", "node2", "compose/web.yml", resultSuccess, "v3"),
+		deployed("5", hostname, "compose/web.yml", resultFailed, "v4"),
+	)()
+
+	tests := []struct {
+		before   string
+		expected string
+	}{
+		// The last successful deployment, whatever the current content
+		{"", "3"},
+		{"5", "3"},
+		// Undo a successful deployment
+		{"3", "1"},
+		{"1", ""},
+	}
+
+	for _, test := range tests {
+		e, _, err := lastGoodSnapshot("compose/web.yml", test.before)
+		if err != nil {
+			t.Errorf("before %q: %s", test.before, err)
+			continue
+		}
+		id := ""
+		if e != nil {
+			id = e.ID
+		}
+		if id != test.expected {
+			t.Errorf("before %q: expected execution %q, got %q", test.before, test.expected, id)
+		}
+	}
+
+	if _, _, err := lastGoodSnapshot("compose/web.yml", "42"); errorStatus(err) != 404 {
+		t.Errorf("expected an unknown execution to be not found, got %v", err)
+	}
+}
+
+func TestRollbackToCurrentContent(t *testing.T) {
+	dir, cleanup := useComposesDir(t)
+	defer cleanup()
+
+	compose := filepath.Join(dir, "web.yml")
+	if err := writeComposeFile(compose, []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	defer useHistory(
+		deployed("1", hostname, compose, resultSuccess, "v1"),
+		deployed("2", hostname, compose, resultSuccess, "v2"),
+	)()
+
+	// The current content is the last successful deployment
+	if _, err := rollback(compose, ""); errorStatus(err) != 409 {
+		t.Errorf("expected a conflict, got %v", err)
+	}
+}
+
+func TestRollbackRecordsUndoneExecution(t *testing.T) {
+	dir, cleanup := useComposesDir(t)
+	defer cleanup()
+
+	compose := filepath.Join(dir, "web.yml")
+	v := func(version string) string { return "services:\n  web:\n    image: nginx:" + version + "\n" }
+	defer useHistory(
+		deployed("1", hostname, compose, resultSuccess, v("1")),
+		deployed("2", hostname, compose, resultSuccess, v("2")),
+		deployed("3", "node2", compose, resultSuccess, v("3")),
+		deployed("4", hostname, compose, resultFailed, v("4")),
+	)()
+
+	tests := []struct {
+		undo     string
+		undone   string
+		restored string
+		content  string
+	}{
+		// The last deployment is undone
+		{"", "4", "2", v("2")},
+		{"2", "2", "1", v("1")},
+	}
+
+	for _, test := range tests {
+		if err := writeComposeFile(compose, []byte(v("4"))); err != nil {
+			t.Fatal(err)
+		}
+
+		e, err := rollback(compose, test.undo)
+		if err != nil {
+			t.Errorf("undo %q: %s", test.undo, err)
+			continue
+		}
+		if e.RollbackOf != test.undone || e.RestoredFrom != test.restored {
+			t.Errorf("undo %q: expected the rollback of %s to %s, got the rollback of %s to %s", test.undo, test.undone, test.restored, e.RollbackOf, e.RestoredFrom)
+		}
+		if in, _ := ioutil.ReadFile(compose); string(in) != test.content {
+			t.Errorf("undo %q: expected %q restored, got %q", test.undo, test.content, in)
+		}
+	}
+}
@@ -0,0 +1,519 @@
+package controllers
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	rollouts = map[string]*rollout{}
+	rmx      sync.RWMutex
+
+	rolloutCheckPeriod = time.Duration(5) * time.Second
+	// A paused rollout keeps its global lock renewing it periodically
+	lockRenewPeriod    = time.Duration(defaultLockTTL/3) * time.Second
+	defaultWaitTimeout = 300
+	defaultBatchSize   = 1
+	defaultOnFailure   = "pause"
+	rolloutsKept       = 50
+)
+
+// Status of a rollout and of its nodes
+const (
+	rolloutRunning   = "running"
+	rolloutPaused    = "paused"
+	rolloutAborted   = "aborted"
+	rolloutSucceeded = "succeeded"
+	rolloutFailed    = "failed"
+
+	nodePending   = "pending"
+	nodeDeploying = "deploying"
+	nodeWaiting   = "waiting"
+	nodeHealthy   = "healthy"
+	nodeFailed    = "failed"
+)
+
+type rolloutSpec struct {
+	Compose     string   `json:"compose"`
+	Definition  string   `json:"definition"`
+	Nodes       []string `json:"nodes"`
+	BatchSize   int      `json:"batchSize"`
+	MaxFailures int      `json:"maxFailures"`
+	OnFailure   string   `json:"onFailure"`
+	WaitTimeout int      `json:"waitTimeout"`
+}
+
+type rollout struct {
+	ID       string          `json:"id"`
+	Spec     rolloutSpec     `json:"spec"`
+	User     string          `json:"user"`
+	Status   string          `json:"status"`
+	Reason   string          `json:"reason,omitempty"`
+	Started  int64           `json:"started"`
+	Ended    int64           `json:"ended,omitempty"`
+	Failures int             `json:"failures"`
+	Batches  []*rolloutBatch `json:"batches"`
+
+	wake chan struct{}
+	lock string
+}
+
+type rolloutBatch struct {
+	Status string         `json:"status"`
+	Nodes  []*rolloutNode `json:"nodes"`
+}
+
+type rolloutNode struct {
+	Node      string `json:"node"`
+	Status    string `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Execution string `json:"execution,omitempty"`
+
+	// result is the one of the compose file in the execution of the agent,
+	// nil when the agent refused to deploy it
+	result *cmdResult
+}
+
+// StartRollout deploys a compose file on a set of nodes batch by batch
+func StartRollout(c *gin.Context) {
+	var spec rolloutSpec
+	if err := c.BindJSON(&spec); err != nil {
+		c.JSON(400, err.Error())
+		return
+	}
+
+	r, err := newRollout(spec, authUser(c), "")
+	if err != nil {
+		c.JSON(errorStatus(err), err.Error())
+		return
+	}
+
+	go r.run()
+
+	rmx.RLock()
+	defer rmx.RUnlock()
+	c.JSON(200, r.redacted())
+}
+
+func ListRollouts(c *gin.Context) {
+	rmx.RLock()
+	defer rmx.RUnlock()
+
+	list := []*rollout{}
+	for _, r := range rollouts {
+		list = append(list, r.redacted())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Started > list[j].Started
+	})
+
+	c.JSON(200, list)
+}
+
+// GetRollout returns a rollout, the secrets of its definition are
+// redacted unless an admin asks for them
+func GetRollout(c *gin.Context) {
+	redact, ok := redactionFor(c)
+	if !ok {
+		return
+	}
+
+	rmx.RLock()
+	defer rmx.RUnlock()
+
+	r, ok := rollouts[c.Param("id")]
+	if !ok {
+		c.JSON(404, "rollout not found")
+		return
+	}
+
+	if redact {
+		r = r.redacted()
+	}
+	c.JSON(200, r)
+}
+
+// ControlRollout pauses, resumes or aborts a rollout
+func ControlRollout(c *gin.Context) {
+	rmx.Lock()
+	defer rmx.Unlock()
+
+	r, ok := rollouts[c.Param("id")]
+	if !ok {
+		c.JSON(404, "rollout not found")
+		return
+	}
+
+	action := c.Param("action")
+	switch {
+	case r.Status != rolloutRunning && r.Status != rolloutPaused:
+		c.JSON(409, "rollout is "+r.Status)
+		return
+	case action == "pause":
+		r.Status = rolloutPaused
+		r.Reason = "paused by " + authUser(c)
+	case action == "resume":
+		r.Status = rolloutRunning
+		r.Reason = ""
+	case action == "abort":
+		r.Status = rolloutAborted
+		r.Reason = "aborted by " + authUser(c)
+		r.Ended = time.Now().Unix()
+	default:
+		c.JSON(400, "unknown action "+action)
+		return
+	}
+
+	// Wake up the rollout waiting to be resumed
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+
+	c.JSON(200, r.redacted())
+}
+
+// newRollout validates a rollout and takes the global lock unless
+// the token of the lock already held is given
+func newRollout(spec rolloutSpec, user string, lock string) (*rollout, error) {
+	if spec.Compose == "" {
+		return nil, badRequestError("compose is required")
+	}
+	if _, err := composeFilePath(spec.Compose); err != nil {
+		return nil, badRequestError(err.Error())
+	}
+	if spec.Definition != "" {
+		if err := checkDefinition(spec.Compose, []byte(spec.Definition)); err != nil {
+			return nil, badRequestError("invalid definition: " + err.Error())
+		}
+	}
+	if spec.BatchSize <= 0 {
+		spec.BatchSize = defaultBatchSize
+	}
+	if spec.WaitTimeout <= 0 {
+		spec.WaitTimeout = defaultWaitTimeout
+	}
+	if spec.OnFailure == "" {
+		spec.OnFailure = defaultOnFailure
+	}
+	if spec.OnFailure != "pause" && spec.OnFailure != "abort" {
+		return nil, badRequestError("onFailure must be pause or abort")
+	}
+	if len(spec.Nodes) == 0 {
+		spec.Nodes = nodesRunningCompose(spec.Compose)
+	}
+	for _, node := range spec.Nodes {
+		if _, err := nodeURL(node); err != nil {
+			return nil, err
+		}
+	}
+	if len(spec.Nodes) == 0 {
+		return nil, badRequestError("no node runs " + spec.Compose)
+	}
+
+	if lock == "" {
+		token, err := acquireGlobalLock("rollout of "+spec.Compose+" by "+user, defaultLockTTL)
+		if err != nil {
+			return nil, err
+		}
+		lock = token
+	}
+
+	r := &rollout{
+		ID:      newExecutionID(),
+		Spec:    spec,
+		User:    user,
+		Status:  rolloutRunning,
+		Started: time.Now().Unix(),
+		Batches: []*rolloutBatch{},
+		wake:    make(chan struct{}, 1),
+		lock:    lock,
+	}
+	for i := 0; i < len(spec.Nodes); i += spec.BatchSize {
+		end := i + spec.BatchSize
+		if end > len(spec.Nodes) {
+			end = len(spec.Nodes)
+		}
+		batch := &rolloutBatch{Status: nodePending, Nodes: []*rolloutNode{}}
+		for _, node := range spec.Nodes[i:end] {
+			batch.Nodes = append(batch.Nodes, &rolloutNode{Node: node, Status: nodePending})
+		}
+		r.Batches = append(r.Batches, batch)
+	}
+
+	rmx.Lock()
+	rollouts[r.ID] = r
+	forgetOldRollouts()
+	rmx.Unlock()
+
+	return r, nil
+}
+
+func (r *rollout) run() {
+	defer releaseGlobalLock(r.lock)
+
+	for _, batch := range r.Batches {
+		if !r.waitRunning() {
+			return
+		}
+
+		if err := renewGlobalLock(r.lock, defaultLockTTL); err != nil {
+			r.update(func() {
+				r.Status = rolloutFailed
+				r.Reason = err.Error()
+				r.Ended = time.Now().Unix()
+			})
+			return
+		}
+
+		r.update(func() { batch.Status = nodeDeploying })
+		rolloutBatchNodes(r.Spec, r.lock, batch.Nodes, r.update)
+
+		r.update(func() {
+			batch.Status = nodeHealthy
+			for _, n := range batch.Nodes {
+				if n.Status == nodeFailed {
+					batch.Status = nodeFailed
+					r.Failures++
+				}
+			}
+			if r.Failures <= r.Spec.MaxFailures || r.Status != rolloutRunning {
+				return
+			}
+			r.Reason = "too many failures"
+			if r.Spec.OnFailure == "abort" {
+				r.Status = rolloutFailed
+				r.Ended = time.Now().Unix()
+			} else {
+				r.Status = rolloutPaused
+			}
+		})
+	}
+
+	// A rollout paused after its last batch waits to be resumed or aborted
+	if !r.waitRunning() {
+		return
+	}
+
+	r.update(func() {
+		if r.Status == rolloutRunning {
+			r.Status = rolloutSucceeded
+			r.Ended = time.Now().Unix()
+		}
+	})
+}
+
+// waitRunning blocks while the rollout is paused, renewing its global
+// lock, and tells if the rollout can continue
+func (r *rollout) waitRunning() bool {
+	for {
+		rmx.RLock()
+		status := r.Status
+		rmx.RUnlock()
+
+		switch status {
+		case rolloutRunning:
+			return true
+		case rolloutPaused:
+			select {
+			case <-r.wake:
+			case <-time.After(lockRenewPeriod):
+				if err := renewGlobalLock(r.lock, defaultLockTTL); err != nil {
+					r.update(func() {
+						r.Status = rolloutFailed
+						r.Reason = "paused: " + err.Error()
+						r.Ended = time.Now().Unix()
+					})
+					return false
+				}
+			}
+		default:
+			return false
+		}
+	}
+}
+
+func (r *rollout) update(f func()) {
+	rmx.Lock()
+	defer rmx.Unlock()
+	f()
+}
+
+// rolloutBatchNodes deploys a compose file on nodes in parallel, with the
+// token of the global lock, and waits for their reported status to be up
+// and healthy
+func rolloutBatchNodes(spec rolloutSpec, lock string, nodes []*rolloutNode, update func(func())) {
+	var wg sync.WaitGroup
+	wg.Add(len(nodes))
+
+	for _, n := range nodes {
+		go func(n *rolloutNode) {
+			defer wg.Done()
+
+			update(func() { n.Status = nodeDeploying })
+			since := time.Now().Unix()
+			e, err := deployOnNode(n.Node, lock, spec.Compose, spec.Definition)
+			update(func() {
+				// The agent applied the definition when it ran the deployment
+				if e != nil {
+					n.Execution = e.ID
+					if len(e.Results) > 0 {
+						n.result = e.Results[0]
+					}
+				}
+				if err != nil {
+					n.Status = nodeFailed
+					n.Detail = err.Error()
+				} else {
+					n.Status = nodeWaiting
+				}
+			})
+			if err != nil {
+				return
+			}
+
+			healthy, detail := waitNodeHealthy(n.Node, spec.Compose, since, time.Duration(spec.WaitTimeout)*time.Second)
+			update(func() {
+				n.Detail = detail
+				if healthy {
+					n.Status = nodeHealthy
+				} else {
+					n.Status = nodeFailed
+				}
+			})
+		}(n)
+	}
+
+	wg.Wait()
+}
+
+// deployOnNode asks the agent of a node to deploy a compose file,
+// applying a new definition if given
+func deployOnNode(node string, lock string, compose string, definition string) (*execution, error) {
+	req := deployRequest{Files: []string{compose}}
+	if definition != "" {
+		req.Files = nil
+		req.Definitions = map[string]string{compose: definition}
+	}
+
+	var e execution
+	code, err := lockedAgentRequest(node, lock, "POST", "/compose/up", req, &e)
+	if err != nil {
+		return nil, err
+	}
+	if code != 200 {
+		return &e, errors.New("deploy " + e.Status + " on " + node)
+	}
+
+	return &e, nil
+}
+
+// waitNodeHealthy waits for a node to report the services of a compose file
+// up and healthy in a status sent after a date
+func waitNodeHealthy(node string, compose string, since int64, timeout time.Duration) (bool, string) {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		done, healthy, detail := nodeComposeHealth(node, compose, since)
+		if done {
+			return healthy, detail
+		}
+		if time.Now().After(deadline) {
+			return false, "timeout: " + detail
+		}
+		time.Sleep(rolloutCheckPeriod)
+	}
+}
+
+// nodeComposeHealth checks the services of a compose file in the last status
+// reported by a node. It is done when all the services are healthy or one
+// of them is definitely down.
+func nodeComposeHealth(node string, compose string, since int64) (bool, bool, string) {
+	m.RLock()
+	defer m.RUnlock()
+
+	status, ok := statuses[node]
+	if !ok {
+		return true, false, "unknown node"
+	}
+	if status.Date < since {
+		return false, false, "waiting for a status report"
+	}
+
+	pending := []string{}
+	nbServices := 0
+	for _, s := range status.Services {
+		if s.Compose != compose {
+			continue
+		}
+		nbServices++
+
+		switch {
+		case s.Status == "Exited" || s.Status == "Dead":
+			return true, false, s.Name + " " + s.FullStatus
+		case s.Status != "Up" || strings.Contains(s.FullStatus, "health: starting") ||
+			strings.Contains(s.FullStatus, "unhealthy"):
+			pending = append(pending, s.Name+" "+s.FullStatus)
+		}
+	}
+
+	if nbServices == 0 {
+		return false, false, "no service reported"
+	}
+	if len(pending) > 0 {
+		return false, false, strings.Join(pending, ", ")
+	}
+
+	return true, true, ""
+}
+
+// nodesRunningCompose lists the nodes reporting services of a compose file
+func nodesRunningCompose(compose string) []string {
+	m.RLock()
+	defer m.RUnlock()
+
+	nodes := []string{}
+	for node, status := range statuses {
+		for _, s := range status.Services {
+			if s.Compose == compose {
+				nodes = append(nodes, node)
+				break
+			}
+		}
+	}
+	sort.Strings(nodes)
+
+	return nodes
+}
+
+// forgetOldRollouts keeps only the most recent finished rollouts
+func forgetOldRollouts() {
+	list := []*rollout{}
+	for _, r := range rollouts {
+		list = append(list, r)
+	}
+	if len(list) <= rolloutsKept {
+		return
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Started > list[j].Started
+	})
+	for _, r := range list[rolloutsKept:] {
+		if r.Status != rolloutRunning && r.Status != rolloutPaused {
+			delete(rollouts, r.ID)
+		}
+	}
+}
+
+// redacted copies a rollout with the secrets of its definition redacted
+func (r *rollout) redacted() *rollout {
+	redacted := *r
+	redacted.Spec.Definition = redactText(r.Spec.Definition)
+	return &redacted
+}
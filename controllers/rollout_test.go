@@ -0,0 +1,50 @@
+package controllers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPausedRolloutRenewsLock(t *testing.T) {
+	defer func(period time.Duration) { lockRenewPeriod = period }(lockRenewPeriod)
+	lockRenewPeriod = 10 * time.Millisecond
+
+	token, err := acquireGlobalLock("rollout of web.yml by ba", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer releaseGlobalLock(token)
+
+	r := &rollout{Status: rolloutPaused, wake: make(chan struct{}, 1), lock: token}
+	running := make(chan bool)
+	go func() { running <- r.waitRunning() }()
+
+	// Longer than the TTL of the lock
+	time.Sleep(2100 * time.Millisecond)
+
+	lmx.Lock()
+	expired := globalLock == nil || globalLock.Token != token || globalLock.expired()
+	lmx.Unlock()
+	if expired {
+		t.Error("expected the paused rollout to keep its lock")
+	}
+
+	r.update(func() { r.Status = rolloutRunning })
+	r.wake <- struct{}{}
+	if !<-running {
+		t.Errorf("expected the rollout to be resumed, got %s", r.Status)
+	}
+}
+
+func TestPausedRolloutLosingLockFails(t *testing.T) {
+	defer func(period time.Duration) { lockRenewPeriod = period }(lockRenewPeriod)
+	lockRenewPeriod = 10 * time.Millisecond
+
+	r := &rollout{Status: rolloutPaused, wake: make(chan struct{}, 1), lock: "lost"}
+	if r.waitRunning() {
+		t.Fatal("expected the rollout to stop")
+	}
+	if r.Status != rolloutFailed {
+		t.Errorf("expected the rollout to fail, got %s", r.Status)
+	}
+}
@@ -0,0 +1,150 @@
+package controllers
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+var (
+	secretKey []byte
+
+	encryptedValue = regexp.MustCompile(`ENC\[([A-Za-z0-9+/=]+)\]`)
+	// Prefix of the environment variables giving the decrypted values to docker-compose
+	secretEnvPrefix = "SQUID_SECRET_"
+)
+
+// LoadSecretKey reads the key of the node decrypting the ENC[...] values
+func LoadSecretKey(file string) error {
+	key, err := ReadSecretKey(file)
+	if err != nil {
+		return err
+	}
+	secretKey = key
+	return nil
+}
+
+// ReadSecretKey reads a key encoded in base64 (32 bytes for AES-256)
+func ReadSecretKey(file string) ([]byte, error) {
+	in, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(in)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret key %s: %s", file, err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid secret key %s: 32 bytes expected", file)
+	}
+	return key, nil
+}
+
+// GenerateSecretKey writes a new random key readable only by its owner
+func GenerateSecretKey(file string) error {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600)
+}
+
+// EncryptSecret encrypts a value with AES-GCM as ENC[base64(nonce + ciphertext)]
+func EncryptSecret(key []byte, plaintext string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+
+	return "ENC[" + base64.StdEncoding.EncodeToString(sealed) + "]", nil
+}
+
+func decryptSecret(encoded string) (string, error) {
+	if secretKey == nil {
+		return "", errors.New("encrypted value found but no secret key is loaded")
+	}
+	gcm, err := newGCM(secretKey)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < gcm.NonceSize() {
+		return "", errors.New("invalid encrypted value")
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("fail to decrypt a value, wrong secret key?")
+	}
+
+	return string(plaintext), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// secretEnv replaces the encrypted values of a compose file by references
+// to environment variables holding their plaintext, only given to the
+// docker-compose process so the plaintext is never written
+type secretEnv struct {
+	names map[string]string
+	env   []string
+	err   error
+}
+
+func newSecretEnv() *secretEnv {
+	return &secretEnv{names: map[string]string{}, env: []string{}}
+}
+
+func (s *secretEnv) seal(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return encryptedValue.ReplaceAllStringFunc(v, func(enc string) string {
+			encoded := encryptedValue.FindStringSubmatch(enc)[1]
+			name, ok := s.names[encoded]
+			if !ok {
+				plaintext, err := decryptSecret(encoded)
+				if err != nil {
+					s.err = err
+					return enc
+				}
+				name = fmt.Sprintf("%s%d", secretEnvPrefix, len(s.names))
+				s.names[encoded] = name
+				s.env = append(s.env, name+"="+plaintext)
+			}
+			return "${" + name + "}"
+		})
+	case map[string]interface{}:
+		m := map[string]interface{}{}
+		for k, val := range v {
+			m[k] = s.seal(val)
+		}
+		return m
+	case []interface{}:
+		l := []interface{}{}
+		for _, val := range v {
+			l = append(l, s.seal(val))
+		}
+		return l
+	default:
+		return value
+	}
+}
@@ -0,0 +1,55 @@
+package controllers
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestEncryptDecryptSecret(t *testing.T) {
+	defer func(key []byte) { secretKey = key }(secretKey)
+
+	key := bytes.Repeat([]byte{1}, 32)
+	otherKey := bytes.Repeat([]byte{2}, 32)
+
+	encrypted, err := EncryptSecret(key, "s3cr3t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	match := encryptedValue.FindStringSubmatch(encrypted)
+	if match == nil || match[0] != encrypted {
+		t.Fatalf("expected an ENC[...] value, got %s", encrypted)
+	}
+	if again, _ := EncryptSecret(key, "s3cr3t"); again == encrypted {
+		t.Error("expected a random nonce for each encryption")
+	}
+
+	tests := []struct {
+		name      string
+		key       []byte
+		encoded   string
+		plaintext string
+		err       string
+	}{
+		{"right key", key, match[1], "s3cr3t", ""},
+		{"no key", nil, match[1], "", "no secret key"},
+		{"wrong key", otherKey, match[1], "", "wrong secret key"},
+		{"not base64", key, "!!!", "", "invalid encrypted value"},
+		{"too short", key, "AAAA", "", "invalid encrypted value"},
+	}
+
+	for _, test := range tests {
+		secretKey = test.key
+		plaintext, err := decryptSecret(test.encoded)
+		if plaintext != test.plaintext {
+			t.Errorf("%s: expected %q, got %q", test.name, test.plaintext, plaintext)
+		}
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+		}
+	}
+
+	if _, err := EncryptSecret([]byte("short"), "s3cr3t"); err == nil {
+		t.Error("expected an invalid key to be refused")
+	}
+}
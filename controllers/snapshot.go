@@ -0,0 +1,162 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+func contentHash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+type composeDiff struct {
+	Compose  string   `json:"compose"`
+	FromHash string   `json:"fromHash"`
+	ToHash   string   `json:"toHash"`
+	Changed  bool     `json:"changed"`
+	Diff     []string `json:"diff"`
+}
+
+// DiffExecutions diffs the compose files snapshots of two executions
+func DiffExecutions(c *gin.Context) {
+	redact, ok := redactionFor(c)
+	if !ok {
+		return
+	}
+
+	from := findExecution(c.Param("id"))
+	to := findExecution(c.Param("other"))
+	if from == nil || to == nil {
+		c.JSON(404, "execution not found")
+		return
+	}
+
+	diffs := diffExecutions(from, to)
+	if redact {
+		for i := range diffs {
+			diffs[i] = diffs[i].redacted()
+		}
+	}
+	c.JSON(200, diffs)
+}
+
+func diffExecutions(from *execution, to *execution) []composeDiff {
+	fromSnapshots := from.snapshots()
+	toSnapshots := to.snapshots()
+
+	composes := []string{}
+	for compose := range fromSnapshots {
+		composes = append(composes, compose)
+	}
+	for compose := range toSnapshots {
+		if _, ok := fromSnapshots[compose]; !ok {
+			composes = append(composes, compose)
+		}
+	}
+	sort.Strings(composes)
+
+	diffs := []composeDiff{}
+	for _, compose := range composes {
+		before := fromSnapshots[compose]
+		after := toSnapshots[compose]
+
+		d := composeDiff{Compose: compose, Diff: []string{}}
+		if before != nil {
+			d.FromHash = before.Hash
+		}
+		if after != nil {
+			d.ToHash = after.Hash
+		}
+		d.Changed = d.FromHash != d.ToHash
+		if d.Changed {
+			d.Diff = diffLines(splitLines(before), splitLines(after))
+		}
+		diffs = append(diffs, d)
+	}
+
+	return diffs
+}
+
+// snapshots indexes the results of an execution by compose file, the
+// overlay of a common compose file is diffed as a file of its own
+func (e *execution) snapshots() map[string]*cmdResult {
+	snapshots := map[string]*cmdResult{}
+	for _, result := range e.Results {
+		if result.Hash == "" {
+			continue
+		}
+		if result.Overlay == "" {
+			snapshots[result.Compose] = result
+			continue
+		}
+		snapshots[result.Compose] = &cmdResult{
+			Compose:  result.Compose,
+			Hash:     contentHash([]byte(result.Snapshot)),
+			Snapshot: result.Snapshot,
+		}
+		snapshots[result.Overlay] = &cmdResult{
+			Compose:  result.Overlay,
+			Hash:     contentHash([]byte(result.OverlaySnapshot)),
+			Snapshot: result.OverlaySnapshot,
+		}
+	}
+	return snapshots
+}
+
+func splitLines(result *cmdResult) []string {
+	if result == nil || result.Snapshot == "" {
+		return []string{}
+	}
+	return strings.Split(strings.TrimRight(result.Snapshot, "\n"), "\n")
+}
+
+// diffLines computes a line based diff using the longest common subsequence.
+// Lines are prefixed by '+' when added, '-' when removed and ' ' otherwise.
+func diffLines(a []string, b []string) []string {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	diff := []string{}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			diff = append(diff, " "+a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			diff = append(diff, "-"+a[i])
+			i++
+		default:
+			diff = append(diff, "+"+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		diff = append(diff, "-"+a[i])
+	}
+	for ; j < len(b); j++ {
+		diff = append(diff, "+"+b[j])
+	}
+
+	return diff
+}
@@ -0,0 +1,27 @@
+package controllers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		a        []string
+		b        []string
+		expected []string
+	}{
+		{[]string{}, []string{}, []string{}},
+		{[]string{"a"}, []string{"a"}, []string{" a"}},
+		{[]string{}, []string{"a", "b"}, []string{"+a", "+b"}},
+		{[]string{"a", "b"}, []string{}, []string{"-a", "-b"}},
+		{[]string{"a", "b", "c"}, []string{"a", "x", "c"}, []string{" a", "-b", "+x", " c"}},
+		{[]string{"a", "b", "c"}, []string{"b", "c", "d"}, []string{"-a", " b", " c", "+d"}},
+	}
+
+	for _, test := range tests {
+		if diff := diffLines(test.a, test.b); !reflect.DeepEqual(diff, test.expected) {
+			t.Errorf("%q -> %q: expected %q, got %q", test.a, test.b, test.expected, diff)
+		}
+	}
+}
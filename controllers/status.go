@@ -1,6 +1,7 @@
 package controllers
 
 import (
+	"errors"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -9,26 +10,42 @@ import (
 
 	"github.com/docker/engine-api/client"
 	"github.com/docker/engine-api/types"
-	"github.com/ghodss/yaml"
 	"github.com/gin-gonic/gin"
 	"golang.org/x/net/context"
 )
 
 var (
 	defaultHeaders = map[string]string{"User-Agent": "squid-1.0"}
+
+	hostname = "default"
 )
 
 func init() {
 	os.Setenv("JSON", "yes")
 }
 
+// SetHostname sets the name of the node squid is running on
+func SetHostname(host string) {
+	hostname = host
+}
+
+// GetStatus returns the services of the node, the secrets of their
+// definition are redacted unless an admin asks for them
 func GetStatus(c *gin.Context) {
+	redact, ok := redactionFor(c)
+	if !ok {
+		return
+	}
+
 	services, err := getServices()
 	if err != nil {
 		handleError(c, err)
 		return
 	}
 
+	if redact {
+		services = redactServices(services)
+	}
 	c.JSON(200, services)
 }
 
@@ -71,7 +88,9 @@ func getDockerStatus(c *gin.Context) {
 
 var dockerClient *client.Client
 
-func dockerStatus() ([]types.Container, error) {
+// getDockerClient creates the client of the docker daemon of the node
+// the first time it is needed
+func getDockerClient() (*client.Client, error) {
 	if dockerClient == nil {
 		c, err := client.NewClient("unix:///var/run/docker.sock", "v1.22", nil, defaultHeaders)
 		if err != nil {
@@ -79,9 +98,17 @@ func dockerStatus() ([]types.Container, error) {
 		}
 		dockerClient = c
 	}
+	return dockerClient, nil
+}
+
+func dockerStatus() ([]types.Container, error) {
+	cli, err := getDockerClient()
+	if err != nil {
+		return nil, err
+	}
 
 	options := types.ContainerListOptions{All: true}
-	containers, err := dockerClient.ContainerList(context.Background(), options)
+	containers, err := cli.ContainerList(context.Background(), options)
 	if err != nil {
 		return nil, err
 	}
@@ -92,27 +119,91 @@ func dockerStatus() ([]types.Container, error) {
 // ---------
 
 type RawCompose struct {
-	Services RawServices `json:"services"`
+	// File is the name of the compose file relative to the compose directory
+	File     string                 `json:"-"`
+	Version  string                 `json:"version,omitempty"`
+	Squid    *squidOptions          `json:"x-squid,omitempty"`
+	Services RawServices            `json:"services"`
+	Networks map[string]interface{} `json:"networks,omitempty"`
+	Volumes  map[string]interface{} `json:"volumes,omitempty"`
+
+	// HasServices tells if the services are under a services key, the
+	// v2/v3 layout, with or without version
+	HasServices bool `json:"-"`
+	// Project is the docker-compose project name of the compose file
+	Project string `json:"-"`
+	// Unscheduled are the services not placed on this node with the reason why
+	Unscheduled map[string]string `json:"-"`
+	// Provenance is the layer defining each field of the services
+	Provenance map[string]map[string]string `json:"provenance,omitempty"`
+	// Error is why the compose file can't be loaded
+	Error string `json:"error,omitempty"`
 }
 
 type RawServices map[string]map[string]interface{}
 
 var composesDir = "./compose"
 
+// listComposeFiles lists the compose files of the compose directory,
+// the ones of the common layer and of the node when it is layered
 func listComposeFiles() ([]string, error) {
-	composeFiles := []string{}
+	if isLayered() {
+		return listLayeredComposeFiles()
+	}
+	return walkComposeFiles(composesDir)
+}
 
-	err := filepath.Walk(composesDir, func(path string, f os.FileInfo, err error) error {
-		if strings.HasSuffix(path, ".yml") {
-			composeFiles = append(composeFiles, path)
-		}
-		return nil
-	})
+// composeFilePath resolves the name of a compose file relative to the
+// compose directory and refuses to escape it
+func composeFilePath(name string) (string, error) {
+	if name == "" {
+		return "", errors.New("compose file name is required")
+	}
+
+	path := filepath.Join(composesDir, name)
+	rel, err := filepath.Rel(composesDir, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", errors.New("invalid compose file name: " + name)
+	}
+
+	return path, nil
+}
+
+// composeName is the name of a compose file relative to the compose directory
+func composeName(path string) string {
+	rel, err := filepath.Rel(composesDir, path)
 	if err != nil {
-		return nil, err
+		return path
 	}
+	return rel
+}
 
-	return composeFiles, err
+// writeComposeFile replaces the content of a compose file using a
+// temporary file renamed afterwards
+func writeComposeFile(path string, content []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".squid")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
 }
 
 func listComposes() ([]RawCompose, error) {
@@ -124,37 +215,29 @@ func listComposes() ([]RawCompose, error) {
 	}
 
 	for _, composeFile := range composeFiles {
-		compose, err := yaml2json(composeFile)
+		compose, err := loadCompose(composeFile)
 		if err != nil {
-			return nil, err
+			// Keep listing the other compose files
+			composes = append(composes, RawCompose{File: composeName(composeFile), Error: err.Error()})
+			continue
 		}
+		compose.File = composeName(composeFile)
+		compose.Unscheduled = scheduleCompose(compose)
 		composes = append(composes, *compose)
 	}
 
 	return composes, nil
 }
 
-func yaml2json(file string) (*RawCompose, error) {
-	in, err := ioutil.ReadFile(file)
-	if err != nil {
-		return nil, err
-	}
-
-	var compose RawCompose
-	err = yaml.Unmarshal(in, &compose)
-	if err != nil {
-		return nil, err
-	}
-
-	return &compose, nil
-}
-
 type Service struct {
 	Image      string      `json:"image"`
 	Name       string      `json:"name"`
+	Compose    string      `json:"compose,omitempty"`
 	Status     string      `json:"status"`
 	FullStatus string      `json:"fullStatus"`
 	Definition interface{} `json:"definition"`
+	// Provenance is the layer defining each field of the definition
+	Provenance map[string]string `json:"provenance,omitempty"`
 }
 
 // A services slice is sortable
@@ -184,7 +267,7 @@ func mergeDockerStatusAndComposes(containers []types.Container, composes []RawCo
 			Image:      container.Image,
 			Name:       strings.Replace(container.Names[0], "/", "", -1),
 			FullStatus: container.Status,
-			Status:     "_NotDeclared",
+			Status:     statusNotDeclared,
 			Definition: []string{},
 		})
 	}
@@ -194,34 +277,42 @@ func mergeDockerStatusAndComposes(containers []types.Container, composes []RawCo
 	missingServices := []Service{}
 
 	for _, compose := range composes {
-		for name, composeService := range compose.Services {
-			// Name is the container_name if defined or the key of the service
-			containerName := composeService["container_name"]
-			if containerName != nil {
-				name = containerName.(string)
-			}
-			image := composeService["image"].(string)
+		if compose.Error != "" {
+			missingServices = append(missingServices, invalidComposeService(compose.File, compose.Error))
+			continue
+		}
+		for key, composeService := range compose.Services {
+			name := serviceContainerName(key, composeService)
+			image := serviceImage(&compose, key, composeService)
 
 			isInDockerPs := false
 			for i, s := range services {
-				// The service match the compose declaration if image and name matches
-				if s.Image == image && (s.Name == name || strings.Contains(s.Name, "_"+name+"_")) {
+				if matchContainer(s.Name, s.Image, name, image) {
 					isInDockerPs = true
 					// Keep the first word of the full status as status
 					services[i].Status = strings.Split(s.FullStatus, " ")[0]
 					services[i].Definition = composeService
+					services[i].Compose = compose.File
+					services[i].Provenance = compose.Provenance[key]
 				}
 			}
 
 			// Handle containers not started
 			if !isInDockerPs {
-				missingServices = append(missingServices, Service{
+				service := Service{
 					Image:      image,
 					Name:       name,
+					Compose:    compose.File,
 					FullStatus: "Not started",
 					Status:     "NotStarted",
 					Definition: composeService,
-				})
+					Provenance: compose.Provenance[key],
+				}
+				if reason, ok := compose.Unscheduled[key]; ok {
+					service.FullStatus = "Not scheduled: " + reason
+					service.Status = statusNotScheduled
+				}
+				missingServices = append(missingServices, service)
 			}
 		}
 	}
@@ -233,6 +324,53 @@ func mergeDockerStatusAndComposes(containers []types.Container, composes []RawCo
 	return services
 }
 
+// serviceContainerName is the container_name if defined or the key of the service
+func serviceContainerName(name string, composeService map[string]interface{}) string {
+	if containerName, ok := composeService["container_name"].(string); ok {
+		return containerName
+	}
+	return name
+}
+
+// matchContainer tells if a container matches a compose declaration:
+// image and name matches
+func matchContainer(containerName string, containerImage string, name string, image string) bool {
+	return containerImage == image && (containerName == name || strings.Contains(containerName, "_"+name+"_"))
+}
+
 func handleError(c *gin.Context, err error) {
 	c.JSON(500, err.Error())
 }
+
+// httpError is an error carrying the HTTP status to respond with
+type httpError struct {
+	code int
+	msg  string
+}
+
+func (e httpError) Error() string {
+	return e.msg
+}
+
+func badRequestError(msg string) error {
+	return httpError{code: 400, msg: msg}
+}
+
+func conflictError(msg string) error {
+	return httpError{code: 409, msg: msg}
+}
+
+func notFoundError(msg string) error {
+	return httpError{code: 404, msg: msg}
+}
+
+func unavailableError(msg string) error {
+	return httpError{code: 503, msg: msg}
+}
+
+func errorStatus(err error) int {
+	if e, ok := err.(httpError); ok {
+		return e.code
+	}
+	return 500
+}
@@ -0,0 +1,262 @@
+package controllers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/ghodss/yaml"
+	"github.com/gin-gonic/gin"
+)
+
+const noValue = "<no value>"
+
+var (
+	inventoryFile = "inventory.yml"
+
+	nodeVars      = map[string]string{}
+	nodeVarsDate  time.Time
+	nodeVarsTTL   = time.Duration(30) * time.Second
+	nodeVarsMutex sync.Mutex
+
+	templateFuncs = template.FuncMap{
+		"default":  templateDefault,
+		"required": templateRequired,
+		"join":     strings.Join,
+		"lower":    strings.ToLower,
+		"upper":    strings.ToUpper,
+	}
+
+	templateErrorLine = regexp.MustCompile(`template: [^:]+:(\d+)`)
+)
+
+// templateData is given to the compose templates: {{ .Hostname }},
+// {{ .Labels.zone }} or {{ .Vars.heap }}
+type templateData struct {
+	Hostname string                 `json:"hostname"`
+	Labels   map[string]string      `json:"labels"`
+	Vars     map[string]interface{} `json:"vars"`
+}
+
+// inventory gives variables to all the nodes and to each node by hostname
+type inventory struct {
+	All   map[string]interface{}            `json:"all"`
+	Hosts map[string]map[string]interface{} `json:"hosts"`
+}
+
+// SetInventory sets the inventory file of the template variables
+func SetInventory(file string) {
+	inventoryFile = file
+}
+
+// isTemplate tells if a compose file is a Go template: es.tmpl.yml.
+// The templates are opt-in as labels often contain {{ }} for docker.
+func isTemplate(name string) bool {
+	base := strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
+	return hasComposeExt(name) && strings.HasSuffix(base, ".tmpl")
+}
+
+// renderTemplate renders a compose template with the data of the node,
+// the other compose files are returned as is
+func renderTemplate(name string, in []byte) ([]byte, error) {
+	if !isTemplate(name) {
+		return in, nil
+	}
+
+	data, err := nodeTemplateData()
+	if err != nil {
+		return nil, err
+	}
+
+	tpl, err := parseTemplate(name, in)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	if err := tpl.Execute(&out, data); err != nil {
+		return nil, err
+	}
+
+	// A variable not defined and without default is rendered as <no value>
+	for i, line := range strings.Split(out.String(), "\n") {
+		if strings.Contains(line, noValue) {
+			return nil, fmt.Errorf("template: %s:%d: undefined variable", filepath.Base(name), i+1)
+		}
+	}
+
+	return out.Bytes(), nil
+}
+
+func parseTemplate(name string, in []byte) (*template.Template, error) {
+	return template.New(filepath.Base(name)).
+		Funcs(templateFuncs).
+		Parse(string(in))
+}
+
+// checkDefinition checks a compose definition sent to the agents: the
+// templates are rendered by each node so only their syntax is checked
+func checkDefinition(name string, in []byte) error {
+	if isTemplate(name) {
+		_, err := parseTemplate(name, in)
+		return err
+	}
+	_, err := parseCompose(name, in)
+	return err
+}
+
+// nodeTemplateData gets the variables of the node: the inventory values
+// of all the nodes, then the ones of the node, then the ones of the server
+func nodeTemplateData() (*templateData, error) {
+	vars := map[string]interface{}{}
+
+	inv, err := readInventory()
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range inv.All {
+		vars[k] = v
+	}
+	for k, v := range inv.Hosts[hostname] {
+		vars[k] = v
+	}
+	for k, v := range getNodeVars() {
+		vars[k] = v
+	}
+
+	return &templateData{Hostname: hostname, Labels: nodeLabels, Vars: vars}, nil
+}
+
+func readInventory() (*inventory, error) {
+	inv := &inventory{}
+	if inventoryFile == "" {
+		return inv, nil
+	}
+
+	in, err := ioutil.ReadFile(inventoryFile)
+	if os.IsNotExist(err) {
+		return inv, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(in, inv); err != nil {
+		return nil, fmt.Errorf("invalid inventory %s: %s", inventoryFile, err)
+	}
+
+	return inv, nil
+}
+
+// getNodeVars gets the key/values of the server for this node,
+// the server is asked at most every 30s
+func getNodeVars() map[string]string {
+	nodeVarsMutex.Lock()
+	defer nodeVarsMutex.Unlock()
+
+	if collectorURL != "" && time.Since(nodeVarsDate) > nodeVarsTTL {
+		vars := map[string]string{}
+		if err := collectorGet("/nodes/vars/"+url.PathEscape(hostname)+"?unredacted=true", &vars); err != nil {
+			logrus.WithError(err).Warn("Fail to get the variables of the node")
+		} else {
+			nodeVars = vars
+		}
+		nodeVarsDate = time.Now()
+	}
+
+	return nodeVars
+}
+
+// templateLine extracts the line of a template error
+func templateLine(err error) int {
+	m := templateErrorLine.FindStringSubmatch(err.Error())
+	if m == nil {
+		return 0
+	}
+	line, _ := strconv.Atoi(m[1])
+	return line
+}
+
+// templateDefault returns the default value when the value is empty:
+// {{ .Vars.heap | default "1g" }}
+func templateDefault(def interface{}, value ...interface{}) interface{} {
+	if len(value) == 0 || value[0] == nil || value[0] == "" {
+		return def
+	}
+	return value[0]
+}
+
+// templateRequired fails the rendering when the value is empty:
+// {{ required "heap is required" .Vars.heap }}
+func templateRequired(message string, value interface{}) (interface{}, error) {
+	if value == nil || value == "" {
+		return nil, errors.New(message)
+	}
+	return value, nil
+}
+
+// GetTemplateData returns the variables given to the compose templates,
+// redacted unless an admin asks for unredacted=true
+func GetTemplateData(c *gin.Context) {
+	redact, ok := redactionFor(c)
+	if !ok {
+		return
+	}
+
+	data, err := nodeTemplateData()
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	if redact {
+		data.Vars = redactDefinition(data.Vars).(map[string]interface{})
+	}
+	c.JSON(200, data)
+}
+
+// GetRenderedComposeFile returns a compose file rendered with the
+// variables of the node, redacted unless an admin asks for unredacted=true
+func GetRenderedComposeFile(c *gin.Context) {
+	redact, ok := redactionFor(c)
+	if !ok {
+		return
+	}
+
+	path, err := editableComposePath(c.Param("name"))
+	if err != nil {
+		c.JSON(400, err.Error())
+		return
+	}
+
+	in, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		c.JSON(404, "compose file not found")
+		return
+	}
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	rendered, err := renderTemplate(path, in)
+	if err != nil {
+		c.JSON(400, err.Error())
+		return
+	}
+
+	if redact {
+		rendered = []byte(redactText(string(rendered)))
+	}
+	c.Data(200, "application/x-yaml", rendered)
+}
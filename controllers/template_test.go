@@ -0,0 +1,217 @@
+package controllers
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// useTemplateData sets the inventory and the variables of the server
+// given to the templates of node1, the returned function restores them
+func useTemplateData(t *testing.T, inv string, vars map[string]string) func() {
+	dir, err := ioutil.TempDir("", "squid-inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "inventory.yml")
+	if err := ioutil.WriteFile(file, []byte(inv), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	previousFile, previousHostname, previousLabels := inventoryFile, hostname, nodeLabels
+	inventoryFile, hostname, nodeLabels = file, "node1", map[string]string{"zone": "eu"}
+	nodeVarsMutex.Lock()
+	previousVars, previousDate, previousURL := nodeVars, nodeVarsDate, collectorURL
+	nodeVars, nodeVarsDate, collectorURL = vars, time.Now(), ""
+	nodeVarsMutex.Unlock()
+
+	return func() {
+		inventoryFile, hostname, nodeLabels = previousFile, previousHostname, previousLabels
+		nodeVarsMutex.Lock()
+		nodeVars, nodeVarsDate, collectorURL = previousVars, previousDate, previousURL
+		nodeVarsMutex.Unlock()
+		os.RemoveAll(dir)
+	}
+}
+
+const testInventory = `all:
+  heap: 1g
+  replicas: 1
+hosts:
+  node1:
+    heap: 4g
+  node2:
+    heap: 8g
+`
+
+func TestIsTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected bool
+	}{
+		{"es.tmpl.yml", true},
+		{"node1/es.tmpl.yaml", true},
+		{"es.yml", false},
+		{"es.tmpl", false},
+		{"tmpl.yml", false},
+		{"es.tmpl.json", false},
+	}
+
+	for _, test := range tests {
+		if template := isTemplate(test.name); template != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, template)
+		}
+	}
+}
+
+func TestNodeTemplateData(t *testing.T) {
+	defer useTemplateData(t, testInventory, map[string]string{"replicas": "3", "token": "s3cr3t"})()
+
+	data, err := nodeTemplateData()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The variables of the server override the ones of the node which
+	// override the ones of all the nodes
+	expected := &templateData{
+		Hostname: "node1",
+		Labels:   map[string]string{"zone": "eu"},
+		Vars:     map[string]interface{}{"heap": "4g", "replicas": "3", "token": "s3cr3t"},
+	}
+	if !reflect.DeepEqual(data, expected) {
+		t.Errorf("expected %+v, got %+v", expected, data)
+	}
+
+	inventoryFile = filepath.Join(filepath.Dir(inventoryFile), "missing.yml")
+	if data, err := nodeTemplateData(); err != nil || data.Vars["heap"] != nil {
+		t.Errorf("expected no inventory, got %+v %v", data, err)
+	}
+
+	if err := ioutil.WriteFile(inventoryFile, []byte("all: [heap]\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nodeTemplateData(); err == nil {
+		t.Error("expected an invalid inventory to fail")
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	defer useTemplateData(t, testInventory, map[string]string{"token": "s3cr3t"})()
+
+	tests := []struct {
+		name     string
+		in       string
+		expected string
+		line     int
+	}{
+		// Not a template
+		{"es.yml", "labels: ['{{ .Name }}']\n", "labels: ['{{ .Name }}']\n", 0},
+		{"es.tmpl.yml", "hostname: {{ .Hostname }}\nzone: {{ .Labels.zone }}\nheap: {{ .Vars.heap }}\n", "hostname: node1\nzone: eu\nheap: 4g\n", 0},
+		{"es.tmpl.yml", "size: {{ .Vars.size | default \"10g\" }}\nheap: {{ .Vars.heap | default \"1g\" }}\n", "size: 10g\nheap: 4g\n", 0},
+		{"es.tmpl.yml", "env: {{ upper (join .Labels.zone) }}\n", "", 1},
+		{"es.tmpl.yml", "zone: {{ .Labels.zone | upper }}\ntoken: {{ required \"token is required\" .Vars.token }}\n", "zone: EU\ntoken: s3cr3t\n", 0},
+		{"es.tmpl.yml", "image: es\nsize: {{ required \"size is required\" .Vars.size }}\n", "", 2},
+		{"es.tmpl.yml", "image: es\n\nsize: {{ .Vars.size }}\n", "", 3},
+		{"es.tmpl.yml", "image: es\nsize: {{ end }}\n", "", 2},
+	}
+
+	for i, test := range tests {
+		out, err := renderTemplate(test.name, []byte(test.in))
+		if test.line > 0 {
+			if err == nil || templateLine(err) != test.line {
+				t.Errorf("%d: expected an error at line %d, got %v", i, test.line, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: %s", i, err)
+			continue
+		}
+		if string(out) != test.expected {
+			t.Errorf("%d: expected %q, got %q", i, test.expected, out)
+		}
+	}
+}
+
+func TestCheckDefinition(t *testing.T) {
+	_, cleanup := useComposesDir(t)
+	defer cleanup()
+	defer useTemplateData(t, testInventory, nil)()
+
+	tests := []struct {
+		name  string
+		in    string
+		valid bool
+	}{
+		{"es.yml", "services:\n  es:\n    image: es\n", true},
+		{"es.yml", "services:\n  es: [\n", false},
+		// The templates are rendered by each node, a variable may be
+		// defined on the nodes only
+		{"es.tmpl.yml", "services:\n  es:\n    image: es:{{ .Vars.version }}\n", true},
+		{"es.tmpl.yml", "services:\n  es:\n    image: es:{{ .Vars.version \n", false},
+	}
+
+	for i, test := range tests {
+		if err := checkDefinition(test.name, []byte(test.in)); (err == nil) != test.valid {
+			t.Errorf("%d: expected valid %v, got %v", i, test.valid, err)
+		}
+	}
+}
+
+func TestGetRenderedComposeFile(t *testing.T) {
+	defer func(admin string) { adminUsername = admin }(adminUsername)
+	adminUsername = "admin"
+	dir, cleanup := useComposesDir(t)
+	defer cleanup()
+	defer useTemplateData(t, testInventory, map[string]string{"token": "s3cr3t"})()
+
+	for name, content := range map[string]string{
+		"es.tmpl.yml":     "services:\n  es:\n    image: es\n    environment:\n      HEAP: {{ .Vars.heap }}\n      API_TOKEN: {{ .Vars.token }}\n",
+		"broken.tmpl.yml": "services:\n  es:\n    image: es:{{ .Vars.version }}\n",
+	} {
+		if err := writeComposeFile(filepath.Join(dir, name), []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		user     string
+		query    string
+		code     int
+		contains []string
+	}{
+		{"es.tmpl.yml", "ba", "", 200, []string{"HEAP: 4g", "API_TOKEN: " + redactedValue}},
+		{"es.tmpl.yml", "ba", "?unredacted=true", 403, nil},
+		{"es.tmpl.yml", "admin", "?unredacted=true", 200, []string{"HEAP: 4g", "API_TOKEN: s3cr3t"}},
+		{"broken.tmpl.yml", "ba", "", 400, []string{"undefined variable"}},
+		{"kibana.tmpl.yml", "ba", "", 404, nil},
+		{"../es.tmpl.yml", "ba", "", 400, nil},
+	}
+
+	for _, test := range tests {
+		c, w, _ := gin.CreateTestContext()
+		c.Request, _ = http.NewRequest("GET", "/api/compose/files/"+test.name+"/rendered"+test.query, nil)
+		c.Params = gin.Params{{Key: "name", Value: test.name}}
+		c.Set(gin.AuthUserKey, test.user)
+		GetRenderedComposeFile(c)
+
+		if w.Code != test.code {
+			t.Errorf("%s by %s: expected %d, got %d %s", test.name, test.user, test.code, w.Code, w.Body.String())
+			continue
+		}
+		for _, s := range test.contains {
+			if !strings.Contains(w.Body.String(), s) {
+				t.Errorf("%s by %s: expected %q in %s", test.name, test.user, s, w.Body.String())
+			}
+		}
+	}
+}
@@ -1,8 +1,12 @@
 package controllers
 
 import (
+	"context"
 	"encoding/json"
+	"net/http"
+	"os"
 	"os/exec"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -12,85 +16,441 @@ import (
 )
 
 var (
-	historyResults = []*cmdResult{}
-	mx             sync.RWMutex
+	deployTimeout = time.Duration(300) * time.Second
+	maxParallel   = 0
+)
+
+// Status of the deployment of one compose file
+const (
+	resultSuccess = "success"
+	resultFailed  = "failed"
+	resultSkipped = "skipped"
+	resultTimeout = "timeout"
+	// The compose file is not placed on this node
+	resultNotScheduled = "notScheduled"
+	// The compose file violates a rule of the policy
+	resultDenied = "denied"
+)
+
+// Kind of execution
+const (
+	kindDeploy   = "deploy"
+	kindRollback = "rollback"
+	kindCanary   = "canary"
+)
+
+// Overall status of an execution
+const (
+	executionSuccess = "success"
+	executionPartial = "partial"
+	executionFailed  = "failed"
 )
 
 type cmdResult struct {
-	Date   int64                  `json:"date"`
-	Cmd    map[string]interface{} `json:"cmd"`
-	Result []string               `json:"result"`
+	Date     int64                  `json:"date"`
+	Node     string                 `json:"node,omitempty"`
+	Compose  string                 `json:"compose"`
+	Status   string                 `json:"status"`
+	ExitCode int                    `json:"exitCode"`
+	Error    string                 `json:"error,omitempty"`
+	Hash     string                 `json:"hash"`
+	Snapshot string                 `json:"snapshot,omitempty"`
+	Cmd      map[string]interface{} `json:"cmd"`
+	Result   []string               `json:"result"`
+
+	Verification *verification `json:"verification,omitempty"`
+	RolledBack   string        `json:"rolledBack,omitempty"`
+	// Warnings are the violations of the policy not denying the deployment
+	Warnings []string `json:"warnings,omitempty"`
+	// Container is the container of a container action
+	Container string `json:"container,omitempty"`
+	// Overlay is the overlay of the node deployed with a common compose file
+	Overlay         string `json:"overlay,omitempty"`
+	OverlaySnapshot string `json:"overlaySnapshot,omitempty"`
+}
+
+type execution struct {
+	ID           string       `json:"id"`
+	Kind         string       `json:"kind"`
+	Date         int64        `json:"date"`
+	Node         string       `json:"node"`
+	User         string       `json:"user"`
+	Status       string       `json:"status"`
+	RollbackOf   string       `json:"rollbackOf,omitempty"`
+	RestoredFrom string       `json:"restoredFrom,omitempty"`
+	Cause        string       `json:"cause,omitempty"`
+	Commit       string       `json:"commit,omitempty"`
+	Decision     string       `json:"decision,omitempty"`
+	Evidence     []string     `json:"evidence,omitempty"`
+	Results      []*cmdResult `json:"results"`
+}
+
+// SetDeployTimeout sets the maximum duration in seconds of one docker-compose up
+func SetDeployTimeout(seconds int) {
+	deployTimeout = time.Duration(seconds) * time.Second
+}
+
+// SetMaxParallel limits the number of docker-compose up running at the same time (0 for no limit)
+func SetMaxParallel(max int) {
+	maxParallel = max
 }
 
+// deployRequest is the body of a deployment applying new definitions
+// of compose files before starting them
+type deployRequest struct {
+	Files       []string          `json:"files"`
+	Definitions map[string]string `json:"definitions"`
+	// Force deploys even if host ports are already bound
+	Force bool `json:"force"`
+}
+
+// ComposeUp deploys all the compose files or only the ones given
+// by the file query parameters, force=true deploys them even if
+// their host ports are already bound
 func ComposeUp(c *gin.Context) {
-	now := time.Now().UnixNano()
+	// Get the compose files assigned by the server first
+	if err := syncCatalog(); err != nil {
+		c.JSON(502, "fail to sync the catalog: "+err.Error())
+		return
+	}
+
+	composeFiles, err := selectComposeFiles(c.Request.URL.Query()["file"])
+	if err != nil {
+		c.JSON(errorStatus(err), err.Error())
+		return
+	}
+
+	unlock, err := lockDeploy(c, composeFiles)
+	if err != nil {
+		c.JSON(errorStatus(err), err.Error())
+		return
+	}
+	defer unlock()
+
+	if c.Query("force") != "true" {
+		if err := checkPortConflicts(composeFiles, nil); err != nil {
+			c.JSON(errorStatus(err), err.Error())
+			return
+		}
+	}
+
+	composeUpAndRecord(c, composeFiles)
+}
 
-	composeFiles, err := listComposeFiles()
+// ComposeApply writes the definitions of compose files and deploys them
+func ComposeApply(c *gin.Context) {
+	var req deployRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(400, err.Error())
+		return
+	}
+
+	definitions := map[string][]byte{}
+	for name, definition := range req.Definitions {
+		path, err := composeFilePath(name)
+		if err != nil {
+			c.JSON(400, err.Error())
+			return
+		}
+		compose, err := parseCompose(name, []byte(definition))
+		if err != nil {
+			c.JSON(400, name+": "+err.Error())
+			return
+		}
+		if denied := deniedBy(evaluatePolicy(compose)); denied != "" {
+			c.JSON(403, name+": "+denied)
+			return
+		}
+		definitions[path] = []byte(definition)
+	}
+
+	composeFiles := []string{}
+	for path := range definitions {
+		composeFiles = append(composeFiles, path)
+	}
+	if len(req.Files) > 0 || len(composeFiles) == 0 {
+		files, err := selectComposeFiles(req.Files)
+		if err != nil {
+			c.JSON(errorStatus(err), err.Error())
+			return
+		}
+		for _, path := range files {
+			if _, ok := definitions[path]; !ok {
+				composeFiles = append(composeFiles, path)
+			}
+		}
+	}
+	sort.Strings(composeFiles)
+
+	unlock, err := lockDeploy(c, composeFiles)
 	if err != nil {
-		handleError(c, err)
+		c.JSON(errorStatus(err), err.Error())
+		return
+	}
+	defer unlock()
+
+	if !req.Force {
+		if err := checkPortConflicts(composeFiles, definitions); err != nil {
+			c.JSON(errorStatus(err), err.Error())
+			return
+		}
+	}
+
+	for path, definition := range definitions {
+		if err := writeComposeFile(path, definition); err != nil {
+			handleError(c, err)
+			return
+		}
+	}
+
+	composeUpAndRecord(c, composeFiles)
+}
+
+func composeUpAndRecord(c *gin.Context, composeFiles []string) {
+	e := deploy(kindDeploy, composeFiles)
+	e.User = authUser(c)
+	rollbacks := rollbackUnhealthy(e)
+	recordExecution(e)
+	for _, rb := range rollbacks {
+		recordExecution(rb)
+	}
+
+	respondExecution(c, e)
+}
+
+// respondExecution answers with an execution redacted unless an admin
+// asks for the secrets
+func respondExecution(c *gin.Context, e *execution) {
+	if c.Query("unredacted") == "true" && isAdmin(c) {
+		c.JSON(e.httpStatus(), e)
 		return
 	}
+	c.JSON(e.httpStatus(), e.redacted())
+}
+
+// selectComposeFiles resolves the paths of the given compose files names
+// or lists all the compose files when no name is given
+func selectComposeFiles(names []string) ([]string, error) {
+	if len(names) == 0 {
+		return listComposeFiles()
+	}
+
+	composeFiles := []string{}
+	seen := map[string]bool{}
+	for _, name := range names {
+		path, err := composeFilePath(name)
+		if err != nil {
+			return nil, badRequestError(err.Error())
+		}
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return nil, notFoundError("compose file " + name + " not found")
+		}
+		if !seen[path] {
+			seen[path] = true
+			composeFiles = append(composeFiles, path)
+		}
+	}
+
+	return composeFiles, nil
+}
+
+// deploy runs docker-compose up on each compose file in parallel
+// and gathers one result per file
+func deploy(kind string, composeFiles []string) *execution {
+	now := time.Now().Unix()
 
 	nbComposes := len(composeFiles)
 	results := make([]*cmdResult, nbComposes)
 
+	parallel := maxParallel
+	if parallel <= 0 || parallel > nbComposes {
+		parallel = nbComposes
+	}
+	slots := make(chan struct{}, parallel)
+
 	var wg sync.WaitGroup
 	wg.Add(nbComposes)
 
 	for index, composeFile := range composeFiles {
 		go func(i int, compose string) {
 			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			results[i] = composeUp(now, compose)
+		}(index, composeFile)
+	}
 
-			// Exec docker-compose up using doo
-			cmd := exec.Command("doo", "-q", "dc", compose, "up", "-d")
+	wg.Wait()
 
-			stdout, err := cmd.CombinedOutput()
-			if err != nil {
-				handleError(c, err)
-				return
-			}
+	return &execution{
+		Kind:    kind,
+		Date:    now,
+		Status:  executionStatus(results),
+		Results: results,
+	}
+}
 
-			lines := strings.Split(string(stdout), "\n")
-			// Forget the empty last line and
-			// unmarshal the penultimate line in json
-			in := lines[len(lines)-2]
-			var data map[string]interface{}
-			err = json.Unmarshal([]byte(in), &data)
-			if err != nil {
-				logrus.WithError(err).Errorf("Fail to execute: doo -q dc %s up -d", compose)
-				handleError(c, err)
-				return
-			}
+// composeUp executes docker-compose up using doo on a single compose file
+func composeUp(date int64, compose string) *cmdResult {
+	result := &cmdResult{
+		Date:     date,
+		Compose:  compose,
+		ExitCode: -1,
+		Result:   []string{},
+	}
 
-			results[i] = &cmdResult{
-				Date:   now,
-				Cmd:    data,
-				Result: lines[:len(lines)-2],
-			}
-		}(index, composeFile)
+	// Do not try to start a compose file that can't be read
+	in, overlay, overlayIn, err := readComposeLayers(compose)
+	if err != nil {
+		result.Status = resultSkipped
+		result.Error = err.Error()
+		return result
 	}
 
-	wg.Wait()
+	// Keep a snapshot of what is deployed, with the overlay of the node
+	result.Hash = layersHash(in, overlay, overlayIn)
+	result.Snapshot = string(in)
+	if overlay != "" {
+		result.Overlay = overlay
+		result.OverlaySnapshot = string(overlayIn)
+	}
+
+	parsed, err := loadCompose(compose)
+	if err != nil {
+		result.Status = resultSkipped
+		result.Error = err.Error()
+		return result
+	}
 
-	// Historizes the last result
-	mx.Lock()
-	defer mx.Unlock()
-	for i := 0; i < nbComposes; i++ {
-		historyResults = append(historyResults, results[i])
+	parsed.File = composeName(compose)
+	violations := evaluatePolicy(parsed)
+	if denied := deniedBy(violations); denied != "" {
+		result.Status = resultDenied
+		result.Error = denied
+		return result
+	}
+	for _, v := range violations {
+		result.Warnings = append(result.Warnings, v.String())
 	}
 
-	c.JSON(200, results)
+	// Deploy the normalized compose file
+	rendered, secrets, err := renderCompose(compose, parsed)
+	if err != nil {
+		result.Status = resultSkipped
+		result.Error = err.Error()
+		return result
+	}
+
+	// Start only the services placed on this node
+	args := []string{"-q", "dc", rendered, "up", "-d"}
+	unscheduled := scheduleCompose(parsed)
+	if len(unscheduled) > 0 {
+		services := scheduledServices(parsed, unscheduled)
+		if len(services) == 0 {
+			result.Status = resultNotScheduled
+			result.Error = unscheduledReason(unscheduled)
+			return result
+		}
+		args = append(args, services...)
+
+		// Verify only the started services
+		for name := range unscheduled {
+			delete(parsed.Services, name)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), deployTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "doo", args...)
+	cmd.Env = append(os.Environ(), secrets...)
+	stdout, err := cmd.CombinedOutput()
+	if cmd.ProcessState != nil {
+		result.ExitCode = cmd.ProcessState.ExitCode()
+	}
+
+	lines, data := parseDooOutput(string(stdout))
+	result.Cmd = data
+	result.Result = lines
+
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		result.Status = resultTimeout
+		result.Error = "timeout after " + deployTimeout.String()
+	case err != nil:
+		result.Status = resultFailed
+		result.Error = err.Error()
+	case data == nil:
+		result.Status = resultFailed
+		result.Error = "fail to parse doo output"
+	default:
+		result.Status = resultSuccess
+	}
+
+	// Wait for the services to be healthy
+	if result.Status == resultSuccess && healthTimeout > 0 {
+		result.Verification = verifyCompose(parsed)
+		if result.Verification.Status != healthHealthy {
+			result.Status = resultFailed
+			result.Error = "unhealthy after " + healthTimeout.String() + ": " + result.Verification.unhealthyServices()
+		}
+	}
+
+	if result.Status != resultSuccess {
+		logrus.WithField("error", result.Error).Errorf("Fail to execute: doo %s", strings.Join(args, " "))
+	}
+
+	return result
+}
+
+// parseDooOutput splits the output of doo in lines and unmarshals
+// the last non empty line in json
+func parseDooOutput(out string) ([]string, map[string]interface{}) {
+	lines := strings.Split(strings.TrimRight(out, "\n"), "\n")
+	if len(lines) == 0 || lines[0] == "" {
+		return []string{}, nil
+	}
+
+	var data map[string]interface{}
+	last := len(lines) - 1
+	if err := json.Unmarshal([]byte(lines[last]), &data); err != nil {
+		return lines, nil
+	}
+
+	return lines[:last], data
 }
 
-func ComposeUpHistory(c *gin.Context) {
-	mx.RLock()
-	defer mx.RUnlock()
+func executionStatus(results []*cmdResult) string {
+	succeeded := 0
+	scheduled := 0
+	for _, result := range results {
+		// The compose files not placed on this node do not count
+		if result.Status == resultNotScheduled {
+			continue
+		}
+		scheduled++
+		if result.Status == resultSuccess {
+			succeeded++
+		}
+	}
 
-	// Display only the last 10 results
-	from := 0
-	if len(historyResults) > 10 {
-		from = len(historyResults) - 10
+	switch {
+	case succeeded == scheduled:
+		return executionSuccess
+	case succeeded == 0:
+		return executionFailed
+	default:
+		return executionPartial
 	}
+}
 
-	c.JSON(200, historyResults[from:])
+func (e *execution) httpStatus() int {
+	switch e.Status {
+	case executionSuccess:
+		return http.StatusOK
+	case executionPartial:
+		return http.StatusMultiStatus
+	default:
+		return http.StatusInternalServerError
+	}
 }
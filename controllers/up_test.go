@@ -0,0 +1,58 @@
+package controllers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDooOutput(t *testing.T) {
+	tests := []struct {
+		out   string
+		lines []string
+		data  map[string]interface{}
+	}{
+		{"", []string{}, nil},
+		{"\n", []string{}, nil},
+		{"Creating web_1\nStarting web_1\n", []string{"Creating web_1", "Starting web_1"}, nil},
+		{"Creating web_1\n{\"ok\":true}\n", []string{"Creating web_1"}, map[string]interface{}{"ok": true}},
+		{"{\"ok\":true}", []string{}, map[string]interface{}{"ok": true}},
+	}
+
+	for _, test := range tests {
+		lines, data := parseDooOutput(test.out)
+		if !reflect.DeepEqual(lines, test.lines) {
+			t.Errorf("%q: expected lines %q, got %q", test.out, test.lines, lines)
+		}
+		if !reflect.DeepEqual(data, test.data) {
+			t.Errorf("%q: expected data %v, got %v", test.out, test.data, data)
+		}
+	}
+}
+
+func TestExecutionStatus(t *testing.T) {
+	results := func(statuses ...string) []*cmdResult {
+		r := []*cmdResult{}
+		for _, status := range statuses {
+			r = append(r, &cmdResult{Status: status})
+		}
+		return r
+	}
+
+	tests := []struct {
+		results  []*cmdResult
+		expected string
+	}{
+		{results(resultSuccess, resultSuccess), executionSuccess},
+		{results(resultSuccess, resultNotScheduled), executionSuccess},
+		{results(resultNotScheduled), executionSuccess},
+		{results(resultSuccess, resultFailed), executionPartial},
+		{results(resultFailed, resultNotScheduled), executionFailed},
+		{results(resultFailed, resultFailed), executionFailed},
+	}
+
+	for i, test := range tests {
+		if status := executionStatus(test.results); status != test.expected {
+			t.Errorf("%d: expected %s, got %s", i, test.expected, status)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package controllers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	serverVars = varsStore{Global: map[string]string{}, Nodes: map[string]map[string]string{}}
+	vmx        sync.RWMutex
+	varsFile   = "vars.json"
+)
+
+// varsStore are the key/values of the server given to the compose
+// templates of the agents, the ones of a node override the global ones
+type varsStore struct {
+	Global map[string]string            `json:"global"`
+	Nodes  map[string]map[string]string `json:"nodes"`
+}
+
+// InitVars loads the key/values of the server persisted in a file
+func InitVars(file string) error {
+	vmx.Lock()
+	defer vmx.Unlock()
+
+	varsFile = file
+	if varsFile == "" {
+		return nil
+	}
+
+	in, err := ioutil.ReadFile(varsFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	store := varsStore{}
+	if err := json.Unmarshal(in, &store); err != nil {
+		return err
+	}
+	if store.Global == nil {
+		store.Global = map[string]string{}
+	}
+	if store.Nodes == nil {
+		store.Nodes = map[string]map[string]string{}
+	}
+	serverVars = store
+
+	return nil
+}
+
+// ListVars returns the global key/values and the ones of each node,
+// redacted unless an admin asks for unredacted=true
+func ListVars(c *gin.Context) {
+	redact, ok := redactionFor(c)
+	if !ok {
+		return
+	}
+
+	vmx.RLock()
+	defer vmx.RUnlock()
+
+	if !redact {
+		c.JSON(200, serverVars)
+		return
+	}
+
+	redacted := varsStore{Global: redactVars(serverVars.Global), Nodes: map[string]map[string]string{}}
+	for node, vars := range serverVars.Nodes {
+		redacted.Nodes[node] = redactVars(vars)
+	}
+	c.JSON(200, redacted)
+}
+
+// GetNodeVars returns the key/values of a node merged over the global ones,
+// redacted unless an admin or an agent asks for unredacted=true
+func GetNodeVars(c *gin.Context) {
+	redact, ok := agentRedactionFor(c)
+	if !ok {
+		return
+	}
+
+	vmx.RLock()
+	defer vmx.RUnlock()
+
+	vars := map[string]string{}
+	for k, v := range serverVars.Global {
+		vars[k] = v
+	}
+	for k, v := range serverVars.Nodes[c.Param("node")] {
+		vars[k] = v
+	}
+
+	if redact {
+		vars = redactVars(vars)
+	}
+	c.JSON(200, vars)
+}
+
+// PutVar sets a global key/value or the one of the node given in query,
+// the body is the JSON string value
+func PutVar(c *gin.Context) {
+	var value string
+	if err := c.BindJSON(&value); err != nil {
+		c.JSON(400, err.Error())
+		return
+	}
+
+	vmx.Lock()
+	defer vmx.Unlock()
+
+	key, node := c.Param("key"), c.Query("node")
+	if node == "" {
+		serverVars.Global[key] = value
+	} else {
+		if serverVars.Nodes[node] == nil {
+			serverVars.Nodes[node] = map[string]string{}
+		}
+		serverVars.Nodes[node][key] = value
+	}
+
+	if err := saveVars(); err != nil {
+		handleError(c, err)
+		return
+	}
+
+	c.JSON(200, value)
+}
+
+// DeleteVar removes a global key/value or the one of the node given in query
+func DeleteVar(c *gin.Context) {
+	vmx.Lock()
+	defer vmx.Unlock()
+
+	key, node := c.Param("key"), c.Query("node")
+	if node == "" {
+		delete(serverVars.Global, key)
+	} else {
+		delete(serverVars.Nodes[node], key)
+		if len(serverVars.Nodes[node]) == 0 {
+			delete(serverVars.Nodes, node)
+		}
+	}
+
+	if err := saveVars(); err != nil {
+		handleError(c, err)
+		return
+	}
+
+	c.JSON(200, true)
+}
+
+func saveVars() error {
+	if varsFile == "" {
+		return nil
+	}
+
+	out, err := json.MarshalIndent(serverVars, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeComposeFile(varsFile, out)
+}
@@ -0,0 +1,215 @@
+package controllers
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Opcodes of the WebSocket frames (RFC 6455)
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+
+	wsGUID           = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsMaxMessageSize = 1024 * 1024
+)
+
+// wsConn is a server side WebSocket connection, enough for the
+// terminals: messages are read by one goroutine, written by any
+type wsConn struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+	wmx  sync.Mutex
+}
+
+// upgradeWebSocket answers the WebSocket handshake of a request and
+// takes over its connection. The requests of other origins are refused.
+func upgradeWebSocket(c *gin.Context) (*wsConn, error) {
+	req := c.Request
+	if !headerContains(req.Header.Get("Connection"), "upgrade") || !headerContains(req.Header.Get("Upgrade"), "websocket") {
+		return nil, badRequestError("websocket upgrade expected")
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, badRequestError("websocket version 13 expected")
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, badRequestError("websocket key expected")
+	}
+	if origin := req.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || u.Host != req.Host {
+			return nil, httpError{code: 403, msg: "websocket origin not allowed"}
+		}
+	}
+
+	conn, rw, err := c.Writer.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha1.Sum([]byte(key + wsGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(hash[:]) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &wsConn{conn: conn, rw: rw}, nil
+}
+
+func headerContains(header string, token string) bool {
+	for _, value := range strings.Split(header, ",") {
+		if strings.EqualFold(strings.TrimSpace(value), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadMessage reads the next text or binary message, the pings are
+// answered and io.EOF is returned when the client closes the connection
+func (ws *wsConn) ReadMessage() (byte, []byte, error) {
+	var opcode byte
+	message := []byte{}
+
+	for {
+		fin, op, payload, err := ws.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch op {
+		case wsPing:
+			if err := ws.WriteMessage(wsPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			// The close frame is answered by CloseWith
+			return 0, nil, io.EOF
+		case wsText, wsBinary:
+			if opcode != 0 {
+				return 0, nil, errors.New("websocket message interrupted by another message")
+			}
+			opcode = op
+			message = payload
+		case wsContinuation:
+			if opcode == 0 {
+				return 0, nil, errors.New("websocket continuation without message")
+			}
+			message = append(message, payload...)
+		default:
+			return 0, nil, errors.New("unknown websocket opcode")
+		}
+
+		if len(message) > wsMaxMessageSize {
+			return 0, nil, errors.New("websocket message too large")
+		}
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+// readFrame reads a frame, the frames of the clients are masked
+func (ws *wsConn) readFrame() (bool, byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(ws.rw, header); err != nil {
+		return false, 0, nil, err
+	}
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+
+	size := uint64(header[1] & 0x7F)
+	switch size {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(ws.rw, ext); err != nil {
+			return false, 0, nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(ws.rw, ext); err != nil {
+			return false, 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(ext)
+	}
+	if !masked {
+		return false, 0, nil, errors.New("websocket frame of the client not masked")
+	}
+	if size > wsMaxMessageSize {
+		return false, 0, nil, errors.New("websocket frame too large")
+	}
+	// The control frames (close, ping, pong) are never fragmented
+	if opcode&0x8 != 0 && (!fin || size > 125) {
+		return false, 0, nil, errors.New("websocket control frame fragmented or too large")
+	}
+
+	mask := make([]byte, 4)
+	if _, err := io.ReadFull(ws.rw, mask); err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(ws.rw, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// WriteMessage writes a message in a single frame, not masked
+func (ws *wsConn) WriteMessage(opcode byte, data []byte) error {
+	ws.wmx.Lock()
+	defer ws.wmx.Unlock()
+
+	header := []byte{0x80 | opcode}
+	switch size := len(data); {
+	case size < 126:
+		header = append(header, byte(size))
+	case size <= 0xFFFF:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(size))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(size))
+	}
+
+	if _, err := ws.rw.Write(header); err != nil {
+		return err
+	}
+	if _, err := ws.rw.Write(data); err != nil {
+		return err
+	}
+	return ws.rw.Flush()
+}
+
+// CloseWith sends a close frame with a reason then closes the connection
+func (ws *wsConn) CloseWith(reason string) error {
+	// Status 1000: normal closure
+	ws.WriteMessage(wsClose, append([]byte{0x03, 0xE8}, reason...))
+	return ws.conn.Close()
+}
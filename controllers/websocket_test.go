@@ -0,0 +1,216 @@
+package controllers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// wsPipe connects a server WebSocket to a client sending frames, the
+// returned function closes the connection and returns what the server sent
+func wsPipe(frames ...[]byte) (*wsConn, func() []byte) {
+	server, client := net.Pipe()
+
+	go func() {
+		for _, frame := range frames {
+			if _, err := client.Write(frame); err != nil {
+				return
+			}
+		}
+	}()
+	sent := make(chan []byte, 1)
+	go func() {
+		out, _ := ioutil.ReadAll(client)
+		sent <- out
+	}()
+
+	ws := &wsConn{conn: server, rw: bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server))}
+	return ws, func() []byte {
+		server.Close()
+		out := <-sent
+		client.Close()
+		return out
+	}
+}
+
+// clientFrame encodes a frame of a client, masked unless said otherwise
+func clientFrame(fin bool, opcode byte, payload []byte, masked bool) []byte {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	frame := []byte{first}
+
+	maskBit := byte(0)
+	if masked {
+		maskBit = 0x80
+	}
+	switch size := len(payload); {
+	case size < 126:
+		frame = append(frame, maskBit|byte(size))
+	case size <= 0xFFFF:
+		frame = append(frame, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(size))
+	default:
+		frame = append(frame, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(size))
+	}
+	if !masked {
+		return append(frame, payload...)
+	}
+
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+// serverFrame decodes a frame sent by the server
+func serverFrame(t *testing.T, in []byte) (bool, byte, []byte, []byte) {
+	if len(in) < 2 {
+		t.Fatalf("expected a frame, got %v", in)
+	}
+	if in[1]&0x80 != 0 {
+		t.Fatal("expected a frame of the server not masked")
+	}
+	size, header := uint64(in[1]&0x7F), 2
+	switch size {
+	case 126:
+		size, header = uint64(binary.BigEndian.Uint16(in[2:])), 4
+	case 127:
+		size, header = binary.BigEndian.Uint64(in[2:]), 10
+	}
+	end := header + int(size)
+	return in[0]&0x80 != 0, in[0] & 0x0F, in[header:end], in[end:]
+}
+
+func TestReadMessage(t *testing.T) {
+	medium := bytes.Repeat([]byte("m"), 300)
+	large := bytes.Repeat([]byte("l"), 70000)
+	half := bytes.Repeat([]byte("h"), wsMaxMessageSize/2+1)
+	tooLarge := []byte{0x82, 0x80 | 127, 0, 0, 0, 0, 0, 0x10, 0, 1}
+
+	tests := []struct {
+		name    string
+		frames  [][]byte
+		opcode  byte
+		message []byte
+		err     bool
+		pong    []byte
+	}{
+		{"text", [][]byte{clientFrame(true, wsText, []byte("hello"), true)}, wsText, []byte("hello"), false, nil},
+		{"empty", [][]byte{clientFrame(true, wsText, []byte{}, true)}, wsText, []byte{}, false, nil},
+		{"16 bits length", [][]byte{clientFrame(true, wsBinary, medium, true)}, wsBinary, medium, false, nil},
+		{"64 bits length", [][]byte{clientFrame(true, wsBinary, large, true)}, wsBinary, large, false, nil},
+		{"continuation", [][]byte{
+			clientFrame(false, wsText, []byte("hel"), true),
+			clientFrame(false, wsContinuation, []byte("l"), true),
+			clientFrame(true, wsContinuation, []byte("o"), true),
+		}, wsText, []byte("hello"), false, nil},
+		{"ping between fragments", [][]byte{
+			clientFrame(false, wsText, []byte("hel"), true),
+			clientFrame(true, wsPing, []byte("are you there"), true),
+			clientFrame(true, wsContinuation, []byte("lo"), true),
+		}, wsText, []byte("hello"), false, []byte("are you there")},
+		{"pong ignored", [][]byte{
+			clientFrame(true, wsPong, []byte("hi"), true),
+			clientFrame(true, wsText, []byte("hello"), true),
+		}, wsText, []byte("hello"), false, nil},
+		{"not masked", [][]byte{clientFrame(true, wsText, []byte("hello"), false)}, 0, nil, true, nil},
+		{"continuation without message", [][]byte{clientFrame(true, wsContinuation, []byte("lo"), true)}, 0, nil, true, nil},
+		{"message interrupted", [][]byte{
+			clientFrame(false, wsText, []byte("hel"), true),
+			clientFrame(true, wsText, []byte("lo"), true),
+		}, 0, nil, true, nil},
+		{"unknown opcode", [][]byte{clientFrame(true, 0x3, []byte("hello"), true)}, 0, nil, true, nil},
+		{"fragmented ping", [][]byte{clientFrame(false, wsPing, []byte("hi"), true)}, 0, nil, true, nil},
+		{"large ping", [][]byte{clientFrame(true, wsPing, medium, true)}, 0, nil, true, nil},
+		{"frame too large", [][]byte{tooLarge}, 0, nil, true, nil},
+		{"message too large", [][]byte{
+			clientFrame(false, wsBinary, half, true),
+			clientFrame(true, wsContinuation, half, true),
+		}, 0, nil, true, nil},
+	}
+
+	for _, test := range tests {
+		ws, closeWS := wsPipe(test.frames...)
+		opcode, message, err := ws.ReadMessage()
+		sent := closeWS()
+
+		if (err != nil) != test.err {
+			t.Errorf("%s: expected an error %v, got %v", test.name, test.err, err)
+			continue
+		}
+		if opcode != test.opcode || !bytes.Equal(message, test.message) {
+			t.Errorf("%s: expected %d %q, got %d %q", test.name, test.opcode, truncate(string(test.message), 20), opcode, truncate(string(message), 20))
+		}
+		if test.pong == nil {
+			if len(sent) != 0 {
+				t.Errorf("%s: expected nothing sent, got %v", test.name, sent)
+			}
+			continue
+		}
+		fin, op, payload, rest := serverFrame(t, sent)
+		if !fin || op != wsPong || !bytes.Equal(payload, test.pong) || len(rest) != 0 {
+			t.Errorf("%s: expected the pong %q, got %v %d %q", test.name, test.pong, fin, op, payload)
+		}
+	}
+}
+
+func TestReadMessageClose(t *testing.T) {
+	ws, closeWS := wsPipe(clientFrame(true, wsClose, []byte{0x03, 0xE8}, true))
+	defer closeWS()
+
+	if _, _, err := ws.ReadMessage(); err != io.EOF {
+		t.Errorf("expected the end of the connection, got %v", err)
+	}
+}
+
+func TestWriteMessage(t *testing.T) {
+	tests := []struct {
+		size   int
+		header int
+	}{
+		{0, 2},
+		{125, 2},
+		{126, 4},
+		{0xFFFF, 4},
+		{0x10000, 10},
+	}
+
+	for _, test := range tests {
+		data := bytes.Repeat([]byte("d"), test.size)
+		ws, closeWS := wsPipe()
+		if err := ws.WriteMessage(wsBinary, data); err != nil {
+			t.Fatal(err)
+		}
+		sent := closeWS()
+
+		fin, op, payload, rest := serverFrame(t, sent)
+		if !fin || op != wsBinary || !bytes.Equal(payload, data) || len(rest) != 0 {
+			t.Errorf("%d bytes: unexpected frame %v %d of %d bytes", test.size, fin, op, len(payload))
+		}
+		if len(sent)-test.size != test.header {
+			t.Errorf("%d bytes: expected a header of %d bytes, got %d", test.size, test.header, len(sent)-test.size)
+		}
+	}
+}
+
+func TestCloseWith(t *testing.T) {
+	ws, closeWS := wsPipe()
+	if err := ws.CloseWith("exit 0"); err != nil {
+		t.Fatal(err)
+	}
+	sent := closeWS()
+
+	fin, op, payload, _ := serverFrame(t, sent)
+	if !fin || op != wsClose || !bytes.Equal(payload, []byte("\x03\xE8exit 0")) {
+		t.Errorf("expected a normal closure, got %v %d %q", fin, op, payload)
+	}
+}
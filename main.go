@@ -13,10 +13,55 @@ import (
 )
 
 var (
-	creds = flag.String("creds", "ba:zinga", "Basic auth credentials (username:password)")
+	creds      = flag.String("creds", "ba:zinga", "Basic auth credentials (username:password)")
+	adminCreds = flag.String("admin-creds", "", "Basic auth credentials of the admin allowed to see the secrets (username:password)")
+	agentCreds = flag.String("agent-creds", "", "Basic auth credentials the agents and the server call each other with, allowed to get the unredacted catalog and variables (username:password, the ones of -creds by default)")
 
-	collector = flag.String("join", "", "Squid server URL")
-	period    = flag.Int("p", 20, "Interval to report status in seconds")
+	redactKeys = flag.String("redact-keys", "password,passwd,secret,token,apikey,api_key,private_key,credential", "Substrings of the keys whose values are redacted (comma separated)")
+	redactURLs = flag.Bool("redact-urls", true, "Redact the passwords of the URLs with credentials")
+	redactEnv  = flag.Bool("redact-environment", false, "Redact all the values of the environment and labels of the services")
+
+	collector    = flag.String("join", "", "Squid server URL")
+	lockFailOpen = flag.Bool("lock-fail-open", false, "Deploy when the squid server can't be reached to check the global lock")
+	period       = flag.Int("p", 20, "Interval to report status in seconds")
+
+	deployTimeout = flag.Int("deploy-timeout", 300, "Maximum duration of a compose file deployment in seconds")
+	healthTimeout = flag.Int("health-timeout", 0, "Time to wait for deployed services to be healthy in seconds (0 to disable)")
+	autoRollback  = flag.Bool("auto-rollback", false, "Roll back compose files whose services are not healthy after deploy")
+	maxParallel   = flag.Int("max-parallel", 0, "Maximum number of compose files deployed at the same time (0 for no limit)")
+	historyFile   = flag.String("history-file", "history.json", "File to persist the executions history (empty to keep it in memory)")
+	historySize   = flag.Int("history-size", 500, "Maximum number of executions kept in history")
+	versionsDir   = flag.String("versions-dir", "versions", "Directory where the previous versions of the edited compose files are kept")
+	versionsKept  = flag.Int("versions-kept", 10, "Number of previous versions kept by compose file")
+
+	gitRepo   = flag.String("git-repo", "", "Git repository to check out in the compose directory (gitops mode)")
+	gitRef    = flag.String("git-ref", "master", "Branch or tag of the git repository to check out")
+	gitPeriod = flag.Int("git-period", 60, "Interval to fetch the git repository in seconds")
+	gitDeploy = flag.Bool("git-deploy", false, "Deploy the compose files changed by a new commit")
+
+	reconcile         = flag.Bool("reconcile", false, "Deploy the compose files when their content changes")
+	reconcilePeriod   = flag.Int("reconcile-period", 10, "Interval to scan the compose files in seconds")
+	reconcileDebounce = flag.Int("reconcile-debounce", 5, "Time without change to wait before deploying in seconds")
+
+	labels      = flag.String("labels", "", "Labels of the node used to place compose files (key=value,key=value)")
+	catalogSync = flag.Bool("catalog-sync", false, "Download the compose files assigned to the node by the server")
+	catalogDir  = flag.String("catalog-dir", "catalog", "Directory where the server stores the compose files catalog")
+
+	policy     = flag.String("policy", "", "Policy rules with their severity (no-privileged=deny,memory-limit=warn,no-latest=deny,no-host-network=warn,registry=deny)")
+	registries = flag.String("registries", "", "Registries the images must come from with the registry policy rule (comma separated)")
+
+	inventory = flag.String("inventory", "inventory.yml", "Inventory of the variables of the compose templates (*.tmpl.yml) by node")
+	varsFile  = flag.String("vars-file", "vars.json", "File to persist the variables given by the server to the compose templates")
+
+	orphanRemove = flag.Bool("orphan-remove", false, "Remove the containers of the compose projects no longer declared in a compose file")
+	orphanGrace  = flag.Int("orphan-grace", 3600, "Time an orphan container is kept before being removed in seconds")
+	orphanIgnore = flag.String("orphan-ignore", "", "Patterns of the names or images of the orphan containers never removed (comma separated)")
+
+	auditFile = flag.String("audit-file", "audit.log", "File where the exec sessions in the containers are recorded")
+
+	secretKey = flag.String("secret-key", "", "File of the key decrypting the ENC[...] values of the compose files")
+
+	advertise = flag.String("advertise", "", "URL the server uses to reach this agent (default http://<hostname>:4242)")
 
 	host     = flag.String("h", "", "Hostname")
 	isServer = flag.Bool("server", false, "Server mode")
@@ -26,6 +71,11 @@ var (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "secret" {
+		secretCommand(os.Args[2:])
+		return
+	}
+
 	flag.Parse()
 
 	if *host == "" {
@@ -38,29 +88,151 @@ func main() {
 
 	setJsServerVar(*isServer)
 
+	controllers.SetHostname(*host)
+	controllers.SetLabels(controllers.ParseLabels(*labels))
+	controllers.SetCatalogDir(*catalogDir)
+	controllers.SetDeployTimeout(*deployTimeout)
+	controllers.SetHealthCheck(*healthTimeout, *autoRollback)
+	controllers.SetMaxParallel(*maxParallel)
+	controllers.SetComposeVersions(*versionsDir, *versionsKept)
+	controllers.SetInventory(*inventory)
+	controllers.SetAuditFile(*auditFile)
+	controllers.SetOrphans(splitList(*orphanIgnore), *orphanGrace, *orphanRemove)
+	if *secretKey != "" {
+		if err := controllers.LoadSecretKey(*secretKey); err != nil {
+			logrus.WithError(err).Fatal("Fail to load the secret key")
+		}
+	}
+	if err := controllers.SetPolicy(controllers.ParseLabels(*policy), splitList(*registries)); err != nil {
+		logrus.WithError(err).Fatal("Invalid policy")
+	}
+	if err := controllers.InitHistory(*historyFile, *historySize); err != nil {
+		logrus.WithError(err).Fatal("Fail to load executions history")
+	}
+	if err := controllers.InitVars(*varsFile); err != nil {
+		logrus.WithError(err).Fatal("Fail to load the template variables")
+	}
+
 	credsParts := strings.Split(*creds, ":")
 	username := credsParts[0]
 	password := credsParts[1]
 
+	accounts := gin.Accounts{username: password}
+	if *adminCreds != "" {
+		adminParts := strings.SplitN(*adminCreds, ":", 2)
+		if len(adminParts) != 2 {
+			logrus.Fatal("Invalid admin credentials, username:password expected")
+		}
+		accounts[adminParts[0]] = adminParts[1]
+		controllers.SetAdmin(adminParts[0])
+	}
+	controllers.SetRedaction(splitList(*redactKeys), *redactURLs, *redactEnv)
+
+	agentUsername, agentPassword := username, password
+	if *agentCreds != "" {
+		agentParts := strings.SplitN(*agentCreds, ":", 2)
+		if len(agentParts) != 2 {
+			logrus.Fatal("Invalid agent credentials, username:password expected")
+		}
+		agentUsername, agentPassword = agentParts[0], agentParts[1]
+		accounts[agentUsername] = agentPassword
+	}
+	// Set before the catalog sync calls the server with them
+	controllers.SetAgentCredentials(agentUsername, agentPassword)
+
 	if *collector != "" {
-		go controllers.SendServicesStatus(*collector, username, password, *period, *host)
+		controllers.SetCollector(*collector)
+		controllers.SetLockFailOpen(*lockFailOpen)
+		go controllers.SendServicesStatus(*collector, agentUsername, agentPassword, *period, *host, *advertise)
+		if *catalogSync {
+			controllers.SetCatalogSync(true)
+			go controllers.SyncCatalog(*period)
+		}
+	}
+
+	if *gitRepo != "" {
+		go controllers.SyncGit(*gitRepo, *gitRef, *gitPeriod, *gitDeploy)
+	}
+	if *reconcile {
+		go controllers.Reconcile(*reconcilePeriod, *reconcileDebounce)
+	}
+
+	if *orphanRemove {
+		go controllers.RemoveOrphans(*period)
 	}
 
 	go controllers.CheckStatus()
 
-	api("squid", username, password,
+	api("squid", accounts,
 		func(r *gin.Engine) {
 			r.GET("/get", controllers.GetAgent)
 		}, func(r *gin.RouterGroup) {
 			r.POST("/nodes/status/:host", controllers.CollectStatus)
 			r.GET("/nodes/status", controllers.Statuses)
+			r.GET("/nodes/ports", controllers.ClusterPorts)
+			r.GET("/nodes/compliance", controllers.ClusterCompliance)
+			r.GET("/nodes/vars/:node", controllers.GetNodeVars)
+			r.GET("/nodes/logs/:node/:name", controllers.NodeContainerLogs)
+			r.POST("/nodes/containers/:node/:name/:action", controllers.NodeContainerAction)
+			r.GET("/vars", controllers.ListVars)
+			r.PUT("/vars/:key", controllers.PutVar)
+			r.DELETE("/vars/:key", controllers.DeleteVar)
 			r.GET("/compose/status", controllers.GetStatus)
 			r.GET("/compose/up", controllers.ComposeUp)
+			r.POST("/compose/up", controllers.ComposeApply)
+			r.POST("/compose/rollback", controllers.ComposeRollback)
 			r.GET("/executions", controllers.ComposeUpHistory)
+			r.GET("/executions/:id", controllers.GetExecution)
+			r.GET("/executions/:id/diff/:other", controllers.DiffExecutions)
+			r.GET("/compose/locks", controllers.ListComposeLocks)
+			r.GET("/compose/lint", controllers.LintComposes)
+			r.GET("/ports", controllers.GetPorts)
+			r.GET("/policy", controllers.GetPolicy)
+			r.GET("/compose/files", controllers.ListComposeFiles)
+			// The names of the files of the layers contain slashes
+			r.GET("/compose/files/*path", controllers.ComposeFileRoute)
+			r.PUT("/compose/files/*path", controllers.ComposeFileRoute)
+			r.DELETE("/compose/files/*path", controllers.ComposeFileRoute)
+			r.GET("/compose/vars", controllers.GetTemplateData)
+			r.GET("/containers/:name/logs", controllers.GetContainerLogs)
+			r.GET("/containers/:name/exec", controllers.ExecContainer)
+			r.POST("/containers/:name/:action", controllers.ContainerAction)
+			r.GET("/audit", controllers.GetAudit)
+			r.GET("/orphans", controllers.ListOrphans)
+			r.POST("/orphans/clean", controllers.CleanOrphans)
+			r.GET("/gitops", controllers.GetGitOps)
+			r.POST("/gitops/sync", controllers.SyncGitOps)
+			r.GET("/lock", controllers.GetLock)
+			r.POST("/lock", controllers.AcquireLock)
+			r.DELETE("/lock", controllers.ReleaseLock)
+			r.GET("/catalog", controllers.ListCatalog)
+			r.GET("/catalog/:name", controllers.GetCatalogFile)
+			r.PUT("/catalog/:name", controllers.PutCatalogFile)
+			r.DELETE("/catalog/:name", controllers.DeleteCatalogFile)
+			r.PUT("/catalog/:name/placement", controllers.PutPlacement)
+			r.GET("/assignments/:node", controllers.GetAssignments)
+			r.POST("/rollouts", controllers.StartRollout)
+			r.GET("/rollouts", controllers.ListRollouts)
+			r.GET("/rollouts/:id", controllers.GetRollout)
+			r.POST("/rollouts/:id/:action", controllers.ControlRollout)
+			r.POST("/canaries", controllers.StartCanary)
+			r.GET("/canaries", controllers.ListCanaries)
+			r.GET("/canaries/:id", controllers.GetCanary)
 			r.GET("/consul/services", controllers.GetConsulServices)
 		})
 }
 
+// splitList splits a comma separated list ignoring the empty elements
+func splitList(s string) []string {
+	list := []string{}
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
 func setJsServerVar(isServer bool) {
 	indexPath := "views/index.html"
 	index, err := ioutil.ReadFile(indexPath)
@@ -80,7 +252,7 @@ func setJsServerVar(isServer bool) {
 	}
 }
 
-func api(name string, username string, password string, f func(r *gin.Engine), g func(r *gin.RouterGroup)) {
+func api(name string, accounts gin.Accounts, f func(r *gin.Engine), g func(r *gin.RouterGroup)) {
 	gin.SetMode(gin.ReleaseMode)
 
 	r := gin.Default()
@@ -107,9 +279,7 @@ func api(name string, username string, password string, f func(r *gin.Engine), g
 
 	f(r)
 
-	a := r.Group("/api", gin.BasicAuth(gin.Accounts{
-		username: password,
-	}))
+	a := r.Group("/api", gin.BasicAuth(accounts))
 
 	g(a)
 
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/thbkrkr/squid/controllers"
+)
+
+// secretCommand encrypts the values to write as ENC[...] in the compose
+// files or generates the key the agents decrypt them with:
+//
+//	squid secret genkey -key secret.key
+//	squid secret encrypt -key secret.key [value]
+func secretCommand(args []string) {
+	if len(args) == 0 {
+		logrus.Fatal("Usage: squid secret genkey|encrypt -key <file> [value]")
+	}
+
+	fs := flag.NewFlagSet("secret "+args[0], flag.ExitOnError)
+	keyFile := fs.String("key", "secret.key", "File of the secret key")
+	fs.Parse(args[1:])
+
+	switch args[0] {
+	case "genkey":
+		if _, err := os.Stat(*keyFile); err == nil {
+			logrus.Fatalf("%s already exists", *keyFile)
+		}
+		if err := controllers.GenerateSecretKey(*keyFile); err != nil {
+			logrus.WithError(err).Fatal("Fail to generate the secret key")
+		}
+
+	case "encrypt":
+		key, err := controllers.ReadSecretKey(*keyFile)
+		if err != nil {
+			logrus.WithError(err).Fatal("Fail to read the secret key")
+		}
+
+		// Read the value from stdin to keep it out of the shell history
+		value := strings.Join(fs.Args(), " ")
+		if fs.NArg() == 0 {
+			line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil && line == "" {
+				logrus.WithError(err).Fatal("Fail to read the value to encrypt")
+			}
+			value = strings.TrimRight(line, "\r\n")
+		}
+
+		encrypted, err := controllers.EncryptSecret(key, value)
+		if err != nil {
+			logrus.WithError(err).Fatal("Fail to encrypt")
+		}
+		fmt.Println(encrypted)
+
+	default:
+		logrus.Fatalf("Unknown secret command %s: genkey or encrypt", args[0])
+	}
+}